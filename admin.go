@@ -0,0 +1,272 @@
+package realip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// overrides are the ranges added and revoked through the admin API. They
+// apply to every handler and survive config reloads, but not restarts.
+var overrides rangeOverrides
+
+type rangeOverrides struct {
+	mu    sync.Mutex
+	state atomic.Value // overrideState
+}
+
+// overrideState is a snapshot of the overrides. It is replaced, never
+// modified, so that requests can use it without locking.
+type overrideState struct {
+	added   []*net.IPNet
+	revoked []*net.IPNet
+}
+
+func (o *rangeOverrides) load() overrideState {
+	state, _ := o.state.Load().(overrideState)
+	return state
+}
+
+// add trusts ranges, undoing earlier revocations of the same ranges.
+func (o *rangeOverrides) add(ranges []*net.IPNet) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state := o.load()
+	state.added = appendNew(state.added, ranges)
+	state.revoked = removeRanges(state.revoked, ranges)
+	o.state.Store(state)
+}
+
+// revoke stops trusting ranges, wherever they are configured.
+func (o *rangeOverrides) revoke(ranges []*net.IPNet) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state := o.load()
+	state.added = removeRanges(state.added, ranges)
+	state.revoked = appendNew(state.revoked, ranges)
+	o.state.Store(state)
+}
+
+// apply removes the revoked ranges from ranges.
+func (s overrideState) apply(ranges []*net.IPNet) []*net.IPNet {
+	if len(s.revoked) == 0 {
+		return ranges
+	}
+	return excludeRanges(ranges, s.revoked)
+}
+
+// appendNew returns a copy of list with the ranges it doesn't contain yet.
+func appendNew(list, ranges []*net.IPNet) []*net.IPNet {
+	out := append([]*net.IPNet{}, list...)
+	for _, r := range ranges {
+		if len(removeRanges(out, []*net.IPNet{r})) == len(out) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// removeRanges returns a copy of list without the ranges.
+func removeRanges(list, ranges []*net.IPNet) []*net.IPNet {
+	var out []*net.IPNet
+	for _, l := range list {
+		found := false
+		for _, r := range ranges {
+			if l.String() == r.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// handlers are the provisioned handlers, in order of provisioning.
+var handlers struct {
+	sync.Mutex
+	list []*module
+}
+
+func registerHandler(m *module) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	handlers.list = append(handlers.list, m)
+}
+
+func unregisterHandler(m *module) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	for i, h := range handlers.list {
+		if h == m {
+			handlers.list = append(handlers.list[:i:i], handlers.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// adminAPI serves /realip/ranges on the admin endpoint: GET lists the
+// ranges each handler trusts and where they come from, POST trusts a range
+// and DELETE revokes one, until Caddy is restarted. /realip/trusted shows
+// the compiled set of each handler, and /realip/presets the status of the
+// live presets.
+type adminAPI struct{}
+
+// provenance is a trusted range along with where it comes from: "from",
+// "admin", the name of a source or the header of a binding.
+type provenance struct {
+	Range  string `json:"range"`
+	Source string `json:"source"`
+}
+
+// rangesResponse is the response to GET requests.
+type rangesResponse struct {
+	Handlers [][]provenance `json:"handlers"`
+	Added    []string       `json:"added"`
+	Revoked  []string       `json:"revoked"`
+}
+
+// compiledResponse is the compiled set of a handler, in the response to
+// /realip/trusted.
+type compiledResponse struct {
+	Ranges   []provenance `json:"ranges"`
+	Overlaps []overlap    `json:"overlaps"`
+}
+
+// rangesRequest is the body of POST and DELETE requests.
+type rangesRequest struct {
+	Range string `json:"range"`
+}
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "admin.api.realip",
+		New: func() caddy.Module {
+			return new(adminAPI)
+		},
+	}
+}
+
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/realip/ranges", Handler: caddy.AdminHandlerFunc(a.handleRanges)},
+		{Pattern: "/realip/trusted", Handler: caddy.AdminHandlerFunc(a.handleTrusted)},
+		{Pattern: "/realip/presets", Handler: caddy.AdminHandlerFunc(a.handlePresets)},
+	}
+}
+
+// handleTrusted lists the compiled ranges every handler trusts for its
+// headers, for debugging, along with the ranges dropped as redundant.
+func (adminAPI) handleTrusted(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+	state := overrides.load()
+	resp := []compiledResponse{}
+	handlers.Lock()
+	defer handlers.Unlock()
+	for _, m := range handlers.list {
+		ranges, overlaps := m.compiled(state)
+		resp = append(resp, compiledResponse{Ranges: ranges, Overlaps: overlaps})
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// handlePresets lists the live presets in use and whether they still use
+// their embedded snapshot.
+func (adminAPI) handlePresets(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+	return json.NewEncoder(w).Encode(livePresets())
+}
+
+func (adminAPI) handleRanges(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return json.NewEncoder(w).Encode(currentRanges())
+	case http.MethodPost, http.MethodDelete:
+		ranges, err := requestRanges(r)
+		if err != nil {
+			return caddy.APIError{Code: http.StatusBadRequest, Err: err}
+		}
+		if r.Method == http.MethodPost {
+			overrides.add(ranges)
+		} else {
+			overrides.revoke(ranges)
+		}
+		return nil
+	default:
+		return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+}
+
+// requestRanges returns the range of a POST or DELETE request, given in
+// the range query parameter or in the body. Like from, it may be a CIDR
+// range, a single address or a preset.
+func requestRanges(r *http.Request) ([]*net.IPNet, error) {
+	value := r.URL.Query().Get("range")
+	if value == "" {
+		var body rangesRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, fmt.Errorf("decoding request body: %v", err)
+		}
+		value = body.Range
+	}
+	if value == "" {
+		return nil, fmt.Errorf("missing range")
+	}
+	return parseRanges([]string{strings.TrimSpace(value)})
+}
+
+// currentRanges returns the ranges trusted by every handler.
+func currentRanges() rangesResponse {
+	state := overrides.load()
+	resp := rangesResponse{
+		Handlers: [][]provenance{},
+		Added:    rangeStrings(state.added),
+		Revoked:  rangeStrings(state.revoked),
+	}
+	handlers.Lock()
+	defer handlers.Unlock()
+	for _, m := range handlers.list {
+		resp.Handlers = append(resp.Handlers, m.provenance(state))
+	}
+	return resp
+}
+
+// provenance returns the ranges m trusts and where they come from.
+func (m *module) provenance(state overrideState) []provenance {
+	list := []provenance{}
+	for _, e := range m.trustEntries(state) {
+		list = append(list, provenance{Range: e.ipnet.String(), Source: e.source})
+	}
+	for _, binding := range m.Bindings {
+		for _, r := range state.apply(binding.trusted()) {
+			list = append(list, provenance{Range: r.String(), Source: "binding " + binding.Header})
+		}
+	}
+	return list
+}
+
+func rangeStrings(ranges []*net.IPNet) []string {
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.String()
+	}
+	return out
+}
+
+var _ caddy.AdminRouter = (*adminAPI)(nil)
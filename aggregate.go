@@ -0,0 +1,169 @@
+package realip
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// trustEntry is a trusted range along with where it comes from.
+type trustEntry struct {
+	ipnet  *net.IPNet
+	source string
+}
+
+// overlap describes a trusted range that is redundant because another
+// range, possibly from another source, already covers it.
+type overlap struct {
+	Range           string `json:"range"`
+	Source          string `json:"source"`
+	CoveredBy       string `json:"covered_by"`
+	CoveredBySource string `json:"covered_by_source"`
+}
+
+// compileRanges sorts entries, IPv4 first and then by address and prefix
+// length, and drops those covered by another entry, so that the result
+// doesn't depend on the order sources were configured or refreshed in.
+// The dropped entries are returned as overlaps.
+func compileRanges(entries []trustEntry) ([]trustEntry, []overlap) {
+	sorted := make([]trustEntry, len(entries))
+	for i, e := range entries {
+		ip, ones, bits := normalizeRange(e.ipnet)
+		sorted[i] = trustEntry{ipnet: &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, source: e.source}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].ipnet, sorted[j].ipnet
+		if len(a.IP) != len(b.IP) {
+			return len(a.IP) < len(b.IP)
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		aOnes, _ := a.Mask.Size()
+		bOnes, _ := b.Mask.Size()
+		return aOnes < bOnes
+	})
+
+	// CIDR ranges either nest or are disjoint, so once sorted, a range is
+	// covered exactly if the last one kept contains its address
+	var kept []trustEntry
+	var overlaps []overlap
+	for _, e := range sorted {
+		if n := len(kept); n > 0 {
+			last := kept[n-1]
+			if len(last.ipnet.IP) == len(e.ipnet.IP) && last.ipnet.Contains(e.ipnet.IP) {
+				overlaps = append(overlaps, overlap{
+					Range:           e.ipnet.String(),
+					Source:          e.source,
+					CoveredBy:       last.ipnet.String(),
+					CoveredBySource: last.source,
+				})
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept, overlaps
+}
+
+// mergeRanges returns ranges sorted and without duplicates or ranges
+// covered by others.
+func mergeRanges(ranges []*net.IPNet) []*net.IPNet {
+	entries := make([]trustEntry, len(ranges))
+	for i, r := range ranges {
+		entries[i].ipnet = r
+	}
+	kept, _ := compileRanges(entries)
+	merged := make([]*net.IPNet, len(kept))
+	for i, e := range kept {
+		merged[i] = e.ipnet
+	}
+	return merged
+}
+
+// trustCache holds the compiled trusted ranges of a handler until one of
+// the lists they are compiled from changes.
+type trustCache struct {
+	value atomic.Value // trustCacheEntry
+}
+
+type trustCacheEntry struct {
+	inputs [][]*net.IPNet
+	ranges []*net.IPNet
+}
+
+// get returns the ranges compiled from inputs, calling compile if they
+// differ from the inputs of the cached ranges.
+func (c *trustCache) get(inputs [][]*net.IPNet, compile func() []*net.IPNet) []*net.IPNet {
+	if entry, ok := c.value.Load().(trustCacheEntry); ok && sameInputs(entry.inputs, inputs) {
+		return entry.ranges
+	}
+	ranges := compile()
+	c.value.Store(trustCacheEntry{inputs: inputs, ranges: ranges})
+	return ranges
+}
+
+func sameInputs(a, b [][]*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameRanges(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// trustEntries returns the ranges m trusts for its headers, except those
+// of bindings, and where they come from.
+func (m *module) trustEntries(state overrideState) []trustEntry {
+	var entries []trustEntry
+	add := func(ranges []*net.IPNet, source string) {
+		for _, r := range state.apply(ranges) {
+			entries = append(entries, trustEntry{ipnet: r, source: source})
+		}
+	}
+	add(m.From, "from")
+	for i, source := range m.sources {
+		name := "source"
+		if i < len(m.sourceNames) {
+			name = m.sourceNames[i]
+		}
+		add(source.IPRanges(), name)
+	}
+	add(excludeRanges(state.added, m.Except), "admin")
+	return entries
+}
+
+// compiled returns the ranges m trusts for its headers, merged, along with
+// the ranges that were dropped because others cover them.
+func (m *module) compiled(state overrideState) ([]provenance, []overlap) {
+	kept, overlaps := compileRanges(m.trustEntries(state))
+	list := make([]provenance, len(kept))
+	for i, e := range kept {
+		list[i] = provenance{Range: e.ipnet.String(), Source: e.source}
+	}
+	if overlaps == nil {
+		overlaps = []overlap{}
+	}
+	return list, overlaps
+}
+
+// logOverlaps logs the ranges of m that are covered by others.
+func (m *module) logOverlaps() {
+	if m.logger == nil {
+		return
+	}
+	_, overlaps := m.compiled(overrides.load())
+	for _, o := range overlaps {
+		m.logger.Info("trusted range is covered by another",
+			zap.String("range", o.Range),
+			zap.String("source", o.Source),
+			zap.String("covered_by", o.CoveredBy),
+			zap.String("covered_by_source", o.CoveredBySource))
+	}
+}
@@ -0,0 +1,156 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// asnSource trusts the networks of some autonomous systems, e.g. 13335 for
+// Cloudflare, as listed in an ASN database in MaxMind DB format such as
+// GeoLite2-ASN or IPinfo's ASN database. This is easier to maintain than
+// mirroring a provider's ever-changing prefixes: only the database needs
+// to be kept up to date. The database is reloaded whenever it changes.
+type asnSource struct {
+	// ASNs are the numbers of the trusted autonomous systems.
+	ASNs []uint
+
+	// Database is the path of the MMDB file.
+	Database string
+
+	refresher rangeRefresher
+}
+
+// asnRecord is the record of a network in an ASN database. GeoLite2-ASN
+// stores the number as an integer, IPinfo as a string like "AS13335".
+type asnRecord struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	ASN    string `maxminddb:"asn"`
+}
+
+func (r asnRecord) number() uint {
+	if r.Number != 0 {
+		return r.Number
+	}
+	n, _ := parseASN(r.ASN)
+	return n
+}
+
+// parseASN parses an AS number, with or without the "AS" prefix.
+func parseASN(s string) (uint, error) {
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint(n), err
+}
+
+func init() {
+	caddy.RegisterModule(asnSource{})
+}
+
+func (asnSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.asn",
+		New: func() caddy.Module {
+			return new(asnSource)
+		},
+	}
+}
+
+func (s *asnSource) Provision(ctx caddy.Context) error {
+	if len(s.ASNs) == 0 {
+		return fmt.Errorf("missing AS numbers")
+	}
+	if s.Database == "" {
+		return fmt.Errorf("missing database")
+	}
+	s.refresher.fetch = s.read
+	s.refresher.logger = ctx.Logger(s)
+	return watchFile(ctx, s.Database, &s.refresher)
+}
+
+// read returns the networks of the database that belong to one of the
+// autonomous systems.
+func (s *asnSource) read(context.Context) ([]*net.IPNet, error) {
+	buf, err := ioutil.ReadFile(s.Database)
+	if err != nil {
+		return nil, err
+	}
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", s.Database, err)
+	}
+	defer db.Close()
+
+	var ranges []*net.IPNet
+	networks := db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record asnRecord
+		network, err := networks.Network(&record)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", s.Database, err)
+		}
+		n := record.number()
+		for _, asn := range s.ASNs {
+			if n == asn {
+				ranges = append(ranges, network)
+				break
+			}
+		}
+	}
+	if err := networks.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", s.Database, err)
+	}
+	return ranges, nil
+}
+
+func (s *asnSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	asn <numbers...> {
+//	    database <path>
+//	}
+func (s *asnSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	for d.NextArg() {
+		n, err := parseASN(d.Val())
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+		s.ASNs = append(s.ASNs, n)
+	}
+	if len(s.ASNs) == 0 {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "database":
+			err = parseStringArg(d, &s.Database)
+		default:
+			return d.Errf("Unknown asn source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*asnSource)(nil)
+	_ caddy.Provisioner     = (*asnSource)(nil)
+	_ caddyfile.Unmarshaler = (*asnSource)(nil)
+)
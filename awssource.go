@@ -0,0 +1,191 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// awsIPRangesURL is where AWS publishes its address ranges.
+const awsIPRangesURL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+
+// awsSource trusts the address ranges AWS publishes for some services and
+// regions, e.g. those of CloudFront. The list is checked for updates
+// periodically, and only downloaded again when it has changed.
+type awsSource struct {
+	// Services filters the prefixes by service, e.g. "CLOUDFRONT" or
+	// "CLOUDFRONT_ORIGIN_FACING". The default is "CLOUDFRONT".
+	Services []string
+
+	// Regions filters the prefixes by region, e.g. "us-east-1" or
+	// "GLOBAL". All regions are included by default.
+	Regions []string
+
+	// URL overrides the location of ip-ranges.json.
+	URL string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 1h; AWS publishes changes several times a week.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+// awsIPRanges is the format of ip-ranges.json.
+type awsIPRanges struct {
+	Prefixes []struct {
+		IPPrefix string `json:"ip_prefix"`
+		Region   string `json:"region"`
+		Service  string `json:"service"`
+	} `json:"prefixes"`
+	IPv6Prefixes []struct {
+		IPv6Prefix string `json:"ipv6_prefix"`
+		Region     string `json:"region"`
+		Service    string `json:"service"`
+	} `json:"ipv6_prefixes"`
+}
+
+func init() {
+	caddy.RegisterModule(awsSource{})
+}
+
+func (awsSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.aws",
+		New: func() caddy.Module {
+			return new(awsSource)
+		},
+	}
+}
+
+func (s *awsSource) Provision(ctx caddy.Context) error {
+	if len(s.Services) == 0 {
+		s.Services = []string{"CLOUDFRONT"}
+	}
+	if s.URL == "" {
+		s.URL = awsIPRangesURL
+	}
+	s.http = newHTTPFetcher(0)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+func (s *awsSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	return s.http.get(ctx, s.URL, s.parse, s.refresher.current())
+}
+
+// parse returns the prefixes of ip-ranges.json that match the filters.
+func (s *awsSource) parse(r io.Reader) ([]*net.IPNet, error) {
+	var doc awsIPRanges
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	for _, p := range doc.Prefixes {
+		if s.matches(p.Service, p.Region) {
+			prefixes = append(prefixes, p.IPPrefix)
+		}
+	}
+	for _, p := range doc.IPv6Prefixes {
+		if s.matches(p.Service, p.Region) {
+			prefixes = append(prefixes, p.IPv6Prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no prefixes for services %v and regions %v", s.Services, s.Regions)
+	}
+	ranges := make([]*net.IPNet, len(prefixes))
+	for i, prefix := range prefixes {
+		_, cidr, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		ranges[i] = cidr
+	}
+	return ranges, nil
+}
+
+func (s *awsSource) matches(service, region string) bool {
+	return containsFold(s.Services, service) && (len(s.Regions) == 0 || containsFold(s.Regions, region))
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *awsSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *awsSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	aws [<services...>] {
+//	    regions <regions...>
+//	    url <url>
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *awsSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Services = append(s.Services, d.RemainingArgs()...)
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "regions":
+			s.Regions = append(s.Regions, d.RemainingArgs()...)
+			if len(s.Regions) == 0 {
+				err = d.ArgErr()
+			}
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown aws source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*awsSource)(nil)
+	_ caddy.Provisioner     = (*awsSource)(nil)
+	_ caddy.CleanerUpper    = (*awsSource)(nil)
+	_ caddyfile.Unmarshaler = (*awsSource)(nil)
+)
@@ -0,0 +1,149 @@
+//go:build go1.18
+// +build go1.18
+
+package realip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// caddySource provides ranges and presets, along with realip's IP sources,
+// to Caddy 2.6 and later as an http.ip_sources module, so that they can be
+// used for the server's trusted_proxies and wherever else Caddy accepts
+// an IP range source. It implements caddyhttp.IPRangeSource.
+type caddySource struct {
+	From []*net.IPNet
+
+	// Sources are realip's IP sources whose ranges are provided in
+	// addition to From.
+	Sources []json.RawMessage `json:",omitempty" caddy:"namespace=realip.ip_sources inline_key=source"`
+
+	sources  []IPSource
+	trust    *trustCache
+	prefixes atomic.Value // caddySourceEntry
+}
+
+// caddySourceEntry holds the prefixes converted from ranges.
+type caddySourceEntry struct {
+	ranges   []*net.IPNet
+	prefixes []netip.Prefix
+}
+
+func init() {
+	caddy.RegisterModule(caddySource{})
+}
+
+func (caddySource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.ip_sources.realip",
+		New: func() caddy.Module {
+			return new(caddySource)
+		},
+	}
+}
+
+func (s *caddySource) Provision(ctx caddy.Context) error {
+	if s.Sources != nil {
+		vals, err := ctx.LoadModule(s, "Sources")
+		if err != nil {
+			return fmt.Errorf("loading IP source modules: %v", err)
+		}
+		for _, val := range vals.([]interface{}) {
+			s.sources = append(s.sources, val.(IPSource))
+		}
+	}
+	if len(s.From) == 0 && len(s.sources) == 0 {
+		return fmt.Errorf("no ranges or sources")
+	}
+	s.From = mergeRanges(s.From)
+	s.trust = new(trustCache)
+	return nil
+}
+
+// ranges returns From along with the current ranges of the sources,
+// merged.
+func (s *caddySource) ranges() []*net.IPNet {
+	if len(s.sources) == 0 {
+		return s.From
+	}
+	inputs := make([][]*net.IPNet, 0, len(s.sources)+1)
+	inputs = append(inputs, s.From)
+	for _, source := range s.sources {
+		inputs = append(inputs, source.IPRanges())
+	}
+	return s.trust.get(inputs, func() []*net.IPNet {
+		var from []*net.IPNet
+		for _, ranges := range inputs {
+			from = append(from, ranges...)
+		}
+		return mergeRanges(from)
+	})
+}
+
+// GetIPRanges returns the ranges as prefixes. They are converted again
+// only when the ranges change.
+func (s *caddySource) GetIPRanges(*http.Request) []netip.Prefix {
+	ranges := s.ranges()
+	if entry, ok := s.prefixes.Load().(caddySourceEntry); ok && sameRanges(entry.ranges, ranges) {
+		return entry.prefixes
+	}
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+	for _, r := range ranges {
+		ip, ones, _ := normalizeRange(r)
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, ones))
+	}
+	s.prefixes.Store(caddySourceEntry{ranges: ranges, prefixes: prefixes})
+	return prefixes
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	realip [<ranges...>] {
+//	    from <ranges...>
+//	    source <name> [<args...>]
+//	}
+//
+// Ranges may be presets, e.g. `trusted_proxies realip cloudflare`.
+func (s *caddySource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if err := addIpRanges(&s.From, d, d.RemainingArgs()); err != nil {
+		return err
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "from":
+			if err := addIpRanges(&s.From, d, d.RemainingArgs()); err != nil {
+				return err
+			}
+		case "source":
+			raw, err := parseSource(d)
+			if err != nil {
+				return err
+			}
+			s.Sources = append(s.Sources, raw)
+		default:
+			return d.Errf("Unknown realip source arg")
+		}
+	}
+	if len(s.From) == 0 && len(s.Sources) == 0 {
+		return d.Err("realip requires ranges or a source")
+	}
+	return nil
+}
+
+var (
+	_ caddy.Provisioner     = (*caddySource)(nil)
+	_ caddyfile.Unmarshaler = (*caddySource)(nil)
+)
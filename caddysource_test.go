@@ -0,0 +1,78 @@
+//go:build go1.18
+// +build go1.18
+
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestCaddySource(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, test := range []struct {
+		input    string
+		expected string
+		sources  string
+	}{
+		{"realip 10.0.0.0/8 10.1.0.0/16 2001:db8::1", "[10.0.0.0/8 2001:db8::1/128]", "[]"},
+		{"realip gcp", "[35.191.0.0/16 130.211.0.0/22]", "[]"},
+		{"realip {\n from 1.2.3.4\n}", "[1.2.3.4/32]", "[]"},
+		{"realip 192.168.0.0/16 {\n source static 1.2.3.4\n}", "[192.168.0.0/16]", `[{"Ranges":["1.2.3.4"],"source":"static"}]`},
+		{"realip", "error", ""},
+		{"realip 10.0.0.0/33", "error", ""},
+		{"realip {\n sources static 1.2.3.4\n}", "error", ""},
+	} {
+		s := &caddySource{}
+		err := s.UnmarshalCaddyfile(newTestDispenser(t, test.input))
+		if err != nil {
+			if test.expected != "error" {
+				t.Errorf("Test %d: %v", i, err)
+			}
+			continue
+		}
+		if test.expected == "error" {
+			t.Errorf("Test %d: Expected an error", i)
+			continue
+		}
+		sources := make([]string, len(s.Sources))
+		for j, raw := range s.Sources {
+			sources[j] = string(raw)
+		}
+		if actual := "[" + strings.Join(sources, ",") + "]"; actual != test.sources {
+			t.Errorf("Test %d: Expected sources '%s', but found '%s'", i, test.sources, actual)
+		}
+		s.Sources = nil
+		if err := s.Provision(ctx); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+		if actual := fmt.Sprint(s.GetIPRanges(nil)); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	source := &staticSource{}
+	source.ranges, _ = parseRanges([]string{"1.2.3.4", "::ffff:5.6.7.8", "10.1.0.0/16"})
+	s := &caddySource{From: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}, sources: []IPSource{source}}
+	if err := s.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prefixes := s.GetIPRanges(nil)
+	if actual := fmt.Sprint(prefixes); actual != "[1.2.3.4/32 5.6.7.8/32 10.0.0.0/8]" {
+		t.Errorf("Expected the ranges of the source, but found '%s'", actual)
+	}
+	if again := s.GetIPRanges(nil); &again[0] != &prefixes[0] {
+		t.Errorf("Expected the prefixes to be cached")
+	}
+	source.ranges = source.ranges[:1]
+	if actual := fmt.Sprint(s.GetIPRanges(nil)); actual != "[1.2.3.4/32 10.0.0.0/8]" {
+		t.Errorf("Expected the changed ranges of the source, but found '%s'", actual)
+	}
+}
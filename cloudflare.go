@@ -0,0 +1,216 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// cfConnectingIP is set by Cloudflare to the address of the client that
+// connected to the edge.
+const cfConnectingIP = "CF-Connecting-IP"
+
+// Headers set by Cloudflare's Pseudo IPv4 feature. With "Overwrite
+// Headers", CF-Connecting-IP carries a pseudo address from 240.0.0.0/4 and
+// the real client address is moved to CF-Connecting-IPv6. With "Add
+// Header", the pseudo address is sent in Cf-Pseudo-IPv4 instead.
+const (
+	cfConnectingIPv6 = "CF-Connecting-IPv6"
+	cfPseudoIPv4     = "Cf-Pseudo-IPv4"
+)
+
+// pseudoIPv4Range is the reserved (class E) range Cloudflare maps IPv6
+// clients into.
+var pseudoIPv4Range = &net.IPNet{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)}
+
+// unpseudo replaces a Cloudflare pseudo IPv4 client address in client
+// with the real IPv6 address from CF-Connecting-IPv6. It returns the pseudo
+// address, or errNoAddress if the real address is missing, rather than
+// handing a reserved address to the backend. Other addresses are returned
+// unchanged, along with the pseudo address from Cf-Pseudo-IPv4, if any.
+func unpseudo(req *http.Request, client *hop) (string, error) {
+	ip := net.ParseIP(client.Host)
+	if ip == nil || ip.To4() == nil || !pseudoIPv4Range.Contains(ip) {
+		if pseudo := net.ParseIP(req.Header.Get(cfPseudoIPv4)); pseudo != nil && pseudoIPv4Range.Contains(pseudo) {
+			return pseudo.String(), nil
+		}
+		return "", nil
+	}
+	ipv6 := net.ParseIP(req.Header.Get(cfConnectingIPv6))
+	if ipv6 == nil || ipv6.To4() != nil {
+		return "", errNoAddress
+	}
+	pseudo := client.Host
+	client.Host, client.Port = ipv6.String(), ""
+	return pseudo, nil
+}
+
+// setPseudoPlaceholder exposes the Cloudflare pseudo IPv4 address of the
+// client, if any, as {http.realip.pseudo_ipv4}.
+func setPseudoPlaceholder(req *http.Request, res *resolution) {
+	if res == nil || res.PseudoIPv4 == "" {
+		return
+	}
+	if repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.realip.pseudo_ipv4", res.PseudoIPv4)
+	}
+}
+
+// cloudflareIPsURL is Cloudflare's API endpoint listing its address ranges.
+const cloudflareIPsURL = "https://api.cloudflare.com/client/v4/ips"
+
+// cloudflareSource trusts Cloudflare's current address ranges, fetched
+// from its API, so that the list doesn't drift out of date like the
+// embedded cloudflare preset. The preset is used until the first fetch
+// succeeds, e.g. when starting up offline.
+type cloudflareSource struct {
+	// URL overrides the location of the API endpoint.
+	URL string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+func init() {
+	caddy.RegisterModule(cloudflareSource{})
+}
+
+func (cloudflareSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.cloudflare",
+		New: func() caddy.Module {
+			return new(cloudflareSource)
+		},
+	}
+}
+
+func (s *cloudflareSource) Provision(ctx caddy.Context) error {
+	if s.URL == "" {
+		s.URL = cloudflareIPsURL
+	}
+	fallback, err := parseRanges(presets["cloudflare"])
+	if err != nil {
+		return err
+	}
+	s.http = newHTTPFetcher(0)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, fallback)
+	return nil
+}
+
+func (s *cloudflareSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	return s.http.get(ctx, s.URL, parseCloudflareIPs, s.refresher.current())
+}
+
+// parseCloudflareIPs parses a response of Cloudflare's IP API.
+func parseCloudflareIPs(r io.Reader) ([]*net.IPNet, error) {
+	var resp struct {
+		Success bool `json:"success"`
+		Result  struct {
+			IPv4CIDRs []string `json:"ipv4_cidrs"`
+			IPv6CIDRs []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	cidrs := append(resp.Result.IPv4CIDRs, resp.Result.IPv6CIDRs...)
+	if !resp.Success || len(cidrs) == 0 {
+		return nil, fmt.Errorf("unsuccessful or empty response")
+	}
+	return parseCIDRs(cidrs)
+}
+
+// cloudflareChinaIPsURL lists the ranges of the Cloudflare China Network.
+const cloudflareChinaIPsURL = cloudflareIPsURL + "?networks=jdcloud"
+
+// parseCloudflareChinaIPs parses the JD Cloud ranges of a response of
+// Cloudflare's IP list API.
+func parseCloudflareChinaIPs(r io.Reader) ([]*net.IPNet, error) {
+	var resp struct {
+		Success bool `json:"success"`
+		Result  struct {
+			JDCloudCIDRs []string `json:"jdcloud_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success || len(resp.Result.JDCloudCIDRs) == 0 {
+		return nil, fmt.Errorf("unsuccessful or empty response")
+	}
+	return parseCIDRs(resp.Result.JDCloudCIDRs)
+}
+
+func (s *cloudflareSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *cloudflareSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	cloudflare [<refresh>] {
+//	    url <url>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *cloudflareSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if d.NextArg() {
+		dur, err := time.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("Error parsing refresh: %s", err)
+		}
+		s.Refresh = caddy.Duration(dur)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown cloudflare source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*cloudflareSource)(nil)
+	_ caddy.Provisioner     = (*cloudflareSource)(nil)
+	_ caddy.CleanerUpper    = (*cloudflareSource)(nil)
+	_ caddyfile.Unmarshaler = (*cloudflareSource)(nil)
+)
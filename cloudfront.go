@@ -0,0 +1,21 @@
+package realip
+
+import "strings"
+
+// cloudFrontViewerAddress is set by Amazon CloudFront to the address and
+// source port of the viewer, separated by a colon. IPv6 addresses are not
+// enclosed in brackets, e.g. "2001:db8::1:46532".
+const cloudFrontViewerAddress = "CloudFront-Viewer-Address"
+
+// splitViewerAddress splits a CloudFront-Viewer-Address value into its
+// address and port. CloudFront always sends a port, so the last colon
+// separates it even if the rest would also be a valid IPv6 address.
+func splitViewerAddress(value string) (host, port string) {
+	if strings.HasPrefix(value, "[") {
+		return splitNode(value)
+	}
+	if i := strings.LastIndexByte(value, ':'); i >= 0 {
+		return value[:i], value[i+1:]
+	}
+	return value, ""
+}
@@ -0,0 +1,382 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Cloud providers supported by cloudSource.
+const (
+	cloudAuto  = "auto"
+	cloudAWS   = "aws"
+	cloudGCP   = "gcp"
+	cloudAzure = "azure"
+	cloudOCI   = "oci"
+)
+
+// Instance metadata endpoints.
+const (
+	awsMetadataURL   = "http://169.254.169.254"
+	gcpMetadataURL   = "http://metadata.google.internal"
+	azureMetadataURL = "http://169.254.169.254"
+	ociMetadataURL   = "http://169.254.169.254"
+)
+
+// azureHealthProbe is the address Azure Load Balancer's health probes and
+// other platform services come from.
+const azureHealthProbe = "168.63.129.16/32"
+
+// cloudSource discovers the ranges the cloud provider's load balancers
+// reach the instance from by querying the instance metadata service:
+//
+//   - aws: the CIDR blocks of the instance's VPC, which ALB and NLB nodes
+//     are placed in
+//   - gcp: Google's load balancer and health check ranges (the gcp preset)
+//     and the subnets of the instance's interfaces
+//   - azure: 168.63.129.16, where Azure Load Balancer's health probes come
+//     from, and the subnets of the instance's interfaces, which Application
+//     Gateway is deployed into
+//   - oci: the subnets of the instance's VNICs. OCI load balancers proxy
+//     and run health checks from private addresses in their own subnet,
+//     so there are no public ranges to trust; place the load balancer in
+//     the instance's subnet, or list its subnet with from.
+//
+// This trusts every host in those networks, so it is only suitable when
+// they are not shared with untrusted workloads.
+type cloudSource struct {
+	// Provider is "aws", "gcp", "azure", "oci" or "auto" (the default),
+	// which tries all of them at once.
+	Provider string
+
+	// Refresh is the interval between queries. The default is 1h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *http.Client
+	urls      map[string]string
+	detected  string
+}
+
+// cloudDetectTimeout bounds the detection of the provider with auto.
+const cloudDetectTimeout = 3 * time.Second
+
+func init() {
+	caddy.RegisterModule(cloudSource{})
+}
+
+func (cloudSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.cloud",
+		New: func() caddy.Module {
+			return new(cloudSource)
+		},
+	}
+}
+
+func (s *cloudSource) Provision(ctx caddy.Context) error {
+	switch s.Provider {
+	case "":
+		s.Provider = cloudAuto
+	case cloudAuto, cloudAWS, cloudGCP, cloudAzure, cloudOCI:
+	default:
+		return fmt.Errorf("unknown cloud provider %q", s.Provider)
+	}
+	// the metadata services are link-local, so they answer quickly or not
+	// at all
+	s.client = &http.Client{Timeout: 2 * time.Second}
+	s.urls = map[string]string{
+		cloudAWS:   awsMetadataURL,
+		cloudGCP:   gcpMetadataURL,
+		cloudAzure: azureMetadataURL,
+		cloudOCI:   ociMetadataURL,
+	}
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch queries the metadata service of the provider, or with auto, of the
+// first provider that answers, in the order aws, gcp, azure, oci. With
+// auto, the providers are queried in parallel and detection is bounded by
+// cloudDetectTimeout, so that it doesn't delay loading the config off
+// cloud. The provider found is used from then on.
+func (s *cloudSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	if s.Provider != cloudAuto {
+		return s.discover(ctx, s.Provider)
+	}
+	if s.detected != "" {
+		return s.discover(ctx, s.detected)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cloudDetectTimeout)
+	defer cancel()
+
+	providers := []string{cloudAWS, cloudGCP, cloudAzure, cloudOCI}
+	ranges := make([][]*net.IPNet, len(providers))
+	errs := make([]error, len(providers))
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider string) {
+			defer wg.Done()
+			ranges[i], errs[i] = s.discover(ctx, provider)
+		}(i, provider)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i, provider := range providers {
+		if errs[i] == nil {
+			s.detected = provider
+			return ranges[i], nil
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %v", provider, errs[i]))
+	}
+	return nil, fmt.Errorf("no instance metadata service found (%s)", strings.Join(msgs, "; "))
+}
+
+func (s *cloudSource) discover(ctx context.Context, provider string) ([]*net.IPNet, error) {
+	switch provider {
+	case cloudAWS:
+		return s.discoverAWS(ctx)
+	case cloudGCP:
+		return s.discoverGCP(ctx)
+	case cloudOCI:
+		return s.discoverOCI(ctx)
+	default:
+		return s.discoverAzure(ctx)
+	}
+}
+
+// discoverAWS returns the VPC CIDR blocks of all interfaces, using IMDSv2.
+func (s *cloudSource) discoverAWS(ctx context.Context) ([]*net.IPNet, error) {
+	base := s.urls[cloudAWS]
+	req, err := http.NewRequest("PUT", base+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := s.get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	get := func(path string) (string, error) {
+		req, err := http.NewRequest("GET", base+"/latest/meta-data/"+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return s.get(ctx, req)
+	}
+	macs, err := get("network/interfaces/macs/")
+	if err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, mac := range strings.Fields(macs) {
+		mac = strings.TrimSuffix(mac, "/")
+		blocks, err := get("network/interfaces/macs/" + mac + "/vpc-ipv4-cidr-blocks")
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, strings.Fields(blocks)...)
+		// only set for VPCs with IPv6
+		if blocks, err := get("network/interfaces/macs/" + mac + "/vpc-ipv6-cidr-blocks"); err == nil {
+			cidrs = append(cidrs, strings.Fields(blocks)...)
+		}
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no VPC CIDR blocks found")
+	}
+	return parseCIDRs(cidrs)
+}
+
+// discoverGCP returns the gcp preset and the subnets of all interfaces.
+func (s *cloudSource) discoverGCP(ctx context.Context) ([]*net.IPNet, error) {
+	req, err := http.NewRequest("GET", s.urls[cloudGCP]+"/computeMetadata/v1/instance/network-interfaces/?recursive=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := s.get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []struct {
+		IP         string `json:"ip"`
+		Subnetmask string `json:"subnetmask"`
+	}
+	if err := json.Unmarshal([]byte(body), &ifaces); err != nil {
+		return nil, err
+	}
+	ranges, err := parseRanges(presets["gcp"])
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		ip, mask := net.ParseIP(iface.IP).To4(), net.ParseIP(iface.Subnetmask).To4()
+		if ip == nil || mask == nil {
+			continue
+		}
+		ranges = append(ranges, &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)})
+	}
+	return ranges, nil
+}
+
+// discoverAzure returns Azure's health probe address and the subnets of
+// all interfaces.
+func (s *cloudSource) discoverAzure(ctx context.Context) ([]*net.IPNet, error) {
+	req, err := http.NewRequest("GET", s.urls[cloudAzure]+"/metadata/instance/network?api-version=2021-02-01", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	body, err := s.get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	type subnet struct {
+		Address string `json:"address"`
+		Prefix  string `json:"prefix"`
+	}
+	var network struct {
+		Interface []struct {
+			IPv4 struct {
+				Subnet []subnet `json:"subnet"`
+			} `json:"ipv4"`
+			IPv6 struct {
+				Subnet []subnet `json:"subnet"`
+			} `json:"ipv6"`
+		} `json:"interface"`
+	}
+	if err := json.Unmarshal([]byte(body), &network); err != nil {
+		return nil, err
+	}
+	cidrs := []string{azureHealthProbe}
+	for _, iface := range network.Interface {
+		for _, sub := range append(iface.IPv4.Subnet, iface.IPv6.Subnet...) {
+			if sub.Address != "" && sub.Prefix != "" {
+				cidrs = append(cidrs, sub.Address+"/"+sub.Prefix)
+			}
+		}
+	}
+	return parseCIDRs(cidrs)
+}
+
+// discoverOCI returns the subnets of all VNICs, using version 2 of the
+// instance metadata service.
+func (s *cloudSource) discoverOCI(ctx context.Context) ([]*net.IPNet, error) {
+	req, err := http.NewRequest("GET", s.urls[cloudOCI]+"/opc/v2/vnics/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer Oracle")
+	body, err := s.get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var vnics []struct {
+		SubnetCidrBlock     string `json:"subnetCidrBlock"`
+		IPv6SubnetCidrBlock string `json:"ipv6SubnetCidrBlock"`
+	}
+	if err := json.Unmarshal([]byte(body), &vnics); err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, vnic := range vnics {
+		for _, cidr := range []string{vnic.SubnetCidrBlock, vnic.IPv6SubnetCidrBlock} {
+			if cidr != "" {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no VNIC subnets found")
+	}
+	return parseCIDRs(cidrs)
+}
+
+// get sends req and returns the body of the response, which must be small.
+func (s *cloudSource) get(ctx context.Context, req *http.Request) (string, error) {
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: unexpected status %s", req.URL.Path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return string(body), err
+}
+
+func (s *cloudSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *cloudSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	cloud [aws|gcp|azure|oci|auto] {
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *cloudSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	d.Args(&s.Provider)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	switch s.Provider {
+	case "", cloudAuto, cloudAWS, cloudGCP, cloudAzure, cloudOCI:
+	default:
+		return d.Errf("Unknown cloud provider %s", s.Provider)
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown cloud source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*cloudSource)(nil)
+	_ caddy.Provisioner     = (*cloudSource)(nil)
+	_ caddy.CleanerUpper    = (*cloudSource)(nil)
+	_ caddyfile.Unmarshaler = (*cloudSource)(nil)
+)
@@ -0,0 +1,385 @@
+package realip
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// crawlerSource trusts crawlers verified the way Google and Microsoft
+// document for Googlebot and Bingbot: the peer's address must resolve to a
+// host name under one of Domains, and that name must resolve back to the
+// address. Results, including failed verifications, are cached for TTL.
+//
+// A verified crawler is trusted as the peer of its own requests. It is
+// kept in the cache rather than added to the source's ranges, so that
+// verifying one doesn't change the trusted ranges; IPRanges is always
+// empty, and verified crawlers aren't trusted as hops further down a
+// forward chain.
+//
+// Only requests whose User-Agent matches Agents are verified, since
+// verification takes two DNS lookups on the request path. Concurrent
+// requests from the same address share one verification.
+//
+// The host name of a verified crawler is available as
+// {http.realip.crawler}, whether or not it is trusted.
+type crawlerSource struct {
+	// Domains are the domains crawlers' host names must be in, e.g.
+	// "googlebot.com" or "search.msn.com".
+	Domains []string
+
+	// Agents limits verification to requests whose User-Agent contains
+	// one of them, ignoring case, e.g. "Googlebot", so that other visitors
+	// don't cause DNS lookups.
+	Agents []string
+
+	// TTL is how long a result is cached. The default is 1h.
+	TTL caddy.Duration `json:",omitempty"`
+
+	// MaxEntries bounds the number of cached results. When it is
+	// reached, the least recently used failed verification is evicted,
+	// or the least recently used verified crawler if there is none. The
+	// default is 10000.
+	MaxEntries int `json:",omitempty"`
+
+	// TagOnly verifies and tags crawlers without trusting them.
+	TagOnly bool `json:",omitempty"`
+
+	cache      *crawlerCache
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	lookupIP   func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// crawlerCache holds the cached verifications by address, with the failed
+// and the successful ones in separate lists ordered by last use, and the
+// verifications in progress.
+type crawlerCache struct {
+	sync.Mutex
+	entries  map[string]*list.Element // of *crawlerEntry
+	failed   *list.List
+	verified *list.List
+	pending  map[string]*crawlerCall
+}
+
+func newCrawlerCache() *crawlerCache {
+	return &crawlerCache{
+		entries:  make(map[string]*list.Element),
+		failed:   list.New(),
+		verified: list.New(),
+		pending:  make(map[string]*crawlerCall),
+	}
+}
+
+// crawlerCall is a verification in progress. name is set before done is
+// closed.
+type crawlerCall struct {
+	done chan struct{}
+	name string
+}
+
+// crawlerEntry is a cached verification. name is empty if the address
+// failed it.
+type crawlerEntry struct {
+	host    string
+	name    string
+	expires time.Time
+}
+
+// list returns the list of the cache e belongs in.
+func (c *crawlerCache) list(e *crawlerEntry) *list.List {
+	if e.name == "" {
+		return c.failed
+	}
+	return c.verified
+}
+
+// crawlerLookupTimeout bounds the DNS lookups of one verification.
+const crawlerLookupTimeout = 2 * time.Second
+
+func init() {
+	caddy.RegisterModule(crawlerSource{})
+}
+
+func (crawlerSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.crawler",
+		New: func() caddy.Module {
+			return new(crawlerSource)
+		},
+	}
+}
+
+func (s *crawlerSource) Provision(ctx caddy.Context) error {
+	if len(s.Domains) == 0 {
+		return fmt.Errorf("missing domains")
+	}
+	if len(s.Agents) == 0 {
+		return fmt.Errorf("missing agents")
+	}
+	if s.TTL == 0 {
+		s.TTL = caddy.Duration(time.Hour)
+	}
+	if s.MaxEntries == 0 {
+		s.MaxEntries = 10000
+	}
+	s.cache = newCrawlerCache()
+	s.lookupAddr = net.DefaultResolver.LookupAddr
+	s.lookupIP = net.DefaultResolver.LookupIPAddr
+	return nil
+}
+
+// IPRanges returns no ranges: verified crawlers are trusted through
+// trusts, so that verifying one doesn't change the trusted ranges.
+func (s *crawlerSource) IPRanges() []*net.IPNet {
+	return nil
+}
+
+// trusts reports whether host is a verified crawler that is trusted.
+func (s *crawlerSource) trusts(host string) bool {
+	if s.TagOnly {
+		return false
+	}
+	s.cache.Lock()
+	defer s.cache.Unlock()
+	entry, ok := s.get(host, time.Now())
+	return ok && entry.name != ""
+}
+
+// verify returns the host name of the crawler at host, or an empty string
+// if it is not one. Requests whose User-Agent doesn't match Agents are not
+// verified, but an expired verification of host is dropped regardless. A
+// request that finds a verification of host in progress waits for its
+// result instead of starting another one.
+func (s *crawlerSource) verify(ctx context.Context, host, userAgent string) string {
+	s.cache.Lock()
+	entry, ok := s.get(host, time.Now())
+	if ok {
+		s.cache.Unlock()
+		return entry.name
+	}
+	if !containsAnyFold(userAgent, s.Agents) {
+		s.cache.Unlock()
+		return ""
+	}
+	if call, ok := s.cache.pending[host]; ok {
+		s.cache.Unlock()
+		select {
+		case <-call.done:
+			return call.name
+		case <-ctx.Done():
+			return ""
+		}
+	}
+	call := &crawlerCall{done: make(chan struct{})}
+	s.cache.pending[host] = call
+	s.cache.Unlock()
+
+	// the lookups aren't bound to ctx, since other requests may be
+	// waiting for them
+	lookupCtx, cancel := context.WithTimeout(context.Background(), crawlerLookupTimeout)
+	defer cancel()
+	call.name = s.lookup(lookupCtx, host)
+
+	s.cache.Lock()
+	delete(s.cache.pending, host)
+	s.put(&crawlerEntry{host: host, name: call.name, expires: time.Now().Add(time.Duration(s.TTL))})
+	s.cache.Unlock()
+	close(call.done)
+	return call.name
+}
+
+// get returns the cached verification of host and marks it as used. An
+// expired one is removed. s.cache must be locked.
+func (s *crawlerSource) get(host string, now time.Time) (*crawlerEntry, bool) {
+	elem, ok := s.cache.entries[host]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*crawlerEntry)
+	if !now.Before(entry.expires) {
+		s.remove(elem)
+		return nil, false
+	}
+	s.cache.list(entry).MoveToFront(elem)
+	return entry, true
+}
+
+// put caches entry, replacing an earlier verification of its host and
+// evicting the least recently used entry if the cache is full, failed
+// verifications first. s.cache must be locked.
+func (s *crawlerSource) put(entry *crawlerEntry) {
+	if elem, ok := s.cache.entries[entry.host]; ok {
+		s.remove(elem)
+	}
+	for len(s.cache.entries) >= s.MaxEntries {
+		oldest := s.cache.failed.Back()
+		if oldest == nil {
+			oldest = s.cache.verified.Back()
+		}
+		if oldest == nil {
+			break
+		}
+		s.remove(oldest)
+	}
+	s.cache.entries[entry.host] = s.cache.list(entry).PushFront(entry)
+}
+
+// remove removes the cached entry elem. s.cache must be locked.
+func (s *crawlerSource) remove(elem *list.Element) {
+	entry := elem.Value.(*crawlerEntry)
+	s.cache.list(entry).Remove(elem)
+	delete(s.cache.entries, entry.host)
+}
+
+// lookup verifies host by a reverse lookup followed by a forward lookup of
+// the name found.
+func (s *crawlerSource) lookup(ctx context.Context, host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	names, err := s.lookupAddr(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if !s.inDomains(name) {
+			continue
+		}
+		addrs, err := s.lookupIP(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// inDomains reports whether name is one of Domains or a subdomain of one.
+func (s *crawlerSource) inDomains(name string) bool {
+	name = strings.ToLower(name)
+	for _, domain := range s.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAnyFold reports whether s contains one of substrs, ignoring
+// case.
+func containsAnyFold(s string, substrs []string) bool {
+	s = strings.ToLower(s)
+	for _, sub := range substrs {
+		if strings.Contains(s, strings.ToLower(sub)) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyCrawler verifies the peer of req with the crawler sources of the
+// module and its bindings, which trust it from then on if it is a
+// crawler, and exposes its host name as {http.realip.crawler}.
+func (m *module) verifyCrawler(req *http.Request, peer string) {
+	if len(m.allCrawlers) == 0 {
+		return
+	}
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return
+	}
+	for _, c := range m.allCrawlers {
+		name := c.verify(req.Context(), host, req.UserAgent())
+		if name == "" {
+			continue
+		}
+		if repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			repl.Set("http.realip.crawler", name)
+		}
+		return
+	}
+}
+
+// trustsCrawler reports whether host is a crawler verified by one of
+// crawlers, and neither excluded nor revoked.
+func (m *module) trustsCrawler(crawlers []*crawlerSource, host string) bool {
+	if len(crawlers) == 0 {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || containsIP(m.Except, ip) || containsIP(overrides.load().revoked, ip) {
+		return false
+	}
+	for _, c := range crawlers {
+		if c.trusts(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	crawler <domains...> {
+//	    agents <substrings...>
+//	    ttl <duration>
+//	    max_entries <n>
+//	    tag_only
+//	}
+func (s *crawlerSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Domains = append(s.Domains, d.RemainingArgs()...)
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "domains":
+			s.Domains = append(s.Domains, d.RemainingArgs()...)
+		case "agents":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				err = d.ArgErr()
+			}
+			s.Agents = append(s.Agents, args...)
+		case "ttl":
+			err = parseDurationArg(d, &s.TTL)
+		case "max_entries":
+			err = parseIntArg(d, &s.MaxEntries)
+		case "tag_only":
+			s.TagOnly = true
+		default:
+			return d.Errf("Unknown crawler source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	if len(s.Domains) == 0 {
+		return d.Err("crawler requires domains")
+	}
+	if len(s.Agents) == 0 {
+		return d.Err("crawler requires agents")
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*crawlerSource)(nil)
+	_ caddy.Provisioner     = (*crawlerSource)(nil)
+	_ caddyfile.Unmarshaler = (*crawlerSource)(nil)
+)
@@ -0,0 +1,216 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// dnsSource trusts the addresses a set of host names resolve to, so that
+// trust follows proxies whose addresses change behind a stable name. The
+// names are resolved again when the shortest TTL of their records expires.
+type dnsSource struct {
+	// Names are the host names to resolve. A and AAAA records are used.
+	Names []string
+
+	// Resolvers are the DNS servers to query, as host:port. The default is
+	// the servers in /etc/resolv.conf.
+	Resolvers []string
+
+	// MinRefresh and MaxRefresh bound the time between lookups regardless
+	// of the TTL. The defaults are 5s and 1h. Failed lookups are retried
+	// with backoff.
+	MinRefresh caddy.Duration
+	MaxRefresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *dns.Client
+	ttl       time.Duration
+}
+
+func init() {
+	caddy.RegisterModule(dnsSource{})
+}
+
+func (dnsSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.dns",
+		New: func() caddy.Module {
+			return new(dnsSource)
+		},
+	}
+}
+
+func (s *dnsSource) Provision(ctx caddy.Context) error {
+	if len(s.Names) == 0 {
+		return fmt.Errorf("missing host names")
+	}
+	if len(s.Resolvers) == 0 {
+		resolvers, err := systemResolvers()
+		if err != nil {
+			return err
+		}
+		s.Resolvers = resolvers
+	}
+	if s.MinRefresh == 0 {
+		s.MinRefresh = caddy.Duration(5 * time.Second)
+	}
+	if s.MaxRefresh == 0 {
+		s.MaxRefresh = caddy.Duration(time.Hour)
+	}
+	s.client = new(dns.Client)
+	s.refresher.fetch = s.resolve
+	s.refresher.next = s.next
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// next returns the time until the next lookup: the TTL of the last
+// successful one, bounded by MinRefresh and MaxRefresh.
+func (s *dnsSource) next() time.Duration {
+	wait := s.ttl
+	if wait < time.Duration(s.MinRefresh) {
+		wait = time.Duration(s.MinRefresh)
+	}
+	if wait > time.Duration(s.MaxRefresh) {
+		wait = time.Duration(s.MaxRefresh)
+	}
+	return wait
+}
+
+// resolve looks up all names and returns their addresses as single-address
+// ranges. It fails if any name can't be resolved, so that a partial answer
+// doesn't replace a complete one.
+func (s *dnsSource) resolve(ctx context.Context) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	var ttl time.Duration
+	for _, name := range s.Names {
+		found := false
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			answer, err := exchange(ctx, s.client, s.Resolvers, name, qtype)
+			if err != nil {
+				return nil, err
+			}
+			for _, rr := range answer {
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A.To4()
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				bits := 8 * len(ip)
+				ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; !found || rrTTL < ttl {
+					ttl = rrTTL
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no addresses found for %s", name)
+		}
+	}
+	s.ttl = ttl
+	return ranges, nil
+}
+
+// systemResolvers returns the DNS servers in /etc/resolv.conf.
+func systemResolvers() ([]string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("no resolvers configured: %v", err)
+	}
+	var resolvers []string
+	for _, server := range conf.Servers {
+		resolvers = append(resolvers, net.JoinHostPort(server, conf.Port))
+	}
+	return resolvers, nil
+}
+
+// exchange queries the resolvers in order until one of them answers.
+func exchange(ctx context.Context, client *dns.Client, resolvers []string, name string, qtype uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	var err error
+	for _, server := range resolvers {
+		var resp *dns.Msg
+		resp, _, err = client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("resolving %s: %s", name, dns.RcodeToString[resp.Rcode])
+		}
+		return resp.Answer, nil
+	}
+	return nil, fmt.Errorf("resolving %s: %v", name, err)
+}
+
+func (s *dnsSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *dnsSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	dns <names...> {
+//	    resolvers <addresses...>
+//	    min_refresh <interval>
+//	    max_refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *dnsSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Names = append(s.Names, d.RemainingArgs()...)
+	if len(s.Names) == 0 {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "resolvers":
+			s.Resolvers = append(s.Resolvers, d.RemainingArgs()...)
+			if len(s.Resolvers) == 0 {
+				err = d.ArgErr()
+			}
+		case "min_refresh":
+			err = parseDurationArg(d, &s.MinRefresh)
+		case "max_refresh":
+			err = parseDurationArg(d, &s.MaxRefresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown dns source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*dnsSource)(nil)
+	_ caddy.Provisioner     = (*dnsSource)(nil)
+	_ caddy.CleanerUpper    = (*dnsSource)(nil)
+	_ caddyfile.Unmarshaler = (*dnsSource)(nil)
+)
@@ -0,0 +1,122 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// dockerSource trusts the subnets of the networks the container is attached
+// to, so that a proxy on the same Docker network is trusted without
+// hardcoding its address range. The subnets are read from the container's
+// own interfaces, so no access to the Docker socket is needed. They are
+// checked again periodically to pick up networks connected at runtime.
+type dockerSource struct {
+	// Interfaces limits the source to some interfaces, e.g. "eth0". All
+	// interfaces except loopback are used by default.
+	Interfaces []string
+
+	// Refresh is the interval between checks. The default is 1m.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	addrs     func() (map[string][]net.Addr, error)
+}
+
+func init() {
+	caddy.RegisterModule(dockerSource{})
+}
+
+func (dockerSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.docker",
+		New: func() caddy.Module {
+			return new(dockerSource)
+		},
+	}
+}
+
+func (s *dockerSource) Provision(ctx caddy.Context) error {
+	s.addrs = interfaceAddrs
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Minute
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch returns the subnets of the interfaces.
+func (s *dockerSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	addrs, err := s.addrs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(addrs))
+	for name := range addrs {
+		if len(s.Interfaces) == 0 || containsFold(s.Interfaces, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ranges := interfaceRanges(addrs, names)
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no container networks found")
+	}
+	return ranges, nil
+}
+
+func (s *dockerSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *dockerSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	docker [<interfaces...>] {
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *dockerSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Interfaces = append(s.Interfaces, d.RemainingArgs()...)
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown docker source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*dockerSource)(nil)
+	_ caddy.Provisioner     = (*dockerSource)(nil)
+	_ caddy.CleanerUpper    = (*dockerSource)(nil)
+	_ caddyfile.Unmarshaler = (*dockerSource)(nil)
+)
@@ -0,0 +1,146 @@
+package realip
+
+import (
+	"net"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// applyExcept removes Except from From, the bindings and the sources.
+func (m *module) applyExcept() {
+	if len(m.Except) == 0 {
+		return
+	}
+	m.logExcept()
+	m.From = excludeRanges(m.From, m.Except)
+	for i := range m.Bindings {
+		m.Bindings[i].From = excludeRanges(m.Bindings[i].From, m.Except)
+		for j, source := range m.Bindings[i].sources {
+			m.Bindings[i].sources[j] = &exclusion{source: source, except: m.Except}
+		}
+	}
+	for i, source := range m.sources {
+		m.sources[i] = &exclusion{source: source, except: m.Except}
+	}
+}
+
+// logExcept warns about exclusions that conflict with the trusted ranges:
+// trusted ranges that are excluded entirely, which is likely a mistake, and
+// exclusions that match nothing trusted. The latter can only be known when
+// there are no sources.
+func (m *module) logExcept() {
+	if m.logger == nil {
+		return
+	}
+	static := append([]*net.IPNet{}, m.From...)
+	for _, binding := range m.Bindings {
+		static = append(static, binding.From...)
+	}
+	for _, r := range static {
+		if len(excludeRanges([]*net.IPNet{r}, m.Except)) == 0 {
+			m.logger.Warn("trusted range is excluded entirely by except", zap.String("range", r.String()))
+		}
+	}
+	if len(m.sources) > 0 {
+		return
+	}
+	for _, e := range m.Except {
+		if !overlapsAny(static, e) {
+			m.logger.Warn("except range matches no trusted range", zap.String("except", e.String()))
+		}
+	}
+}
+
+// overlapsAny reports whether e overlaps one of ranges.
+func overlapsAny(ranges []*net.IPNet, e *net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(e.IP) || e.Contains(r.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeRanges returns ranges without the addresses in except. Ranges that
+// partially overlap an excluded range are split into the largest ranges
+// that don't.
+func excludeRanges(ranges, except []*net.IPNet) []*net.IPNet {
+	for _, e := range except {
+		var out []*net.IPNet
+		for _, r := range ranges {
+			out = append(out, subtractRange(r, e)...)
+		}
+		ranges = out
+	}
+	return ranges
+}
+
+// subtractRange returns the ranges covering r but not e.
+func subtractRange(r, e *net.IPNet) []*net.IPNet {
+	rIP, rOnes, rBits := normalizeRange(r)
+	eIP, eOnes, eBits := normalizeRange(e)
+	if rBits != eBits {
+		return []*net.IPNet{r}
+	}
+	if eOnes <= rOnes {
+		if e.Contains(rIP) {
+			return nil
+		}
+		return []*net.IPNet{r}
+	}
+	if !r.Contains(eIP) {
+		return []*net.IPNet{r}
+	}
+	// walk down from r to e, keeping the half that doesn't contain e at
+	// every level
+	var out []*net.IPNet
+	for ones := rOnes + 1; ones <= eOnes; ones++ {
+		mask := net.CIDRMask(ones, eBits)
+		ip := eIP.Mask(mask)
+		ip[(ones-1)/8] ^= 0x80 >> uint((ones-1)%8)
+		out = append(out, &net.IPNet{IP: ip, Mask: mask})
+	}
+	return out
+}
+
+// normalizeRange returns the network address of n, four bytes long for
+// IPv4, along with the size of its mask.
+func normalizeRange(n *net.IPNet) (net.IP, int, int) {
+	ones, bits := n.Mask.Size()
+	ip := n.IP
+	if ip4 := ip.To4(); ip4 != nil && bits == 8*net.IPv4len {
+		ip = ip4
+	}
+	return ip.Mask(n.Mask), ones, bits
+}
+
+// exclusion is a source with some ranges removed. The result is cached
+// until the source's ranges change.
+type exclusion struct {
+	source IPSource
+	except []*net.IPNet
+	cache  atomic.Value // exclusionCache
+}
+
+type exclusionCache struct {
+	in, out []*net.IPNet
+}
+
+func (e *exclusion) IPRanges() []*net.IPNet {
+	in := e.source.IPRanges()
+	if c, ok := e.cache.Load().(exclusionCache); ok && sameRanges(c.in, in) {
+		return c.out
+	}
+	out := excludeRanges(in, e.except)
+	e.cache.Store(exclusionCache{in: in, out: out})
+	return out
+}
+
+// sameRanges reports whether a and b are the same slice. Sources replace
+// rather than modify their ranges, so this means they are unchanged.
+func sameRanges(a, b []*net.IPNet) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+var _ IPSource = (*exclusion)(nil)
@@ -0,0 +1,57 @@
+package realip
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// headerExtract extracts addresses from a header whose value is not a
+// plain list, such as `X-Forwarded: addr="1.2.3.4"; port=443`.
+type headerExtract struct {
+	// Header is the name of the header, which must also be configured
+	// through Header, Headers or Bindings.
+	Header string
+
+	// Pattern is a regular expression with a capture group for the
+	// address. Every match adds an entry to the chain, in order.
+	Pattern string
+
+	re *regexp.Regexp
+}
+
+// compileExtract compiles the pattern of an extraction.
+func compileExtract(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("pattern %q has no capture group", pattern)
+	}
+	return re, nil
+}
+
+// extract returns the compiled pattern configured for header, if any.
+func (m *module) extract(header string) *regexp.Regexp {
+	for _, ex := range m.Extract {
+		if header != "" && strings.EqualFold(ex.Header, header) {
+			return ex.re
+		}
+	}
+	return nil
+}
+
+// extractParts returns the addresses captured by re in value, ordered as
+// they appear, or errNoAddress if there is no match.
+func extractParts(re *regexp.Regexp, value string) ([]hop, error) {
+	matches := re.FindAllStringSubmatch(value, -1)
+	if len(matches) == 0 {
+		return nil, errNoAddress
+	}
+	parts := make([]hop, len(matches))
+	for i, match := range matches {
+		parts[i].Host, parts[i].Port = splitNode(strings.TrimSpace(match[1]))
+	}
+	return parts, nil
+}
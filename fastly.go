@@ -0,0 +1,144 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// fastlyClientIP is set by Fastly to the address of the client that
+// connected to the edge. With shielding it keeps the edge's value.
+const fastlyClientIP = "Fastly-Client-IP"
+
+// fastlyIPsURL is Fastly's API endpoint listing its address ranges.
+const fastlyIPsURL = "https://api.fastly.com/public-ip-list"
+
+// fastlySource trusts Fastly's current address ranges, fetched from its
+// API, so that origins stay correct as Fastly adds POPs. The embedded
+// fastly preset is used until the first fetch succeeds.
+type fastlySource struct {
+	// URL overrides the location of the API endpoint.
+	URL string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+func init() {
+	caddy.RegisterModule(fastlySource{})
+}
+
+func (fastlySource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.fastly",
+		New: func() caddy.Module {
+			return new(fastlySource)
+		},
+	}
+}
+
+func (s *fastlySource) Provision(ctx caddy.Context) error {
+	if s.URL == "" {
+		s.URL = fastlyIPsURL
+	}
+	fallback, err := parseRanges(presets["fastly"])
+	if err != nil {
+		return err
+	}
+	s.http = newHTTPFetcher(0)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, fallback)
+	return nil
+}
+
+func (s *fastlySource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	return s.http.get(ctx, s.URL, parseFastlyIPs, s.refresher.current())
+}
+
+// parseFastlyIPs parses a response of Fastly's public IP list API.
+func parseFastlyIPs(r io.Reader) ([]*net.IPNet, error) {
+	var resp struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	cidrs := append(resp.Addresses, resp.IPv6Addresses...)
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+	return parseCIDRs(cidrs)
+}
+
+func (s *fastlySource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *fastlySource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	fastly [<refresh>] {
+//	    url <url>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *fastlySource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if d.NextArg() {
+		dur, err := time.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("Error parsing refresh: %s", err)
+		}
+		s.Refresh = caddy.Duration(dur)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown fastly source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*fastlySource)(nil)
+	_ caddy.Provisioner     = (*fastlySource)(nil)
+	_ caddy.CleanerUpper    = (*fastlySource)(nil)
+	_ caddyfile.Unmarshaler = (*fastlySource)(nil)
+)
@@ -0,0 +1,125 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// fileSource reads a list of ranges, one per line, from a file and reloads
+// it whenever the file changes, so that updates by configuration
+// management take effect without reloading Caddy. The previous list is
+// kept if the file becomes unreadable or invalid.
+type fileSource struct {
+	// Path is the location of the list.
+	Path string
+
+	refresher rangeRefresher
+}
+
+func init() {
+	caddy.RegisterModule(fileSource{})
+}
+
+func (fileSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.file",
+		New: func() caddy.Module {
+			return new(fileSource)
+		},
+	}
+}
+
+func (s *fileSource) Provision(ctx caddy.Context) error {
+	if s.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	s.refresher.logger = ctx.Logger(s)
+	return s.watch(ctx)
+}
+
+// watch loads the file and reloads it on changes for the lifetime of ctx.
+func (s *fileSource) watch(ctx context.Context) error {
+	s.refresher.fetch = s.read
+	return watchFile(ctx, s.Path, &s.refresher)
+}
+
+// watchFile loads the ranges with r's fetch function, and refreshes them
+// whenever the file at path changes for the lifetime of ctx. The directory
+// is watched rather than the file itself, since tools commonly replace
+// files by renaming a new one over them.
+func watchFile(ctx context.Context, path string, r *rangeRefresher) error {
+	ranges, err := r.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	r.ranges.Store(ranges)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					r.refresh(ctx)
+				}
+			case err := <-watcher.Errors:
+				if r.logger != nil {
+					r.logger.Warn("watching trusted ranges file", zap.String("path", path), zap.Error(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *fileSource) read(context.Context) ([]*net.IPNet, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ranges, err := parseRangeList(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", s.Path, err)
+	}
+	return ranges, nil
+}
+
+func (s *fileSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	file <path>
+func (s *fileSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&s.Path) || d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*fileSource)(nil)
+	_ caddy.Provisioner     = (*fileSource)(nil)
+	_ caddyfile.Unmarshaler = (*fileSource)(nil)
+)
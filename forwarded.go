@@ -0,0 +1,152 @@
+package realip
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// forwardedHeader is the standardized header defined by RFC 7239.
+const forwardedHeader = "Forwarded"
+
+// forwardedElement is a single comma-separated element of a Forwarded
+// header, i.e. the information added by one proxy.
+type forwardedElement struct {
+	For   string
+	By    string
+	Proto string
+	Host  string
+}
+
+// parseForwarded parses the value of a Forwarded header as described in
+// RFC 7239. Parameter names are case-insensitive, values may be tokens or
+// quoted strings, and empty list elements are ignored. Unknown parameters
+// are accepted and dropped.
+func parseForwarded(value string) ([]forwardedElement, error) {
+	elements, err := splitQuoted(value, ',')
+	if err != nil {
+		return nil, err
+	}
+	var result []forwardedElement
+	for _, element := range elements {
+		if strings.TrimSpace(element) == "" {
+			continue
+		}
+		pairs, err := splitQuoted(element, ';')
+		if err != nil {
+			return nil, err
+		}
+		var elem forwardedElement
+		for _, pair := range pairs {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			eq := strings.IndexByte(pair, '=')
+			if eq <= 0 {
+				return nil, fmt.Errorf("malformed forwarded pair %q", pair)
+			}
+			val, err := unquote(strings.TrimSpace(pair[eq+1:]))
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(strings.TrimSpace(pair[:eq])) {
+			case "for":
+				elem.For = val
+			case "by":
+				elem.By = val
+			case "proto":
+				elem.Proto = val
+			case "host":
+				elem.Host = val
+			}
+		}
+		result = append(result, elem)
+	}
+	return result, nil
+}
+
+// setForwardedPlaceholders exposes the parameters of the Forwarded element
+// the client address was taken from as {http.realip.forwarded.for}, .by,
+// .proto and .host, so that they can be used without parsing the header
+// again. Nothing is set if the request wasn't resolved through Forwarded.
+func setForwardedPlaceholders(req *http.Request, res *resolution) {
+	if res == nil || res.Chain[res.Client].Forwarded == nil {
+		return
+	}
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	elem := res.Chain[res.Client].Forwarded
+	repl.Set("http.realip.forwarded.for", elem.For)
+	repl.Set("http.realip.forwarded.by", elem.By)
+	repl.Set("http.realip.forwarded.proto", elem.Proto)
+	repl.Set("http.realip.forwarded.host", elem.Host)
+}
+
+// splitNode splits a node identifier as used in the "for" and "by"
+// parameters into its host and optional port. IPv6 addresses with a port
+// must be enclosed in brackets; the brackets are removed. The same format
+// is accepted for entries of other forward headers such as X-Forwarded-For.
+func splitNode(node string) (host, port string) {
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return node, ""
+		}
+		host = node[1:end]
+		if rest := node[end+1:]; strings.HasPrefix(rest, ":") {
+			port = rest[1:]
+		}
+		return host, port
+	}
+	if i := strings.IndexByte(node, ':'); i >= 0 && strings.Count(node, ":") == 1 {
+		return node[:i], node[i+1:]
+	}
+	return node, ""
+}
+
+// splitQuoted splits s at every occurrence of sep that is not inside a
+// quoted string.
+func splitQuoted(s string, sep byte) ([]string, error) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted string in %q", s)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// unquote returns the content of a quoted string with escapes resolved,
+// or s unchanged if it is a plain token.
+func unquote(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return s, nil
+	}
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return "", fmt.Errorf("malformed quoted string %s", s)
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
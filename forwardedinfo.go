@@ -0,0 +1,101 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// applyForwardedInfo applies X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Port to req as configured, provided that peer, the address
+// the request was received from, is trusted. Of a list of values, the one
+// set by the proxy that received the request from the client in res is
+// used, or the one set by peer if no client was resolved. Invalid values,
+// and lists that don't match the forward header entry for entry, are
+// ignored.
+func (m *module) applyForwardedInfo(req *http.Request, peer string, res *resolution) {
+	if !m.TrustProto && !m.TrustHost && !m.TrustPort {
+		return
+	}
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil || !m.trustedPeer(host) {
+		return
+	}
+	repl, _ := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	if m.TrustProto {
+		proto := strings.ToLower(trustedValue(req.Header.Values("X-Forwarded-Proto"), res))
+		if proto == "http" || proto == "https" {
+			req.URL.Scheme = proto
+			if repl != nil {
+				repl.Set("http.request.scheme", proto)
+			}
+		}
+	}
+
+	if !m.TrustHost && !m.TrustPort {
+		return
+	}
+	reqHost, reqPort, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		reqHost, reqPort = req.Host, ""
+	}
+	if fwdHost := trustedValue(req.Header.Values("X-Forwarded-Host"), res); m.TrustHost && validHost(fwdHost) {
+		reqHost, reqPort = fwdHost, ""
+		if h, p, err := net.SplitHostPort(fwdHost); err == nil && isPort(p) {
+			reqHost, reqPort = h, p
+		}
+	}
+	if fwdPort := trustedValue(req.Header.Values("X-Forwarded-Port"), res); m.TrustPort && isPort(fwdPort) {
+		reqPort = fwdPort
+	}
+	if reqPort != "" {
+		req.Host = net.JoinHostPort(reqHost, reqPort)
+	} else {
+		req.Host = reqHost
+	}
+	if repl != nil {
+		repl.Set("http.request.host", reqHost)
+		repl.Set("http.request.port", reqPort)
+		repl.Set("http.request.hostport", req.Host)
+	}
+}
+
+// trustedValue returns the entry of the comma-separated header values
+// that was appended along with the client address in res, since each proxy
+// appends to both. Entries left of it may have been sent by the client. If
+// the header doesn't carry as many entries as the forward header did, they
+// can't be matched, and an empty string is returned. Without a resolution,
+// the rightmost entry, set by the peer, is returned.
+func trustedValue(values []string, res *resolution) string {
+	if len(values) == 0 {
+		return ""
+	}
+	entries := strings.Split(strings.Join(values, ","), ",")
+	if res == nil {
+		return strings.TrimSpace(entries[len(entries)-1])
+	}
+	if len(entries) != res.Entries {
+		return ""
+	}
+	return strings.TrimSpace(entries[res.Position])
+}
+
+// validHost reports whether host looks like a host name or address with an
+// optional port, and contains nothing that could alter a URL.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, c := range host {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune(".-_:[]", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// gcoreIPsURL is Gcore's API endpoint listing the addresses of its CDN
+// nodes.
+const gcoreIPsURL = "https://api.gcore.com/cdn/public-ip-list"
+
+// gcoreSource trusts the current addresses of Gcore's CDN nodes, fetched
+// from its API. The embedded gcore preset is used until the first fetch
+// succeeds.
+type gcoreSource struct {
+	// URL overrides the location of the API endpoint.
+	URL string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+func init() {
+	caddy.RegisterModule(gcoreSource{})
+}
+
+func (gcoreSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.gcore",
+		New: func() caddy.Module {
+			return new(gcoreSource)
+		},
+	}
+}
+
+func (s *gcoreSource) Provision(ctx caddy.Context) error {
+	if s.URL == "" {
+		s.URL = gcoreIPsURL
+	}
+	fallback, err := parseRanges(presets["gcore"])
+	if err != nil {
+		return err
+	}
+	s.http = newHTTPFetcher(0)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, fallback)
+	return nil
+}
+
+func (s *gcoreSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	return s.http.get(ctx, s.URL, parseGcoreIPs, s.refresher.current())
+}
+
+// parseGcoreIPs parses a response of Gcore's public IP list API.
+func parseGcoreIPs(r io.Reader) ([]*net.IPNet, error) {
+	var resp struct {
+		Addresses   []string `json:"addresses"`
+		AddressesV6 []string `json:"addresses_v6"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	cidrs := append(resp.Addresses, resp.AddressesV6...)
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+	return parseCIDRs(cidrs)
+}
+
+func (s *gcoreSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *gcoreSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	gcore [<refresh>] {
+//	    url <url>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *gcoreSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if d.NextArg() {
+		dur, err := time.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("Error parsing refresh: %s", err)
+		}
+		s.Refresh = caddy.Duration(dur)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown gcore source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*gcoreSource)(nil)
+	_ caddy.Provisioner     = (*gcoreSource)(nil)
+	_ caddy.CleanerUpper    = (*gcoreSource)(nil)
+	_ caddyfile.Unmarshaler = (*gcoreSource)(nil)
+)
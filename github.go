@@ -0,0 +1,139 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// githubMetaURL is GitHub's API endpoint listing its address ranges.
+const githubMetaURL = "https://api.github.com/meta"
+
+// githubSource trusts the address ranges GitHub publishes in its meta API,
+// by default those webhooks are delivered from. There is no embedded
+// fallback, so nothing is trusted until the first fetch succeeds.
+type githubSource struct {
+	// Keys selects the lists of the meta API to use, e.g. "hooks" or
+	// "actions". The default is "hooks".
+	Keys []string
+
+	// URL overrides the location of the meta API, e.g. for GitHub
+	// Enterprise Server.
+	URL string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+func init() {
+	caddy.RegisterModule(githubSource{})
+}
+
+func (githubSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.github",
+		New: func() caddy.Module {
+			return new(githubSource)
+		},
+	}
+}
+
+func (s *githubSource) Provision(ctx caddy.Context) error {
+	if len(s.Keys) == 0 {
+		s.Keys = []string{"hooks"}
+	}
+	if s.URL == "" {
+		s.URL = githubMetaURL
+	}
+	s.http = newHTTPFetcher(0)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+func (s *githubSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	return s.http.get(ctx, s.URL, s.parse, s.refresher.current())
+}
+
+// parse returns the ranges of the selected lists of a meta API response.
+func (s *githubSource) parse(r io.Reader) ([]*net.IPNet, error) {
+	var meta map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&meta); err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, key := range s.Keys {
+		var list []string
+		if err := json.Unmarshal(meta[key], &list); err != nil || len(list) == 0 {
+			return nil, fmt.Errorf("no ranges for %q", key)
+		}
+		cidrs = append(cidrs, list...)
+	}
+	return parseCIDRs(cidrs)
+}
+
+func (s *githubSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *githubSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	github [<keys...>] {
+//	    url <url>
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *githubSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Keys = append(s.Keys, d.RemainingArgs()...)
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown github source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*githubSource)(nil)
+	_ caddy.Provisioner     = (*githubSource)(nil)
+	_ caddy.CleanerUpper    = (*githubSource)(nil)
+	_ caddyfile.Unmarshaler = (*githubSource)(nil)
+)
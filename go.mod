@@ -2,4 +2,10 @@ module github.com/kirsch33/realip
 
 go 1.15
 
-require github.com/caddyserver/caddy/v2 v2.0.0
+require (
+	github.com/caddyserver/caddy/v2 v2.0.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/miekg/dns v1.1.27
+	github.com/oschwald/maxminddb-golang v1.8.0
+	go.uber.org/zap v1.14.1
+)
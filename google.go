@@ -0,0 +1,191 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// googleFeeds are the netblock feeds Google publishes: "goog" lists the
+// ranges of Google's own services, including the front ends (GFE) that
+// proxy requests for Cloud load balancers, and "cloud" lists the ranges
+// available to Cloud customers.
+var googleFeeds = map[string]string{
+	"goog":  "https://www.gstatic.com/ipranges/goog.json",
+	"cloud": "https://www.gstatic.com/ipranges/cloud.json",
+}
+
+// googleSource trusts the netblocks Google publishes. The gcp preset, which
+// only covers the load balancer proxies, is used until the first fetch
+// succeeds.
+type googleSource struct {
+	// Feeds selects the feeds to use, "goog" and/or "cloud". The default
+	// is "goog".
+	Feeds []string
+
+	// Scopes filters the prefixes of the cloud feed by scope, e.g.
+	// "us-east1". All scopes are included by default.
+	Scopes []string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	fetchers  map[string]*httpFetcher
+	ranges    map[string][]*net.IPNet
+}
+
+// googlePrefixes is the format of the feeds.
+type googlePrefixes struct {
+	Prefixes []struct {
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+		Scope      string `json:"scope"`
+	} `json:"prefixes"`
+}
+
+func init() {
+	caddy.RegisterModule(googleSource{})
+}
+
+func (googleSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.google",
+		New: func() caddy.Module {
+			return new(googleSource)
+		},
+	}
+}
+
+func (s *googleSource) Provision(ctx caddy.Context) error {
+	if len(s.Feeds) == 0 {
+		s.Feeds = []string{"goog"}
+	}
+	s.fetchers = make(map[string]*httpFetcher)
+	s.ranges = make(map[string][]*net.IPNet)
+	for _, feed := range s.Feeds {
+		if _, ok := googleFeeds[feed]; !ok {
+			return fmt.Errorf("unknown feed %q", feed)
+		}
+		fetcher := newHTTPFetcher(0)
+		s.fetchers[feed] = &fetcher
+	}
+	fallback, err := parseRanges(presets["gcp"])
+	if err != nil {
+		return err
+	}
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, fallback)
+	return nil
+}
+
+// fetch fetches all feeds. It fails if any of them fails, so that a
+// partial list doesn't replace a complete one.
+func (s *googleSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	var all []*net.IPNet
+	for _, feed := range s.Feeds {
+		ranges, err := s.fetchers[feed].get(ctx, googleFeeds[feed], s.parse, s.ranges[feed])
+		if err != nil {
+			return nil, err
+		}
+		s.ranges[feed] = ranges
+		all = append(all, ranges...)
+	}
+	return all, nil
+}
+
+// parse returns the prefixes of a feed that match Scopes. Only the cloud
+// feed carries scopes.
+func (s *googleSource) parse(r io.Reader) ([]*net.IPNet, error) {
+	var doc googlePrefixes
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	for _, p := range doc.Prefixes {
+		if p.Scope != "" && len(s.Scopes) > 0 && !containsFold(s.Scopes, p.Scope) {
+			continue
+		}
+		if p.IPv4Prefix != "" {
+			prefixes = append(prefixes, p.IPv4Prefix)
+		}
+		if p.IPv6Prefix != "" {
+			prefixes = append(prefixes, p.IPv6Prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no prefixes for scopes %v", s.Scopes)
+	}
+	return parseCIDRs(prefixes)
+}
+
+func (s *googleSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *googleSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	google [<feeds...>] {
+//	    scopes <scopes...>
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *googleSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Feeds = append(s.Feeds, d.RemainingArgs()...)
+	for _, feed := range s.Feeds {
+		if _, ok := googleFeeds[feed]; !ok {
+			return d.Errf("Unknown google feed '%s'", feed)
+		}
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "scopes":
+			s.Scopes = append(s.Scopes, d.RemainingArgs()...)
+			if len(s.Scopes) == 0 {
+				err = d.ArgErr()
+			}
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown google source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*googleSource)(nil)
+	_ caddy.Provisioner     = (*googleSource)(nil)
+	_ caddy.CleanerUpper    = (*googleSource)(nil)
+	_ caddyfile.Unmarshaler = (*googleSource)(nil)
+)
@@ -0,0 +1,155 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// interfaceSource trusts the subnets assigned to some network interfaces,
+// e.g. a WireGuard interface that proxies connect through. The interfaces
+// are checked again every few seconds, so that addresses added or removed
+// at runtime are picked up.
+type interfaceSource struct {
+	// Names are the names of the interfaces, e.g. "wg0".
+	Names []string
+
+	// Refresh is the interval between checks. The default is 10s.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	addrs     func() (map[string][]net.Addr, error)
+}
+
+func init() {
+	caddy.RegisterModule(interfaceSource{})
+}
+
+func (interfaceSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.interface",
+		New: func() caddy.Module {
+			return new(interfaceSource)
+		},
+	}
+}
+
+func (s *interfaceSource) Provision(ctx caddy.Context) error {
+	if len(s.Names) == 0 {
+		return fmt.Errorf("missing interface names")
+	}
+	s.addrs = interfaceAddrs
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 10 * time.Second
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch returns the subnets of the interfaces. It fails if one of them is
+// missing or down, so that its subnets stay trusted while it is recreated.
+func (s *interfaceSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	addrs, err := s.addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range s.Names {
+		if _, ok := addrs[name]; !ok {
+			return nil, fmt.Errorf("interface %s not found or down", name)
+		}
+	}
+	return interfaceRanges(addrs, s.Names), nil
+}
+
+// interfaceAddrs returns the addresses of the interfaces that are up.
+func interfaceAddrs() (map[string][]net.Addr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string][]net.Addr, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if addrs[iface.Name], err = iface.Addrs(); err != nil {
+			return nil, err
+		}
+	}
+	return addrs, nil
+}
+
+// interfaceRanges returns the subnets of the named interfaces. Loopback and
+// link-local addresses are skipped.
+func interfaceRanges(addrs map[string][]net.Addr, names []string) []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, name := range names {
+		for _, addr := range addrs[name] {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ip := ipnet.IP.Mask(ipnet.Mask)
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: ipnet.Mask[len(ipnet.Mask)-len(ip):]})
+		}
+	}
+	return ranges
+}
+
+func (s *interfaceSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *interfaceSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	interface <names...> {
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *interfaceSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Names = append(s.Names, d.RemainingArgs()...)
+	if len(s.Names) == 0 {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown interface source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*interfaceSource)(nil)
+	_ caddy.Provisioner     = (*interfaceSource)(nil)
+	_ caddy.CleanerUpper    = (*interfaceSource)(nil)
+	_ caddyfile.Unmarshaler = (*interfaceSource)(nil)
+)
@@ -0,0 +1,461 @@
+package realip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// IPSource provides trusted ranges in addition to the static From list.
+// Sources are modules in the realip.ip_sources namespace, e.g. lists
+// fetched from a URL or a CDN's API. A source that changes over time is
+// responsible for refreshing itself in the background once provisioned.
+type IPSource interface {
+	// IPRanges returns the ranges currently provided by the source. It is
+	// called for every request, so it must be cheap and safe for
+	// concurrent use.
+	IPRanges() []*net.IPNet
+}
+
+// ipSourcesNamespace is the module namespace of IPSource modules.
+const ipSourcesNamespace = "realip.ip_sources"
+
+// parseSource parses an IP source module from the Caddyfile:
+//
+//	source <name> [<args...>] [{
+//	    ...
+//	}]
+//
+// The module receives the tokens starting at its name.
+func parseSource(d *caddyfile.Dispenser) ([]byte, error) {
+	mod, name, err := parseGuestModule(d, ipSourcesNamespace)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := mod.(IPSource); !ok {
+		return nil, d.Errf("module '%s' is not a realip IP source", name)
+	}
+	return caddyconfig.JSONModuleObject(mod, "source", name, nil), nil
+}
+
+// parseRangeList parses a list of ranges with one CIDR range or address
+// per line. Empty lines and comments starting with # are ignored.
+func parseRangeList(r io.Reader) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		if ip := net.ParseIP(text); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ranges = append(ranges, cidr)
+	}
+	return ranges, scanner.Err()
+}
+
+// hostRange returns a range containing only ip.
+func hostRange(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// rangeRefresher holds the ranges of a source that changes over time and
+// refreshes them in the background until the config is unloaded. A failed
+// refresh keeps the previous ranges.
+type rangeRefresher struct {
+	fetch    func(ctx context.Context) ([]*net.IPNet, error)
+	interval time.Duration
+	logger   *zap.Logger
+	ranges   atomic.Value // []*net.IPNet
+
+	// next, if set, returns the time until the next refresh after a
+	// successful one, overriding interval.
+	next func() time.Duration
+
+	// storage, if set, keeps the last fetched ranges under key, along
+	// with the time they were fetched, so that they can be used when the
+	// source is unreachable at startup.
+	storage rangeStorage
+	key     string
+
+	// shared is the refresher doing the work when the ranges are shared
+	// with identically configured sources, possibly r itself.
+	shared *rangeRefresher
+
+	// maxStale, if set, is how long the ranges are used after the last
+	// successful refresh, or startup. Past that, they are dropped if
+	// failClosed is set, and used with an error logged otherwise.
+	maxStale   time.Duration
+	failClosed bool
+	updated    int64 // unix nanoseconds, accessed atomically
+}
+
+// stalePolicy decides what happens to the ranges of a source when its
+// refreshes keep failing, so that a silently dead fetcher doesn't keep
+// trusting an outdated list forever. It is embedded in sources that
+// refresh in the background. Its fields are omitted from the JSON of
+// sources that don't set them, which keeps their storage keys unchanged.
+type stalePolicy struct {
+	// MaxStale is how long the ranges are used after the last successful
+	// refresh. By default, they are used until the next one succeeds.
+	MaxStale caddy.Duration `json:",omitempty"`
+
+	// OnStale is "open" to keep using stale ranges and log an error, or
+	// "closed" to stop trusting them until a refresh succeeds. The default
+	// is "open".
+	OnStale string `json:",omitempty"`
+}
+
+const (
+	staleOpen   = "open"
+	staleClosed = "closed"
+)
+
+// configure validates the policy and applies it to r.
+func (p stalePolicy) configure(r *rangeRefresher) error {
+	switch p.OnStale {
+	case "", staleOpen, staleClosed:
+	default:
+		return fmt.Errorf("unknown stale policy %q", p.OnStale)
+	}
+	if p.MaxStale < 0 {
+		return fmt.Errorf("max stale must not be negative")
+	}
+	r.maxStale = time.Duration(p.MaxStale)
+	r.failClosed = p.OnStale == staleClosed
+	return nil
+}
+
+// parseCaddyfile parses the max_stale and on_stale options of a source:
+//
+//	max_stale <duration>
+//	on_stale open|closed
+func (p *stalePolicy) parseCaddyfile(d *caddyfile.Dispenser) error {
+	if d.Val() == "max_stale" {
+		return parseDurationArg(d, &p.MaxStale)
+	}
+	if err := parseStringArg(d, &p.OnStale); err != nil {
+		return err
+	}
+	if p.OnStale != staleOpen && p.OnStale != staleClosed {
+		return fmt.Errorf("unknown stale policy %q", p.OnStale)
+	}
+	return nil
+}
+
+// sharedRefreshers holds the refreshers of sources by configuration, so
+// that sites configured with the same source share one list and one
+// background refresh, e.g. 40 sites trusting the live Cloudflare list.
+var sharedRefreshers = caddy.NewUsagePool()
+
+// sharedRefresher is a refresher in sharedRefreshers. It is stopped when
+// the last source using it is cleaned up.
+type sharedRefresher struct {
+	refresher *rangeRefresher
+	cancel    context.CancelFunc
+}
+
+func (s *sharedRefresher) Destruct() error {
+	s.cancel()
+	return nil
+}
+
+// rangeStorage is the part of certmagic.Storage used to persist ranges.
+type rangeStorage interface {
+	Store(key string, value []byte) error
+	Load(key string) ([]byte, error)
+}
+
+// persist makes r keep its ranges in the storage configured for Caddy,
+// under a key derived from the module's ID and config.
+func (r *rangeRefresher) persist(ctx caddy.Context, mod caddy.Module) {
+	config, _ := json.Marshal(mod)
+	sum := sha256.Sum256(config)
+	r.storage = ctx.Storage()
+	r.key = path.Join("realip", "ranges", string(mod.CaddyModule().ID)+"-"+hex.EncodeToString(sum[:8]))
+}
+
+// startShared persists the ranges of mod and shares them with identically
+// configured sources.
+func (r *rangeRefresher) startShared(ctx caddy.Context, mod caddy.Module, initial []*net.IPNet) {
+	r.persist(ctx, mod)
+	r.share(initial)
+}
+
+// share uses the refresher running for r's key, if there is one. Otherwise
+// r is started with initial, and refreshes the ranges until the last source
+// sharing them is cleaned up.
+func (r *rangeRefresher) share(initial []*net.IPNet) {
+	val, _, _ := sharedRefreshers.LoadOrNew(r.key, func() (caddy.Destructor, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r.start(ctx, initial)
+		return &sharedRefresher{refresher: r, cancel: cancel}, nil
+	})
+	r.shared = val.(*sharedRefresher).refresher
+}
+
+// stop releases the shared refresher, stopping it if r was the last source
+// using it.
+func (r *rangeRefresher) stop() error {
+	if r.shared == nil {
+		return nil
+	}
+	_, err := sharedRefreshers.Delete(r.key)
+	return err
+}
+
+// retryMin and retryMax bound the backoff between attempts after a failed
+// refresh.
+const (
+	retryMin = 5 * time.Second
+	retryMax = 5 * time.Minute
+)
+
+// start installs initial, fetches the ranges once and, if interval or next
+// is set, keeps refreshing them for the lifetime of ctx. If the first fetch
+// fails, the ranges persisted by a previous run are used instead of initial.
+// Failed refreshes are retried with backoff.
+func (r *rangeRefresher) start(ctx context.Context, initial []*net.IPNet) {
+	r.ranges.Store(initial)
+	atomic.StoreInt64(&r.updated, time.Now().UnixNano())
+	err := r.refresh(ctx)
+	if err != nil {
+		r.load()
+	}
+	if r.interval <= 0 && r.next == nil {
+		return
+	}
+	go func() {
+		var failures uint
+		for {
+			wait := r.interval
+			switch {
+			case err != nil:
+				failures++
+				wait = r.backoff(failures)
+			case r.next != nil:
+				failures = 0
+				wait = r.next()
+			default:
+				failures = 0
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				err = r.refresh(ctx)
+			}
+		}
+	}()
+}
+
+// backoff returns the time until the next attempt after failures
+// consecutive failed refreshes: retryMin, doubled for each further failure,
+// up to retryMax or interval if it is shorter. A random jitter of up to half
+// the time keeps sources from retrying in lockstep.
+func (r *rangeRefresher) backoff(failures uint) time.Duration {
+	max := retryMax
+	if r.interval > 0 && r.interval < max {
+		max = r.interval
+	}
+	wait := max
+	if failures < 32 && retryMin<<(failures-1) < max {
+		wait = retryMin << (failures - 1)
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (r *rangeRefresher) refresh(ctx context.Context) error {
+	ranges, err := r.fetch(ctx)
+	if err != nil {
+		if r.logger == nil {
+			return err
+		}
+		switch {
+		case !r.stale():
+			r.logger.Warn("refreshing trusted ranges failed, keeping previous ranges", zap.Error(err))
+		case r.failClosed:
+			r.logger.Error("refreshing trusted ranges failed, no longer trusting stale ranges", zap.Duration("max_stale", r.maxStale), zap.Error(err))
+		default:
+			r.logger.Error("refreshing trusted ranges failed, still trusting stale ranges", zap.Duration("max_stale", r.maxStale), zap.Error(err))
+		}
+		return err
+	}
+	r.ranges.Store(ranges)
+	atomic.StoreInt64(&r.updated, time.Now().UnixNano())
+	r.save(ranges)
+	return nil
+}
+
+// stale reports whether the ranges are older than maxStale.
+func (r *rangeRefresher) stale() bool {
+	if r.maxStale <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.updated))) > r.maxStale
+}
+
+// savedPrefix starts the comment line of persisted ranges that holds the
+// time they were fetched.
+const savedPrefix = "# fetched "
+
+// save persists ranges along with the time they were fetched. They are
+// saved after every successful refresh, even if unchanged, so that the
+// time stays current.
+func (r *rangeRefresher) save(ranges []*net.IPNet) {
+	if r.storage == nil {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%s\n", savedPrefix, time.Unix(0, atomic.LoadInt64(&r.updated)).UTC().Format(time.RFC3339Nano))
+	for _, cidr := range ranges {
+		fmt.Fprintln(&buf, cidr)
+	}
+	if err := r.storage.Store(r.key, buf.Bytes()); err != nil && r.logger != nil {
+		r.logger.Warn("saving trusted ranges failed", zap.String("key", r.key), zap.Error(err))
+	}
+}
+
+// load installs the persisted ranges, if there are any, and restores the
+// time they were fetched, so that they are as stale as they were when
+// saved. Ranges saved without a time count as stale.
+func (r *rangeRefresher) load() {
+	if r.storage == nil {
+		return
+	}
+	buf, err := r.storage.Load(r.key)
+	if err != nil {
+		return
+	}
+	ranges, err := parseRangeList(bytes.NewReader(buf))
+	if err != nil {
+		return
+	}
+	fetched := time.Unix(0, 0)
+	line := string(buf)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if strings.HasPrefix(line, savedPrefix) {
+		if t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, savedPrefix)); err == nil {
+			fetched = t
+		}
+	}
+	r.ranges.Store(ranges)
+	atomic.StoreInt64(&r.updated, fetched.UnixNano())
+	if r.logger != nil {
+		r.logger.Info("using trusted ranges saved by a previous run", zap.String("key", r.key), zap.Int("ranges", len(ranges)), zap.Time("fetched", fetched))
+	}
+}
+
+// IPRanges returns the current ranges, or none if they are stale and the
+// source fails closed.
+func (r *rangeRefresher) IPRanges() []*net.IPNet {
+	if r.shared != nil && r.shared != r {
+		return r.shared.IPRanges()
+	}
+	if r.failClosed && r.stale() {
+		return nil
+	}
+	return r.current()
+}
+
+// current returns the last fetched ranges, regardless of their age. Fetch
+// functions use it as the result of unchanged lists.
+func (r *rangeRefresher) current() []*net.IPNet {
+	ranges, _ := r.ranges.Load().([]*net.IPNet)
+	return ranges
+}
+
+// staticSource provides a fixed list of ranges. It is mostly useful to
+// combine presets with other sources in JSON configs.
+type staticSource struct {
+	// Ranges is a list of CIDR ranges or presets such as "cloudflare".
+	Ranges []string
+
+	ranges []*net.IPNet
+}
+
+func init() {
+	caddy.RegisterModule(staticSource{})
+}
+
+func (staticSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.static",
+		New: func() caddy.Module {
+			return new(staticSource)
+		},
+	}
+}
+
+func (s *staticSource) Provision(ctx caddy.Context) error {
+	ranges, err := parseRanges(s.Ranges)
+	if err != nil {
+		return err
+	}
+	s.ranges = ranges
+	return nil
+}
+
+func (s *staticSource) IPRanges() []*net.IPNet {
+	return s.ranges
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	static <ranges...>
+func (s *staticSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Ranges = append(s.Ranges, d.RemainingArgs()...)
+	if len(s.Ranges) == 0 {
+		return d.ArgErr()
+	}
+	if _, err := parseRanges(s.Ranges); err != nil {
+		return d.Errf("Error parsing static: %s", err)
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*staticSource)(nil)
+	_ IPSource              = (*rangeRefresher)(nil)
+	_ caddy.Provisioner     = (*staticSource)(nil)
+	_ caddyfile.Unmarshaler = (*staticSource)(nil)
+)
@@ -0,0 +1,1658 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// fixedSource is an IPSource with fixed ranges.
+type fixedSource []*net.IPNet
+
+func (s fixedSource) IPRanges() []*net.IPNet { return s }
+
+func TestIPSources(t *testing.T) {
+	_, source, _ := net.ParseCIDR("10.0.0.0/8")
+	for i, test := range []struct {
+		actualIP   string
+		headerVal  string
+		expectedIP string
+	}{
+		{"4.5.0.1:123", "1.2.3.4", "1.2.3.4:123"},
+		{"10.0.0.1:123", "1.2.3.4", "1.2.3.4:123"},
+		{"10.0.0.1:123", "1.2.3.4, 4.5.0.2, 10.1.0.1", "1.2.3.4:123"},
+		{"8.8.8.8:123", "1.2.3.4", "8.8.8.8:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.sources = []IPSource{fixedSource{source}}
+
+		remoteAddr := serveTest(t, i, he, test.actualIP, test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n source static 10.0.0.0/8 cloudflare\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Sources) != 1 || string(m.Sources[0]) != `{"Ranges":["10.0.0.0/8","cloudflare"],"source":"static"}` {
+		t.Errorf("Unexpected sources: %s", m.Sources)
+	}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n source static 10.0.0.0/33\n}")); err == nil {
+		t.Errorf("Expected an error for an invalid range")
+	}
+}
+
+func TestRangeRefresher(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	_, initial, _ := net.ParseCIDR("10.0.0.0/8")
+	_, fetched, _ := net.ParseCIDR("192.168.0.0/16")
+	fail := false
+	r := &rangeRefresher{fetch: func(context.Context) ([]*net.IPNet, error) {
+		if fail {
+			return nil, errors.New("offline")
+		}
+		return []*net.IPNet{fetched}, nil
+	}}
+
+	r.start(ctx, []*net.IPNet{initial})
+	if ranges := r.IPRanges(); len(ranges) != 1 || ranges[0] != fetched {
+		t.Errorf("Expected fetched ranges, but found %v", ranges)
+	}
+
+	fail = true
+	r.refresh(ctx)
+	if ranges := r.IPRanges(); len(ranges) != 1 || ranges[0] != fetched {
+		t.Errorf("Expected previous ranges after a failed refresh, but found %v", ranges)
+	}
+
+	r = &rangeRefresher{fetch: func(context.Context) ([]*net.IPNet, error) { return nil, errors.New("offline") }}
+	r.start(ctx, []*net.IPNet{initial})
+	if ranges := r.IPRanges(); len(ranges) != 1 || ranges[0] != initial {
+		t.Errorf("Expected initial ranges, but found %v", ranges)
+	}
+}
+
+// memoryStorage is a rangeStorage in memory.
+type memoryStorage map[string][]byte
+
+func (s memoryStorage) Store(key string, value []byte) error {
+	s[key] = value
+	return nil
+}
+
+func (s memoryStorage) Load(key string) ([]byte, error) {
+	value, ok := s[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return value, nil
+}
+
+func TestRangeRefresherBackoff(t *testing.T) {
+	for i, test := range []struct {
+		interval time.Duration
+		failures uint
+		expected time.Duration
+	}{
+		{time.Hour, 1, 5 * time.Second},
+		{time.Hour, 2, 10 * time.Second},
+		{time.Hour, 4, 40 * time.Second},
+		{time.Hour, 7, 5 * time.Minute},
+		{time.Hour, 100, 5 * time.Minute},
+		{time.Minute, 5, time.Minute},
+		{0, 3, 20 * time.Second},
+	} {
+		r := &rangeRefresher{interval: test.interval}
+		for j := 0; j < 10; j++ {
+			if actual := r.backoff(test.failures); actual < test.expected/2 || actual > test.expected {
+				t.Errorf("Test %d: Expected between %s and %s, but found %s", i, test.expected/2, test.expected, actual)
+			}
+		}
+	}
+}
+
+func TestRangeRefresherStorage(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	_, initial, _ := net.ParseCIDR("10.0.0.0/8")
+	_, fetched, _ := net.ParseCIDR("192.168.0.0/16")
+	storage := memoryStorage{}
+	online := true
+	fetch := func(context.Context) ([]*net.IPNet, error) {
+		if !online {
+			return nil, errors.New("offline")
+		}
+		return []*net.IPNet{fetched, hostRange(net.ParseIP("2001:db8::1"))}, nil
+	}
+
+	for i, test := range []struct {
+		online   bool
+		key      string
+		expected string
+	}{
+		{false, "realip/ranges/a", "[10.0.0.0/8]"},
+		{true, "realip/ranges/a", "[192.168.0.0/16 2001:db8::1/128]"},
+		{false, "realip/ranges/a", "[192.168.0.0/16 2001:db8::1/128]"},
+		{false, "realip/ranges/b", "[10.0.0.0/8]"},
+	} {
+		online = test.online
+		r := &rangeRefresher{fetch: fetch, storage: storage, key: test.key}
+		r.start(ctx, []*net.IPNet{initial})
+		if actual := fmt.Sprint(r.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+	stored := string(storage["realip/ranges/a"])
+	if i := strings.IndexByte(stored, '\n'); i < 0 || !strings.HasPrefix(stored, savedPrefix) || stored[i+1:] != "192.168.0.0/16\n2001:db8::1/128\n" {
+		t.Errorf("Unexpected stored ranges %q", stored)
+	}
+
+	// persisted ranges are as stale as they were when they were saved
+	online = false
+	for i, test := range []struct {
+		saved    string
+		expected string
+	}{
+		{savedPrefix + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano) + "\n192.168.0.0/16\n", "[192.168.0.0/16]"},
+		{savedPrefix + time.Now().Add(-72*time.Hour).UTC().Format(time.RFC3339Nano) + "\n192.168.0.0/16\n", "[]"},
+		{"192.168.0.0/16\n", "[]"},
+	} {
+		storage["realip/ranges/c"] = []byte(test.saved)
+		r := &rangeRefresher{fetch: fetch, storage: storage, key: "realip/ranges/c"}
+		if err := (stalePolicy{MaxStale: caddy.Duration(48 * time.Hour), OnStale: "closed"}).configure(r); err != nil {
+			t.Fatal(err)
+		}
+		r.start(ctx, []*net.IPNet{initial})
+		if actual := fmt.Sprint(r.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestRangeRefresherStale(t *testing.T) {
+	_, fetched, _ := net.ParseCIDR("192.168.0.0/16")
+	fail := func(context.Context) ([]*net.IPNet, error) {
+		return nil, errors.New("offline")
+	}
+	for i, test := range []struct {
+		policy   stalePolicy
+		age      time.Duration
+		expected string
+	}{
+		{stalePolicy{}, 72 * time.Hour, "[192.168.0.0/16]"},
+		{stalePolicy{MaxStale: caddy.Duration(48 * time.Hour)}, 72 * time.Hour, "[192.168.0.0/16]"},
+		{stalePolicy{MaxStale: caddy.Duration(48 * time.Hour), OnStale: "closed"}, time.Hour, "[192.168.0.0/16]"},
+		{stalePolicy{MaxStale: caddy.Duration(48 * time.Hour), OnStale: "closed"}, 72 * time.Hour, "[]"},
+		{stalePolicy{OnStale: "closed"}, 72 * time.Hour, "[192.168.0.0/16]"},
+		{stalePolicy{OnStale: "ajar"}, 0, "error"},
+	} {
+		r := &rangeRefresher{fetch: fail}
+		if err := test.policy.configure(r); err != nil {
+			if test.expected != "error" {
+				t.Errorf("Test %d: Unexpected error: %v", i, err)
+			}
+			continue
+		}
+		r.ranges.Store([]*net.IPNet{fetched})
+		r.updated = time.Now().Add(-test.age).UnixNano()
+		r.refresh(context.Background())
+		if actual := fmt.Sprint(r.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestRangeRefresherShared(t *testing.T) {
+	_, fetched, _ := net.ParseCIDR("192.168.0.0/16")
+	var fetches int
+	fetch := func(ctx context.Context) ([]*net.IPNet, error) {
+		fetches++
+		return []*net.IPNet{fetched}, nil
+	}
+
+	a := &rangeRefresher{fetch: fetch, interval: time.Hour, key: "realip/ranges/shared"}
+	b := &rangeRefresher{fetch: fetch, interval: time.Hour, key: "realip/ranges/shared"}
+	c := &rangeRefresher{fetch: fetch, interval: time.Hour, key: "realip/ranges/other"}
+	a.share(nil)
+	b.share(nil)
+	c.share(nil)
+	if fetches != 2 || a.shared != a || b.shared != a || c.shared != c {
+		t.Errorf("Expected 2 fetches by 2 refreshers, but found %d fetches", fetches)
+	}
+	if actual := fmt.Sprint(b.IPRanges()); actual != "[192.168.0.0/16]" {
+		t.Errorf("Expected shared ranges, but found %s", actual)
+	}
+
+	// the refresher keeps running until all sources sharing it are cleaned up
+	for i, test := range []struct {
+		refresher *rangeRefresher
+		running   bool
+	}{
+		{a, true},
+		{b, false},
+		{c, false},
+	} {
+		if err := test.refresher.stop(); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+		running := false
+		sharedRefreshers.Range(func(key, value interface{}) bool {
+			running = running || key == "realip/ranges/shared"
+			return true
+		})
+		if running != test.running {
+			t.Errorf("Test %d: Expected running %v, but found %v", i, test.running, running)
+		}
+	}
+}
+
+func TestParseRangeList(t *testing.T) {
+	ranges, err := parseRangeList(strings.NewReader("# trusted proxies\n10.0.0.0/8\n\n  192.0.2.1 # lb\n2001:db8::/32\n2001:db8::1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprint(ranges); actual != "[10.0.0.0/8 192.0.2.1/32 2001:db8::/32 2001:db8::1/128]" {
+		t.Errorf("Unexpected ranges %s", actual)
+	}
+	if _, err := parseRangeList(strings.NewReader("10.0.0.0/8\nnonsense\n")); err == nil {
+		t.Errorf("Expected an error for an invalid line")
+	}
+}
+
+func TestURLSource(t *testing.T) {
+	var requests, notModified int
+	list := "10.0.0.0/8\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case list == "":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Header.Get("If-None-Match") == `"v1"` && list == "10.0.0.0/8\n":
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, list)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s := &urlSource{URL: srv.URL, http: httpFetcher{client: srv.Client()}}
+	s.refresher.fetch = s.fetch
+	s.refresher.start(ctx, nil)
+	if actual := fmt.Sprint(s.IPRanges()); actual != "[10.0.0.0/8]" {
+		t.Errorf("Unexpected ranges %s", actual)
+	}
+
+	s.refresher.refresh(ctx)
+	if actual := fmt.Sprint(s.IPRanges()); notModified != 1 || actual != "[10.0.0.0/8]" {
+		t.Errorf("Expected unchanged ranges from a 304 response, but found %s after %d not modified", actual, notModified)
+	}
+
+	list = "192.168.0.0/16\n"
+	s.refresher.refresh(ctx)
+	if actual := fmt.Sprint(s.IPRanges()); actual != "[192.168.0.0/16]" {
+		t.Errorf("Expected updated ranges, but found %s", actual)
+	}
+
+	list = ""
+	s.refresher.refresh(ctx)
+	if actual := fmt.Sprint(s.IPRanges()); requests != 4 || actual != "[192.168.0.0/16]" {
+		t.Errorf("Expected previous ranges after a failed fetch, but found %s", actual)
+	}
+
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"from_url https://example.com/ips.txt", `{"Refresh":0,"Timeout":0,"URL":"https://example.com/ips.txt","source":"url"}`},
+		{"from_url https://example.com/ips.txt refresh 1h", `{"Refresh":3600000000000,"Timeout":0,"URL":"https://example.com/ips.txt","source":"url"}`},
+		{"from_url https://example.com/ips.txt {\n refresh 1m\n timeout 5s\n }", `{"Refresh":60000000000,"Timeout":5000000000,"URL":"https://example.com/ips.txt","source":"url"}`},
+		{"source url https://example.com/ips.txt refresh 1h", `{"Refresh":3600000000000,"Timeout":0,"URL":"https://example.com/ips.txt","source":"url"}`},
+		{"from_url https://example.com/ips.txt {\n max_stale 48h\n on_stale closed\n }", `{"MaxStale":172800000000000,"OnStale":"closed","Refresh":0,"Timeout":0,"URL":"https://example.com/ips.txt","source":"url"}`},
+	} {
+		m := &module{}
+		if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n "+test.input+"\n header X-Forwarded-For\n}")); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if len(m.Sources) != 1 || string(m.Sources[0]) != test.expected || m.Header != "X-Forwarded-For" {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, m.Sources)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "realip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trusted_proxies.txt")
+	if err := ioutil.WriteFile(path, []byte("# proxies\n10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fileSource{Path: path}
+	s.refresher.fetch = s.read
+	if err := s.watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprint(s.IPRanges()); actual != "[10.0.0.0/8]" {
+		t.Errorf("Unexpected ranges %s", actual)
+	}
+
+	// replace the file the way configuration management tools do
+	tmp := filepath.Join(dir, ".trusted_proxies.txt.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("192.168.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitForRanges(t, s, "[192.168.0.0/16]")
+
+	if err := ioutil.WriteFile(path, []byte("nonsense\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("172.16.0.0/12\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForRanges(t, s, "[172.16.0.0/12]")
+
+	if err := (&fileSource{Path: filepath.Join(dir, "missing")}).watch(ctx); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+// waitForRanges waits up to 5s for source to provide the expected ranges.
+func waitForRanges(t *testing.T, source IPSource, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for actual := ""; ; time.Sleep(10 * time.Millisecond) {
+		if actual = fmt.Sprint(source.IPRanges()); actual == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Expected ranges %s, but found %s", expected, actual)
+			return
+		}
+	}
+}
+
+func TestDNSSource(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name == "lb.example.com." && q.Qtype == dns.TypeA:
+			resp.Answer = append(resp.Answer,
+				&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")},
+				&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.2")})
+		case q.Name == "lb.example.com." && q.Qtype == dns.TypeAAAA:
+			resp.Answer = append(resp.Answer,
+				&dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 120}, AAAA: net.ParseIP("2001:db8::1")})
+		case q.Name == "empty.example.com.":
+		default:
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	for i, test := range []struct {
+		names    []string
+		expected string
+		ttl      time.Duration
+		err      bool
+	}{
+		{[]string{"lb.example.com"}, "[192.0.2.1/32 192.0.2.2/32 2001:db8::1/128]", time.Minute, false},
+		{[]string{"lb.example.com", "missing.example.com"}, "", 0, true},
+		{[]string{"empty.example.com"}, "", 0, true},
+	} {
+		s := &dnsSource{Names: test.names, Resolvers: []string{pc.LocalAddr().String()}, MinRefresh: caddy.Duration(5 * time.Second), MaxRefresh: caddy.Duration(time.Hour), client: new(dns.Client)}
+		ranges, err := s.resolve(context.Background())
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Expected error %v, but got %v", i, test.err, err)
+			continue
+		}
+		if actual := fmt.Sprint(ranges); !test.err && actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		if s.ttl != test.ttl {
+			t.Errorf("Test %d: Expected TTL %s, but found %s", i, test.ttl, s.ttl)
+		}
+	}
+
+	s := &dnsSource{MinRefresh: caddy.Duration(5 * time.Second), MaxRefresh: caddy.Duration(time.Hour)}
+	for i, test := range []struct {
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{time.Minute, time.Minute},
+		{time.Second, 5 * time.Second},
+		{24 * time.Hour, time.Hour},
+	} {
+		s.ttl = test.ttl
+		if actual := s.next(); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestAWSSource(t *testing.T) {
+	doc := `{
+  "syncToken": "1589917992",
+  "createDate": "2020-05-19-19-53-12",
+  "prefixes": [
+    {"ip_prefix": "13.32.0.0/15", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"},
+    {"ip_prefix": "13.32.0.0/15", "region": "GLOBAL", "service": "AMAZON", "network_border_group": "GLOBAL"},
+    {"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "S3", "network_border_group": "ap-northeast-2"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2600:9000::/28", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"},
+    {"ipv6_prefix": "2a05:d07a:a000::/40", "region": "eu-south-1", "service": "S3", "network_border_group": "eu-south-1"}
+  ]
+}`
+	for i, test := range []struct {
+		services []string
+		regions  []string
+		expected string
+	}{
+		{[]string{"CLOUDFRONT"}, nil, "[13.32.0.0/15 2600:9000::/28]"},
+		{[]string{"s3"}, []string{"eu-south-1"}, "[2a05:d07a:a000::/40]"},
+		{[]string{"S3", "CLOUDFRONT"}, []string{"GLOBAL", "ap-northeast-2"}, "[13.32.0.0/15 3.5.140.0/22 2600:9000::/28]"},
+		{[]string{"EC2"}, nil, ""},
+	} {
+		s := &awsSource{Services: test.services, Regions: test.regions}
+		ranges, err := s.parse(strings.NewReader(doc))
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = ""
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n source aws CLOUDFRONT_ORIGIN_FACING {\n regions us-east-1 GLOBAL\n }\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Sources) != 1 || string(m.Sources[0]) != `{"Refresh":0,"Regions":["us-east-1","GLOBAL"],"Services":["CLOUDFRONT_ORIGIN_FACING"],"URL":"","source":"aws"}` {
+		t.Errorf("Unexpected sources: %s", m.Sources)
+	}
+}
+
+func TestCloudflareSource(t *testing.T) {
+	online := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"ipv4_cidrs":["173.245.48.0/20"],"ipv6_cidrs":["2400:cb00::/32"],"etag":"38f79d050aa027e3be3865e495dcc9bc"},"success":true,"errors":[],"messages":[]}`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	fallback, err := parseRanges(presets["cloudflare"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		online   bool
+		expected string
+	}{
+		{true, "[173.245.48.0/20 2400:cb00::/32]"},
+		{false, fmt.Sprint(fallback)},
+	} {
+		online = test.online
+		s := &cloudflareSource{URL: srv.URL, http: httpFetcher{client: srv.Client()}}
+		s.refresher.fetch = s.fetch
+		s.refresher.start(ctx, fallback)
+		if actual := fmt.Sprint(s.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	if _, err := parseCloudflareIPs(strings.NewReader(`{"result":null,"success":false,"errors":[{"code":10000}]}`)); err == nil {
+		t.Errorf("Expected an error for an unsuccessful response")
+	}
+}
+
+func TestFastlySource(t *testing.T) {
+	online := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"addresses":["151.101.0.0/16"],"ipv6_addresses":["2a04:4e40::/32"]}`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	fallback, err := parseRanges(presets["fastly"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		online   bool
+		expected string
+	}{
+		{true, "[151.101.0.0/16 2a04:4e40::/32]"},
+		{false, fmt.Sprint(fallback)},
+	} {
+		online = test.online
+		s := &fastlySource{URL: srv.URL, http: httpFetcher{client: srv.Client()}}
+		s.refresher.fetch = s.fetch
+		s.refresher.start(ctx, fallback)
+		if actual := fmt.Sprint(s.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	china, err := parseCloudflareChinaIPs(strings.NewReader(`{"result":{"ipv4_cidrs":["173.245.48.0/20"],"jdcloud_cidrs":["116.196.71.0/24","2402:db40:5100::/48"]},"success":true}`))
+	if actual := fmt.Sprint(china); err != nil || actual != "[116.196.71.0/24 2402:db40:5100::/48]" {
+		t.Errorf("Unexpected China Network ranges %s (%v)", actual, err)
+	}
+	if _, err := parseCloudflareChinaIPs(strings.NewReader(`{"result":{"jdcloud_cidrs":[]},"success":true}`)); err == nil {
+		t.Errorf("Expected an error for an empty response")
+	}
+	// lists fetched at runtime can't name presets
+	if _, err := parseCloudflareIPs(strings.NewReader(`{"result":{"ipv4_cidrs":["private"],"ipv6_cidrs":["loopback"]},"success":true}`)); err == nil {
+		t.Errorf("Expected an error for a preset name in the list")
+	}
+	if _, err := parseFastlyIPs(strings.NewReader(`{"addresses":["private"]}`)); err == nil {
+		t.Errorf("Expected an error for a preset name in the list")
+	}
+
+	if _, err := parseFastlyIPs(strings.NewReader(`{"addresses":[]}`)); err == nil {
+		t.Errorf("Expected an error for an empty response")
+	}
+}
+
+func TestPresetSource(t *testing.T) {
+	online := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"ipv4_cidrs":["173.245.48.0/20"],"ipv6_cidrs":["2400:cb00::/32"]},"success":true}`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	snapshot, err := parseRanges(presets["cloudflare"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		online   bool
+		expected string
+		status   string
+	}{
+		{false, fmt.Sprint(snapshot), fmt.Sprintf("snapshot %d", len(snapshot))},
+		{true, "[173.245.48.0/20 2400:cb00::/32]", "live 2"},
+	} {
+		online = test.online
+		s := &presetSource{Name: "cloudflare", feed: presetFeed{srv.URL, parseCloudflareIPs}, http: httpFetcher{client: srv.Client()}}
+		setPresetStatus(presetStatus{Name: s.Name, URL: srv.URL, Status: presetSnapshot, Ranges: len(snapshot)})
+		s.refresher.fetch = s.fetch
+		s.refresher.start(ctx, snapshot)
+		if actual := fmt.Sprint(s.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		statuses := livePresets()
+		if len(statuses) != 1 {
+			t.Fatalf("Test %d: Expected one preset status, but found %v", i, statuses)
+		}
+		if actual := fmt.Sprintf("%s %d", statuses[0].Status, statuses[0].Ranges); actual != test.status {
+			t.Errorf("Test %d: Expected status '%s', but found '%s'", i, test.status, actual)
+		}
+	}
+	presetStatuses.m = nil
+
+	for i, test := range []struct {
+		input   string
+		from    string
+		sources string
+	}{
+		{"from cloudflare 10.0.0.0/8\n live_presets", "[10.0.0.0/8]", `[{"Name":"cloudflare","Refresh":0,"source":"preset"}]`},
+		{"live_presets 12h\n from gcp fastly", "[130.211.0.0/22 35.191.0.0/16]", `[{"Name":"fastly","Refresh":43200000000000,"source":"preset"}]`},
+		{"from cloudflare 173.245.48.0/20\n live_presets", "[173.245.48.0/20]", `[{"Name":"cloudflare","Refresh":0,"source":"preset"}]`},
+		{"from cloudflare", fmt.Sprint(snapshot), `[]`},
+		{"source preset gcore 1h", "[]", `[{"Name":"gcore","Refresh":3600000000000,"source":"preset"}]`},
+		{"source preset gcp", "", ""},
+	} {
+		m := &module{}
+		err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n "+test.input+"\n}"))
+		if test.sources == "" {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		sources := make([]string, len(m.Sources))
+		for j, raw := range m.Sources {
+			sources[j] = string(raw)
+		}
+		if actual := "[" + strings.Join(sources, ",") + "]"; actual != test.sources {
+			t.Errorf("Test %d: Expected sources '%s', but found '%s'", i, test.sources, actual)
+		}
+		if actual := fmt.Sprint(m.From); actual != test.from {
+			t.Errorf("Test %d: Expected from '%s', but found '%s'", i, test.from, actual)
+		}
+	}
+}
+
+func TestCrawlerSource(t *testing.T) {
+	ptr := map[string][]string{
+		"66.249.66.1":  {"crawl-66-249-66-1.googlebot.com."},
+		"66.249.66.2":  {"crawl-66-249-66-2.googlebot.com.evil.example."},
+		"66.249.66.3":  {"crawl-66-249-66-3.googlebot.com."},
+		"157.55.39.1":  {"msnbot-157-55-39-1.search.msn.com."},
+		"203.0.113.10": {"host.example.net."},
+	}
+	forward := map[string][]string{
+		"crawl-66-249-66-1.googlebot.com":   {"66.249.66.1"},
+		"crawl-66-249-66-3.googlebot.com":   {"66.249.66.99"},
+		"msnbot-157-55-39-1.search.msn.com": {"157.55.39.1"},
+	}
+	lookups := 0
+	s := &crawlerSource{
+		Domains:    []string{"googlebot.com", "search.msn.com"},
+		Agents:     []string{"Googlebot", "bingbot", "Mozilla"},
+		TTL:        caddy.Duration(time.Hour),
+		MaxEntries: 10,
+		cache:      newCrawlerCache(),
+		lookupAddr: func(ctx context.Context, addr string) ([]string, error) {
+			lookups++
+			return ptr[addr], nil
+		},
+		lookupIP: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			var addrs []net.IPAddr
+			for _, a := range forward[host] {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+			}
+			return addrs, nil
+		},
+	}
+	for i, test := range []struct {
+		host     string
+		agent    string
+		expected string
+	}{
+		{"66.249.66.1", "Googlebot/2.1", "crawl-66-249-66-1.googlebot.com"},
+		{"66.249.66.2", "Googlebot/2.1", ""},
+		{"66.249.66.3", "Googlebot/2.1", ""},
+		{"157.55.39.1", "bingbot/2.0", "msnbot-157-55-39-1.search.msn.com"},
+		{"203.0.113.10", "Mozilla/5.0", ""},
+		{"66.249.66.1", "Googlebot/2.1", "crawl-66-249-66-1.googlebot.com"},
+	} {
+		if actual := s.verify(context.Background(), test.host, test.agent); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+	if lookups != 5 {
+		t.Errorf("Expected cached results to be reused, but found %d lookups", lookups)
+	}
+	if actual := trustedCrawlers(s); actual != "[157.55.39.1 66.249.66.1]" {
+		t.Errorf("Unexpected trusted crawlers %s", actual)
+	}
+	if len(s.IPRanges()) != 0 {
+		t.Errorf("Expected crawlers not to be added to the ranges, but found %v", s.IPRanges())
+	}
+
+	s.Agents = []string{"bingbot"}
+	if actual := s.verify(context.Background(), "66.249.66.9", "Googlebot/2.1"); actual != "" || lookups != 5 {
+		t.Errorf("Expected agents to limit verification, but found '%s' after %d lookups", actual, lookups)
+	}
+
+	// a full cache evicts failed verifications first, least recently
+	// used first, and then verified crawlers
+	s.Agents = []string{"Googlebot", "bingbot", "Mozilla"}
+	s.MaxEntries = 3
+	s.cache = newCrawlerCache()
+	for _, host := range []string{"66.249.66.1", "203.0.113.10", "66.249.66.2", "157.55.39.1", "66.249.66.3"} {
+		s.verify(context.Background(), host, "Googlebot/2.1")
+	}
+	cached := make([]string, 0, len(s.cache.entries))
+	for host := range s.cache.entries {
+		cached = append(cached, host)
+	}
+	sort.Strings(cached)
+	if actual := fmt.Sprint(cached); actual != "[157.55.39.1 66.249.66.1 66.249.66.3]" {
+		t.Errorf("Unexpected cached addresses after eviction %s", actual)
+	}
+	s.MaxEntries = 2
+	s.verify(context.Background(), "203.0.113.11", "Googlebot/2.1")
+	if actual := trustedCrawlers(s); actual != "[157.55.39.1]" {
+		t.Errorf("Unexpected trusted crawlers after evicting a verified crawler %s", actual)
+	}
+
+	// an expired verification is dropped even if the agent doesn't match
+	s.cache.entries["157.55.39.1"].Value.(*crawlerEntry).expires = time.Now()
+	if actual := s.verify(context.Background(), "157.55.39.1", "curl/8.0"); actual != "" || s.trusts("157.55.39.1") {
+		t.Errorf("Expected an expired crawler to be dropped, but found '%s'", actual)
+	}
+
+	// concurrent requests from the same address share one verification
+	var pending int32
+	release := make(chan struct{})
+	c := &crawlerSource{
+		Domains:    s.Domains,
+		Agents:     s.Agents,
+		TTL:        s.TTL,
+		MaxEntries: 10,
+		cache:      newCrawlerCache(),
+		lookupAddr: func(ctx context.Context, addr string) ([]string, error) {
+			atomic.AddInt32(&pending, 1)
+			<-release
+			return ptr[addr], nil
+		},
+		lookupIP: s.lookupIP,
+	}
+	names := make(chan string)
+	for i := 0; i < 5; i++ {
+		go func() {
+			names <- c.verify(context.Background(), "66.249.66.1", "Googlebot/2.1")
+		}()
+	}
+	for {
+		c.cache.Lock()
+		waiting := len(c.cache.pending)
+		c.cache.Unlock()
+		if waiting == 1 && atomic.LoadInt32(&pending) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// give the other requests time to join the verification
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		if name := <-names; name != "crawl-66-249-66-1.googlebot.com" {
+			t.Errorf("Expected a shared verification to find the crawler, but found '%s'", name)
+		}
+	}
+	if lookups := atomic.LoadInt32(&pending); lookups != 1 {
+		t.Errorf("Expected one verification, but found %d", lookups)
+	}
+
+	s.MaxEntries = 10
+	s.cache = newCrawlerCache()
+	m := &module{MaxHops: 5, Header: "X-Forwarded-For", sources: []IPSource{s}, crawlers: []*crawlerSource{s}, allCrawlers: []*crawlerSource{s}}
+	headers := http.Header{"X-Forwarded-For": {"1.2.3.4"}, "User-Agent": {"Mozilla/5.0 (compatible; bingbot/2.0)"}}
+	if actual := serveTestHeaders(t, 0, m, "157.55.39.1:123", headers); actual != "1.2.3.4:123" {
+		t.Errorf("Expected a verified crawler to be trusted, but found '%s'", actual)
+	}
+	if actual := serveTestHeaders(t, 1, m, "203.0.113.10:123", headers); actual != "203.0.113.10:123" {
+		t.Errorf("Expected an unverified peer not to be trusted, but found '%s'", actual)
+	}
+
+	c = &crawlerSource{}
+	if err := c.UnmarshalCaddyfile(newTestDispenser(t, "crawler googlebot.com google.com {\n agents Googlebot\n ttl 30m\n tag_only\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprint(c.Domains, c.Agents, c.TTL, c.TagOnly); actual != "[googlebot.com google.com] [Googlebot] 1800000000000 true" {
+		t.Errorf("Unexpected config %s", actual)
+	}
+	if err := new(crawlerSource).UnmarshalCaddyfile(newTestDispenser(t, "crawler")); err == nil {
+		t.Errorf("Expected an error without domains")
+	}
+	if err := new(crawlerSource).UnmarshalCaddyfile(newTestDispenser(t, "crawler googlebot.com")); err == nil {
+		t.Errorf("Expected an error without agents")
+	}
+}
+
+// trustedCrawlers returns the sorted addresses s trusts as crawlers.
+func trustedCrawlers(s *crawlerSource) string {
+	var hosts []string
+	for host := range s.cache.entries {
+		if s.trusts(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return fmt.Sprint(hosts)
+}
+
+func TestGcoreSource(t *testing.T) {
+	online := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"addresses":["92.223.84.0/24","5.188.126.1/32"],"addresses_v6":["2a03:90c0::/32"]}`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	fallback, err := parseRanges(presets["gcore"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		online   bool
+		expected string
+	}{
+		{true, "[92.223.84.0/24 5.188.126.1/32 2a03:90c0::/32]"},
+		{false, fmt.Sprint(fallback)},
+	} {
+		online = test.online
+		s := &gcoreSource{URL: srv.URL, http: httpFetcher{client: srv.Client()}}
+		s.refresher.fetch = s.fetch
+		s.refresher.start(ctx, fallback)
+		if actual := fmt.Sprint(s.IPRanges()); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	if _, err := parseGcoreIPs(strings.NewReader(`{"addresses":[]}`)); err == nil {
+		t.Errorf("Expected an error for an empty response")
+	}
+}
+
+func TestGoogleSource(t *testing.T) {
+	goog := `{"syncToken": "1589917992", "creationTime": "2020-05-19T12:53:12.000", "prefixes": [{"ipv4Prefix": "8.8.4.0/24"}, {"ipv4Prefix": "35.191.0.0/16"}, {"ipv6Prefix": "2001:4860::/32"}]}`
+	cloud := `{"syncToken": "1589917992", "creationTime": "2020-05-19T12:53:12.000", "prefixes": [{"ipv4Prefix": "34.80.0.0/15", "service": "Google Cloud", "scope": "asia-east1"}, {"ipv4Prefix": "34.74.0.0/15", "service": "Google Cloud", "scope": "us-east1"}, {"ipv6Prefix": "2600:1900:4030::/44", "service": "Google Cloud", "scope": "us-east1"}]}`
+	for i, test := range []struct {
+		doc      string
+		scopes   []string
+		expected string
+	}{
+		{goog, nil, "[8.8.4.0/24 35.191.0.0/16 2001:4860::/32]"},
+		{goog, []string{"us-east1"}, "[8.8.4.0/24 35.191.0.0/16 2001:4860::/32]"},
+		{cloud, nil, "[34.80.0.0/15 34.74.0.0/15 2600:1900:4030::/44]"},
+		{cloud, []string{"us-east1"}, "[34.74.0.0/15 2600:1900:4030::/44]"},
+		{cloud, []string{"europe-west1"}, ""},
+	} {
+		s := &googleSource{Scopes: test.scopes}
+		ranges, err := s.parse(strings.NewReader(test.doc))
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = ""
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n source google goog cloud {\n scopes us-east1\n }\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Sources) != 1 || string(m.Sources[0]) != `{"Feeds":["goog","cloud"],"Refresh":0,"Scopes":["us-east1"],"source":"google"}` {
+		t.Errorf("Unexpected sources: %s", m.Sources)
+	}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n source google gcp\n}")); err == nil {
+		t.Errorf("Expected an error for an unknown feed")
+	}
+}
+
+func TestGitHubSource(t *testing.T) {
+	meta := `{"verifiable_password_authentication": true, "hooks": ["192.30.252.0/22", "2a0a:a440::/29"], "web": ["140.82.112.0/20"], "actions": []}`
+	for i, test := range []struct {
+		keys     []string
+		expected string
+	}{
+		{[]string{"hooks"}, "[192.30.252.0/22 2a0a:a440::/29]"},
+		{[]string{"hooks", "web"}, "[192.30.252.0/22 2a0a:a440::/29 140.82.112.0/20]"},
+		{[]string{"actions"}, ""},
+		{[]string{"verifiable_password_authentication"}, ""},
+		{[]string{"missing"}, ""},
+	} {
+		s := &githubSource{Keys: test.keys}
+		ranges, err := s.parse(strings.NewReader(meta))
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = ""
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestKubernetesSource(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/api/v1/namespaces/ingress/pods":
+			if r.URL.Query().Get("labelSelector") != "app=nginx" {
+				w.Write([]byte(`{"items": []}`))
+				return
+			}
+			w.Write([]byte(`{"items": [
+				{"status": {"podIP": "10.1.0.5", "podIPs": [{"ip": "10.1.0.5"}, {"ip": "fd00::5"}]}},
+				{"status": {"podIP": "10.1.1.7"}},
+				{"status": {}}
+			]}`))
+		case "/api/v1/nodes":
+			w.Write([]byte(`{"items": [
+				{"spec": {"podCIDR": "10.1.0.0/24", "podCIDRs": ["10.1.0.0/24"]}},
+				{"spec": {"podCIDR": "10.1.1.0/24"}}
+			]}`))
+		default:
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "realip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		namespace string
+		selector  string
+		nodeCIDRs bool
+		expected  string
+	}{
+		{"ingress", "app=nginx", false, "[10.1.0.5/32 10.1.0.5/32 fd00::5/128 10.1.1.7/32]"},
+		{"ingress", "app=other", false, "[]"},
+		{"ingress", "", true, "[10.1.0.0/24 10.1.0.0/24 10.1.1.0/24]"},
+		{"other", "app=nginx", false, "error"},
+	} {
+		s := &kubernetesSource{
+			Namespace: test.namespace,
+			Selector:  test.selector,
+			NodeCIDRs: test.nodeCIDRs,
+			client:    srv.Client(),
+			server:    srv.URL,
+			tokenFile: tokenFile,
+		}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		if auth != "Bearer secret" {
+			t.Errorf("Test %d: Expected 'Bearer secret', but found '%s'", i, auth)
+		}
+	}
+}
+
+func TestDockerSource(t *testing.T) {
+	addrs := map[string][]net.Addr{
+		"lo": {
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+		},
+		"eth0": {
+			&net.IPNet{IP: net.ParseIP("172.18.0.3"), Mask: net.CIDRMask(16, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::42:acff:fe12:3"), Mask: net.CIDRMask(64, 128)},
+		},
+		"eth1": {
+			&net.IPNet{IP: net.ParseIP("192.168.96.2").To4(), Mask: net.CIDRMask(20, 32)},
+			&net.IPNet{IP: net.ParseIP("fd00:db8:1::3"), Mask: net.CIDRMask(64, 128)},
+		},
+	}
+	for i, test := range []struct {
+		interfaces []string
+		expected   string
+	}{
+		{nil, "[172.18.0.0/16 192.168.96.0/20 fd00:db8:1::/64]"},
+		{[]string{"eth1"}, "[192.168.96.0/20 fd00:db8:1::/64]"},
+		{[]string{"lo"}, "error"},
+	} {
+		s := &dockerSource{
+			Interfaces: test.interfaces,
+			addrs:      func() (map[string][]net.Addr, error) { return addrs, nil },
+		}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestInterfaceSource(t *testing.T) {
+	addrs := map[string][]net.Addr{
+		"eth0": {
+			&net.IPNet{IP: net.ParseIP("172.18.0.3"), Mask: net.CIDRMask(16, 32)},
+		},
+		"wg0": {
+			&net.IPNet{IP: net.ParseIP("10.8.0.1"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		},
+		"tailscale0": {
+			&net.IPNet{IP: net.ParseIP("100.101.102.103"), Mask: net.CIDRMask(32, 32)},
+		},
+	}
+	for i, test := range []struct {
+		names    []string
+		expected string
+	}{
+		{[]string{"wg0"}, "[10.8.0.0/24]"},
+		{[]string{"tailscale0", "wg0"}, "[100.101.102.103/32 10.8.0.0/24]"},
+		{[]string{"wg0", "wg1"}, "error"},
+	} {
+		s := &interfaceSource{
+			Names: test.names,
+			addrs: func() (map[string][]net.Addr, error) { return addrs, nil },
+		}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestTailscaleSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/localapi/v0/status":
+			w.Write([]byte(`{"Self": {"TailscaleIPs": ["100.64.0.1"]}, "Peer": {
+				"nodekey:b": {"HostName": "edge-2", "DNSName": "edge-2.example.ts.net.", "Tags": ["tag:proxy"], "TailscaleIPs": ["100.64.0.3", "fd7a:115c:a1e0::3"]},
+				"nodekey:a": {"HostName": "Edge 1", "DNSName": "edge-1.example.ts.net.", "TailscaleIPs": ["100.64.0.2"]},
+				"nodekey:c": {"HostName": "laptop", "DNSName": "laptop.example.ts.net.", "TailscaleIPs": ["100.64.0.4"]}
+			}}`))
+		case r.URL.Path == "/api/v2/tailnet/example.com/devices" && r.Header.Get("Authorization") == "Bearer secret":
+			w.Write([]byte(`{"devices": [
+				{"addresses": ["100.64.0.3"], "hostname": "edge-2", "name": "edge-2.example.ts.net", "tags": ["tag:proxy"]},
+				{"addresses": ["100.64.0.4"], "hostname": "laptop", "name": "laptop.example.ts.net"}
+			]}`))
+		default:
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	for i, test := range []struct {
+		tags     []string
+		hosts    []string
+		apiKey   string
+		expected string
+	}{
+		{[]string{"tag:proxy"}, nil, "", "[100.64.0.3/32 fd7a:115c:a1e0::3/128]"},
+		{nil, []string{"edge-1"}, "", "[100.64.0.2/32]"},
+		{nil, []string{"Edge 1", "edge-2.example.ts.net."}, "", "[100.64.0.2/32 100.64.0.3/32 fd7a:115c:a1e0::3/128]"},
+		{[]string{"tag:other"}, nil, "", "[]"},
+		{[]string{"tag:proxy"}, nil, "secret", "[100.64.0.3/32]"},
+		{nil, []string{"laptop"}, "wrong", "error"},
+	} {
+		s := &tailscaleSource{
+			Tags:    test.tags,
+			Hosts:   test.hosts,
+			APIKey:  test.apiKey,
+			Tailnet: "example.com",
+			URL:     srv.URL,
+			client:  srv.Client(),
+		}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestCloudSource(t *testing.T) {
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" && r.Method == "PUT" {
+			w.Write([]byte("token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/network/interfaces/macs/":
+			w.Write([]byte("0e:49:61:0f:c3:11/\n0e:49:61:0f:c3:12/"))
+		case "/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/vpc-ipv4-cidr-blocks":
+			w.Write([]byte("172.31.0.0/16\n100.64.0.0/16"))
+		case "/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/vpc-ipv6-cidr-blocks":
+			w.Write([]byte("2600:1f18:1234:5600::/56"))
+		case "/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:12/vpc-ipv4-cidr-blocks":
+			w.Write([]byte("10.1.0.0/16"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer aws.Close()
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[{"ip": "10.128.0.5", "subnetmask": "255.255.240.0"}]`))
+	}))
+	defer gcp.Close()
+	azure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("api-version") == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"interface": [{"ipv4": {"subnet": [{"address": "10.0.1.0", "prefix": "24"}]}, "ipv6": {"subnet": []}}]}`))
+	}))
+	defer azure.Close()
+	oci := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer Oracle" || r.URL.Path != "/opc/v2/vnics/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"privateIp": "10.0.0.5", "subnetCidrBlock": "10.0.0.0/24", "ipv6SubnetCidrBlock": "2603:c020:4000:1200::/64"}]`))
+	}))
+	defer oci.Close()
+
+	for i, test := range []struct {
+		provider string
+		urls     map[string]string
+		expected string
+	}{
+		{"aws", map[string]string{"aws": aws.URL}, "[172.31.0.0/16 100.64.0.0/16 2600:1f18:1234:5600::/56 10.1.0.0/16]"},
+		{"gcp", map[string]string{"gcp": gcp.URL}, "[130.211.0.0/22 35.191.0.0/16 10.128.0.0/20]"},
+		{"azure", map[string]string{"azure": azure.URL}, "[168.63.129.16/32 10.0.1.0/24]"},
+		{"auto", map[string]string{"aws": gcp.URL, "gcp": gcp.URL, "azure": azure.URL}, "[130.211.0.0/22 35.191.0.0/16 10.128.0.0/20]"},
+		{"auto", map[string]string{"aws": azure.URL, "gcp": azure.URL, "azure": azure.URL}, "[168.63.129.16/32 10.0.1.0/24]"},
+		{"oci", map[string]string{"oci": oci.URL}, "[10.0.0.0/24 2603:c020:4000:1200::/64]"},
+		{"auto", map[string]string{"aws": oci.URL, "gcp": oci.URL, "azure": oci.URL, "oci": oci.URL}, "[10.0.0.0/24 2603:c020:4000:1200::/64]"},
+		{"auto", map[string]string{"aws": gcp.URL, "gcp": aws.URL, "azure": aws.URL, "oci": aws.URL}, "error"},
+	} {
+		s := &cloudSource{Provider: test.provider, client: aws.Client(), urls: test.urls}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestJSONSource(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Query().Get("offset") {
+		case "":
+			fmt.Fprintf(w, `{"count": 3, "next": "%s/api/ipam/prefixes/?offset=2", "results": [{"prefix": "10.1.0.0/24"}, {"prefix": "2001:db8::/48"}]}`, srv.URL)
+		case "2":
+			w.Write([]byte(`{"count": 3, "next": null, "results": [{"prefix": "10.2.0.0/24"}]}`))
+		default:
+			w.Write([]byte(`{"proxies": {"b": ["192.0.2.2"], "a": ["192.0.2.1", null]}, "bad": [{"prefix": 5}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	for i, test := range []struct {
+		url      string
+		path     string
+		next     string
+		expected string
+	}{
+		{"/api/ipam/prefixes/", "results.*.prefix", "next", "[10.1.0.0/24 2001:db8::/48 10.2.0.0/24]"},
+		{"/api/ipam/prefixes/", "results.*.prefix", "", "[10.1.0.0/24 2001:db8::/48]"},
+		{"/api/ipam/prefixes/", "results.*.address", "next", "error"},
+		{"/proxies?offset=x", "proxies.*.*", "", "[192.0.2.1/32 192.0.2.2/32]"},
+		{"/proxies?offset=x", "bad.*.prefix", "", "error"},
+	} {
+		s := &jsonSource{URL: srv.URL + test.url, Path: test.path, Next: test.next, Token: "secret", TokenScheme: "Token", client: srv.Client()}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestConsulSource(t *testing.T) {
+	var index int
+	var value, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/realip/trusted" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query().Get("index") + " " + r.URL.Query().Get("wait")
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		if value == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+	defer srv.Close()
+
+	s := &consulSource{Key: "realip/trusted", Address: srv.URL, Token: "secret", Wait: caddy.Duration(time.Minute), client: srv.Client()}
+	s.refresher.fetch = s.fetch
+	for i, test := range []struct {
+		index         int
+		value         string
+		expectedQuery string
+		expected      string
+	}{
+		{10, "10.0.0.0/8\n192.0.2.1", " ", "[10.0.0.0/8 192.0.2.1/32]"},
+		{10, "ignored", "10 60s", "[10.0.0.0/8 192.0.2.1/32]"},
+		{12, "172.16.0.0/12", "10 60s", "[172.16.0.0/12]"},
+		{13, "", "12 60s", "error"},
+		{14, "invalid", "13 60s", "error"},
+		{3, "10.0.0.0/8", "14 60s", "[10.0.0.0/8]"},
+		{5, "192.0.2.0/24", " ", "[192.0.2.0/24]"},
+	} {
+		index, value = test.index, test.value
+		err := s.refresher.refresh(context.Background())
+		if query != test.expectedQuery {
+			t.Errorf("Test %d: Expected query '%s', but found '%s'", i, test.expectedQuery, query)
+		}
+		actual := fmt.Sprint(s.refresher.IPRanges())
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestEtcdSource(t *testing.T) {
+	var revision int
+	var value string
+	var watchRevision string
+	changed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/auth/authenticate":
+			w.Write([]byte(`{"token": "tok"}`))
+		case "/v3/kv/range":
+			if r.Header.Get("Authorization") != "tok" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var req struct{ Key []byte }
+			json.NewDecoder(r.Body).Decode(&req)
+			resp := map[string]interface{}{"header": map[string]string{"revision": strconv.Itoa(revision)}}
+			if value != "" && string(req.Key) == "/realip/trusted" {
+				resp["kvs"] = []map[string][]byte{{"key": req.Key, "value": []byte(value)}}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v3/watch":
+			var req struct {
+				CreateRequest struct {
+					StartRevision string `json:"start_revision"`
+				} `json:"create_request"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			watchRevision = req.CreateRequest.StartRevision
+			w.Write([]byte(`{"result": {"header": {}, "created": true}}`))
+			w.(http.Flusher).Flush()
+			<-changed
+			w.Write([]byte(`{"result": {"header": {}, "events": [{"kv": {}}]}}`))
+		}
+	}))
+	defer srv.Close()
+	defer close(changed)
+
+	s := &etcdSource{Key: "/realip/trusted", Endpoint: srv.URL, Username: "root", Wait: caddy.Duration(time.Minute), client: srv.Client()}
+	for i, test := range []struct {
+		revision      int
+		value         string
+		expectedWatch string
+		expected      string
+	}{
+		{7, "10.0.0.0/8", "", "[10.0.0.0/8]"},
+		{9, "10.0.0.0/8\n192.0.2.1", "8", "[10.0.0.0/8 192.0.2.1/32]"},
+		{11, "", "10", "error"},
+		{12, "invalid", "12", "error"},
+	} {
+		revision, value = test.revision, test.value
+		watchRevision = ""
+		if i > 0 {
+			go func() { changed <- struct{}{} }()
+		}
+		ranges, err := s.fetch(context.Background())
+		if watchRevision != test.expectedWatch {
+			t.Errorf("Test %d: Expected watch from '%s', but found '%s'", i, test.expectedWatch, watchRevision)
+		}
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+
+	// a watch that ends without a change keeps the list current
+	s.Wait = caddy.Duration(50 * time.Millisecond)
+	current, _ := parseRanges([]string{"10.0.0.0/8"})
+	s.refresher.ranges.Store(current)
+	ranges, err := s.fetch(context.Background())
+	if actual := fmt.Sprint(ranges); err != nil || actual != "[10.0.0.0/8]" {
+		t.Errorf("Expected the current ranges after the watch expired, but found '%s' (%v)", actual, err)
+	}
+}
+
+func TestSPFSource(t *testing.T) {
+	records := map[string][]string{
+		"_spf.example.com.":        {"v=spf1 include:_netblocks.example.com include:_netblocks2.example.com ~all"},
+		"_netblocks.example.com.":  {"v=spf1 ip4:192.0.2.0/24 ", "ip4:198.51.100.7 -ip4:203.0.113.0/24 ?all"},
+		"_netblocks2.example.com.": {"v=spf1 +ip6:2001:db8::/32 a mx include:_spf.example.com -all"},
+		"redirect.example.com.":    {"v=spf1 redirect=_netblocks.example.com"},
+		"nospf.example.com.":       {"google-site-verification=abc"},
+		"broken.example.com.":      {"v=spf1 ip4:300.0.0.0/8"},
+		"deep0.example.com.":       {"v=spf1 include:deep1.example.com"},
+		"deep1.example.com.":       {"v=spf1 include:deep2.example.com"},
+		"deep2.example.com.":       {"v=spf1 ip4:10.0.0.0/8"},
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		if txt, ok := records[q.Name]; ok && q.Qtype == dns.TypeTXT {
+			resp.Answer = append(resp.Answer,
+				&dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}, Txt: txt})
+		} else if !ok {
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	for i, test := range []struct {
+		domains  []string
+		maxDepth int
+		expected string
+	}{
+		{[]string{"_spf.example.com"}, 10, "[192.0.2.0/24 198.51.100.7/32 2001:db8::/32]"},
+		{[]string{"redirect.example.com"}, 10, "[192.0.2.0/24 198.51.100.7/32]"},
+		{[]string{"_netblocks.example.com", "deep0.example.com"}, 10, "[192.0.2.0/24 198.51.100.7/32 10.0.0.0/8]"},
+		{[]string{"deep0.example.com"}, 1, "error"},
+		{[]string{"nospf.example.com"}, 10, "error"},
+		{[]string{"missing.example.com"}, 10, "error"},
+		{[]string{"broken.example.com"}, 10, "error"},
+	} {
+		s := &spfSource{Domains: test.domains, Resolvers: []string{pc.LocalAddr().String()}, MaxDepth: test.maxDepth, client: new(dns.Client)}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestASNSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "realip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, path, map[string][]byte{
+		"104.16.0.0/13":  mmdbMap("autonomous_system_number", mmdbUint32(13335), "autonomous_system_organization", mmdbString("CLOUDFLARENET")),
+		"172.64.0.0/13":  mmdbMap("autonomous_system_number", mmdbUint32(13335)),
+		"52.84.0.0/15":   mmdbMap("autonomous_system_number", mmdbUint32(16509)),
+		"8.8.8.0/24":     mmdbMap("autonomous_system_number", mmdbUint32(15169)),
+		"2606:4700::/32": mmdbMap("asn", mmdbString("AS13335"), "name", mmdbString("Cloudflare, Inc.")),
+	})
+
+	for i, test := range []struct {
+		asns     []uint
+		expected string
+	}{
+		{[]uint{13335}, "[104.16.0.0/13 172.64.0.0/13 2606:4700::/32]"},
+		{[]uint{16509, 15169}, "[8.8.8.0/24 52.84.0.0/15]"},
+		{[]uint{64512}, "[]"},
+	} {
+		s := &asnSource{ASNs: test.asns, Database: path}
+		ranges, err := s.read(context.Background())
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if actual := fmt.Sprint(ranges); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+	if _, err := (&asnSource{ASNs: []uint{13335}, Database: filepath.Join(dir, "missing.mmdb")}).read(context.Background()); err == nil {
+		t.Errorf("Expected an error for a missing database")
+	}
+
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"from_asn 13335 AS16509 {\n database /var/lib/GeoLite2-ASN.mmdb\n }", `{"ASNs":[13335,16509],"Database":"/var/lib/GeoLite2-ASN.mmdb","source":"asn"}`},
+		{"source asn 13335 {\n database asn.mmdb\n }", `{"ASNs":[13335],"Database":"asn.mmdb","source":"asn"}`},
+		{"from_asn cloudflare", ""},
+		{"from_asn", ""},
+	} {
+		m := &module{}
+		err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n "+test.input+"\n}"))
+		actual := ""
+		if err == nil && len(m.Sources) == 1 {
+			actual = string(m.Sources[0])
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+// writeTestMMDB writes an IPv6 MaxMind DB with 24 bit records, mapping
+// networks to encoded records. IPv4 networks are stored under ::/96.
+func writeTestMMDB(t *testing.T, path string, networks map[string][]byte) {
+	type node struct {
+		children [2]*node
+		data     [2]int // offset in the data section + 1, or 0
+	}
+	root := new(node)
+	var data []byte
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To16()
+		if ip4 := network.IP.To4(); ip4 != nil {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+		n := root
+		for bit := 0; bit < ones; bit++ {
+			b := ip[bit/8] >> (7 - uint(bit%8)) & 1
+			if bit == ones-1 {
+				n.data[b] = len(data) + 1
+				break
+			}
+			if n.children[b] == nil {
+				n.children[b] = new(node)
+			}
+			n = n.children[b]
+		}
+		data = append(data, record...)
+	}
+
+	var nodes []*node
+	index := make(map[*node]int)
+	var number func(n *node)
+	number = func(n *node) {
+		index[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, child := range n.children {
+			if child != nil {
+				number(child)
+			}
+		}
+	}
+	number(root)
+
+	var buf []byte
+	for _, n := range nodes {
+		for b := 0; b < 2; b++ {
+			value := len(nodes)
+			if n.children[b] != nil {
+				value = index[n.children[b]]
+			} else if n.data[b] != 0 {
+				value = len(nodes) + 16 + n.data[b] - 1
+			}
+			buf = append(buf, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, mmdbMap(
+		"binary_format_major_version", mmdbUint16(2),
+		"binary_format_minor_version", mmdbUint16(0),
+		"build_epoch", mmdbUint32(0),
+		"database_type", mmdbString("Test-ASN"),
+		"description", mmdbMap(),
+		"ip_version", mmdbUint16(6),
+		"languages", []byte{0x00, 0x04},
+		"node_count", mmdbUint32(uint32(len(nodes))),
+		"record_size", mmdbUint16(24),
+	)...)
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mmdbString(s string) []byte {
+	if len(s) >= 29 {
+		return append([]byte{0x40 | 29, byte(len(s) - 29)}, s...)
+	}
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func mmdbUint16(n uint16) []byte {
+	return []byte{0xa2, byte(n >> 8), byte(n)}
+}
+
+func mmdbUint32(n uint32) []byte {
+	return []byte{0xc4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+// mmdbMap encodes a map from alternating keys and encoded values.
+func mmdbMap(pairs ...interface{}) []byte {
+	buf := []byte{0xe0 | byte(len(pairs)/2)}
+	for i := 0; i < len(pairs); i += 2 {
+		buf = append(buf, mmdbString(pairs[i].(string))...)
+		buf = append(buf, pairs[i+1].([]byte)...)
+	}
+	return buf
+}
+
+func TestRIPEstatSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("resource") {
+		case "AS13335":
+			fmt.Fprint(w, `{"status": "ok", "data": {"prefixes": [{"prefix": "1.1.1.0/24", "timelines": []}, {"prefix": "2606:4700::/32"}], "resource": "13335"}}`)
+		case "AS64496":
+			fmt.Fprint(w, `{"status": "ok", "data": {"prefixes": [{"prefix": "192.0.2.0/24"}]}}`)
+		case "AS64511":
+			fmt.Fprint(w, `{"status": "ok", "data": {"prefixes": []}}`)
+		default:
+			fmt.Fprint(w, `{"status": "error", "messages": [["error", "invalid resource"]]}`)
+		}
+	}))
+	defer srv.Close()
+
+	for i, test := range []struct {
+		asns     []uint
+		expected string
+	}{
+		{[]uint{13335}, "[1.1.1.0/24 2606:4700::/32]"},
+		{[]uint{13335, 64496}, "[1.1.1.0/24 2606:4700::/32 192.0.2.0/24]"},
+		{[]uint{13335, 64511}, "error"},
+		{[]uint{4294967295}, "error"},
+	} {
+		s := &ripestatSource{ASNs: test.asns, URL: srv.URL, fetchers: make(map[uint]*httpFetcher), ranges: make(map[uint][]*net.IPNet)}
+		for _, asn := range test.asns {
+			s.fetchers[asn] = &httpFetcher{client: srv.Client()}
+		}
+		ranges, err := s.fetch(context.Background())
+		actual := fmt.Sprint(ranges)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// maxJSONPages limits how many pages of a paginated list are fetched.
+const maxJSONPages = 100
+
+// jsonSource trusts the ranges listed in a JSON document fetched from an
+// HTTP API, typically an IPAM system such as NetBox that holds the
+// inventory of proxies. Path selects the ranges in the document, and Next,
+// if set, the URL of the next page of a paginated list.
+type jsonSource struct {
+	// URL is the location of the document, e.g.
+	// "https://netbox.example.com/api/ipam/prefixes/?tag=proxy".
+	URL string
+
+	// Path is the location of the ranges in the document, as keys
+	// separated by dots. "*" stands for every element of an array or
+	// every value of an object, e.g. "results.*.prefix" for NetBox.
+	Path string
+
+	// Next is the path of the URL of the next page, e.g. "next" for
+	// NetBox. Pages are fetched until it is missing, null or empty.
+	Next string
+
+	// Token is sent in the Authorization header, preceded by TokenScheme,
+	// which is "Bearer" by default. NetBox uses "Token".
+	Token       string
+	TokenScheme string
+
+	// Refresh is the interval between fetches. The default is 1h.
+	Refresh caddy.Duration
+
+	// Timeout bounds each request. The default is 30s.
+	Timeout caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *http.Client
+}
+
+func init() {
+	caddy.RegisterModule(jsonSource{})
+}
+
+func (jsonSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.json",
+		New: func() caddy.Module {
+			return new(jsonSource)
+		},
+	}
+}
+
+func (s *jsonSource) Provision(ctx caddy.Context) error {
+	if s.URL == "" {
+		return fmt.Errorf("missing URL")
+	}
+	if s.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	if s.TokenScheme == "" {
+		s.TokenScheme = "Bearer"
+	}
+	timeout := time.Duration(s.Timeout)
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	s.client = &http.Client{Timeout: timeout}
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch fetches all pages of the list and returns the ranges they contain.
+func (s *jsonSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	var values []string
+	url := s.URL
+	for page := 0; url != ""; page++ {
+		if page == maxJSONPages {
+			return nil, fmt.Errorf("more than %d pages", maxJSONPages)
+		}
+		doc, err := s.get(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		found, err := jsonPath(doc, strings.Split(s.Path, "."))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", url, err)
+		}
+		values = append(values, found...)
+
+		url = ""
+		if s.Next != "" {
+			// a missing or null next page ends the list
+			if next, err := jsonPath(doc, strings.Split(s.Next, ".")); err == nil && len(next) == 1 {
+				url = next[0]
+			}
+		}
+	}
+	ranges, err := parseCIDRs(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.URL, err)
+	}
+	return ranges, nil
+}
+
+// get fetches and decodes the JSON document at url.
+func (s *jsonSource) get(ctx context.Context, url string) (interface{}, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", s.TokenScheme+" "+s.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", url, resp.Status)
+	}
+	var doc interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRangeListBytes)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", url, err)
+	}
+	return doc, nil
+}
+
+// jsonPath returns the strings found at path in v, where "*" stands for
+// every element of an array or value of an object. Null values are
+// skipped; missing keys and other types are errors.
+func jsonPath(v interface{}, path []string) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if len(path) == 0 {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, found %T", v)
+		}
+		return []string{s}, nil
+	}
+	key, rest := path[0], path[1:]
+	var children []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		if key != "*" {
+			return nil, fmt.Errorf("expected an object at %s, found an array", key)
+		}
+		children = v
+	case map[string]interface{}:
+		if key == "*" {
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				children = append(children, v[k])
+			}
+			break
+		}
+		child, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("missing key %s", key)
+		}
+		children = []interface{}{child}
+	default:
+		return nil, fmt.Errorf("expected an object or array at %s, found %T", key, v)
+	}
+	var out []string
+	for _, child := range children {
+		found, err := jsonPath(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, found...)
+	}
+	return out, nil
+}
+
+func (s *jsonSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *jsonSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	json <url> {
+//	    path <path>
+//	    next <path>
+//	    token <token>
+//	    token_scheme <scheme>
+//	    refresh <interval>
+//	    timeout <duration>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *jsonSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&s.URL) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "path":
+			err = parseStringArg(d, &s.Path)
+		case "next":
+			err = parseStringArg(d, &s.Next)
+		case "token":
+			err = parseStringArg(d, &s.Token)
+		case "token_scheme":
+			err = parseStringArg(d, &s.TokenScheme)
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "timeout":
+			err = parseDurationArg(d, &s.Timeout)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown json source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	if s.Path == "" {
+		return d.Err("json source requires a path")
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*jsonSource)(nil)
+	_ caddy.Provisioner     = (*jsonSource)(nil)
+	_ caddy.CleanerUpper    = (*jsonSource)(nil)
+	_ caddyfile.Unmarshaler = (*jsonSource)(nil)
+)
@@ -0,0 +1,240 @@
+package realip
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesSource trusts the pods matching a label selector, such as the
+// ingress controller, and optionally the pod CIDRs of all nodes, using the
+// Kubernetes API with the pod's service account. The API is polled, so
+// changes take effect within Refresh. The service account needs permission
+// to list pods in Namespace and, for NodeCIDRs, nodes.
+type kubernetesSource struct {
+	// Namespace is the namespace of the pods. The default is the namespace
+	// Caddy runs in.
+	Namespace string
+
+	// Selector is a label selector for the pods to trust, e.g.
+	// "app.kubernetes.io/name=ingress-nginx".
+	Selector string
+
+	// NodeCIDRs also trusts the pod CIDRs assigned to the nodes.
+	NodeCIDRs bool
+
+	// Refresh is the interval between polls. The default is 30s.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *http.Client
+	server    string
+	tokenFile string
+}
+
+func init() {
+	caddy.RegisterModule(kubernetesSource{})
+}
+
+func (kubernetesSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.kubernetes",
+		New: func() caddy.Module {
+			return new(kubernetesSource)
+		},
+	}
+}
+
+func (s *kubernetesSource) Provision(ctx caddy.Context) error {
+	if s.Selector == "" && !s.NodeCIDRs {
+		return fmt.Errorf("either a selector or node CIDRs are required")
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	s.server = "https://" + net.JoinHostPort(host, port)
+	s.tokenFile = serviceAccountDir + "/token"
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	s.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	if s.Namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return err
+		}
+		s.Namespace = strings.TrimSpace(string(ns))
+	}
+
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 30 * time.Second
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+func (s *kubernetesSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	if s.Selector != "" {
+		var pods struct {
+			Items []struct {
+				Status struct {
+					PodIP  string `json:"podIP"`
+					PodIPs []struct {
+						IP string `json:"ip"`
+					} `json:"podIPs"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		path := "/api/v1/namespaces/" + url.PathEscape(s.Namespace) + "/pods?labelSelector=" + url.QueryEscape(s.Selector)
+		if err := s.get(ctx, path, &pods); err != nil {
+			return nil, err
+		}
+		for _, pod := range pods.Items {
+			ips := []string{pod.Status.PodIP}
+			for _, ip := range pod.Status.PodIPs {
+				ips = append(ips, ip.IP)
+			}
+			for _, ip := range ips {
+				if parsed := net.ParseIP(ip); parsed != nil {
+					ranges = append(ranges, hostRange(parsed))
+				}
+			}
+		}
+	}
+	if s.NodeCIDRs {
+		var nodes struct {
+			Items []struct {
+				Spec struct {
+					PodCIDR  string   `json:"podCIDR"`
+					PodCIDRs []string `json:"podCIDRs"`
+				} `json:"spec"`
+			} `json:"items"`
+		}
+		if err := s.get(ctx, "/api/v1/nodes", &nodes); err != nil {
+			return nil, err
+		}
+		for _, node := range nodes.Items {
+			for _, cidr := range append([]string{node.Spec.PodCIDR}, node.Spec.PodCIDRs...) {
+				if _, parsed, err := net.ParseCIDR(cidr); err == nil {
+					ranges = append(ranges, parsed)
+				}
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// get requests path from the API server and decodes the response into v.
+// The token is read on every request, since Kubernetes rotates it.
+func (s *kubernetesSource) get(ctx context.Context, path string, v interface{}) error {
+	token, err := ioutil.ReadFile(s.tokenFile)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", s.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: unexpected status %s", path, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxRangeListBytes)).Decode(v)
+}
+
+func (s *kubernetesSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *kubernetesSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	kubernetes [<selector>] {
+//	    namespace <namespace>
+//	    node_cidrs
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *kubernetesSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	d.Args(&s.Selector)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "namespace":
+			err = parseStringArg(d, &s.Namespace)
+		case "node_cidrs":
+			s.NodeCIDRs = true
+			if d.NextArg() {
+				err = d.ArgErr()
+			}
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown kubernetes source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*kubernetesSource)(nil)
+	_ caddy.Provisioner     = (*kubernetesSource)(nil)
+	_ caddy.CleanerUpper    = (*kubernetesSource)(nil)
+	_ caddyfile.Unmarshaler = (*kubernetesSource)(nil)
+)
@@ -0,0 +1,439 @@
+package realip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// consulSource reads a list of ranges, one per line, from a key in Consul's
+// KV store and watches it with blocking queries, so that a trust list
+// managed centrally takes effect without reloading Caddy. The previous list
+// is kept if the key is deleted, becomes invalid or Consul is unreachable.
+type consulSource struct {
+	// Key is the KV key holding the list.
+	Key string
+
+	// Address is the URL of the Consul HTTP API. The default is
+	// http://127.0.0.1:8500.
+	Address string
+
+	// Token is the ACL token, if required.
+	Token string
+
+	// Wait is the maximum duration of a blocking query. The default is 5m.
+	Wait caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *http.Client
+	index     uint64
+}
+
+func init() {
+	caddy.RegisterModule(consulSource{})
+	caddy.RegisterModule(etcdSource{})
+}
+
+func (consulSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.consul",
+		New: func() caddy.Module {
+			return new(consulSource)
+		},
+	}
+}
+
+func (s *consulSource) Provision(ctx caddy.Context) error {
+	if s.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if s.Address == "" {
+		s.Address = "http://127.0.0.1:8500"
+	}
+	if s.Wait == 0 {
+		s.Wait = caddy.Duration(5 * time.Minute)
+	}
+	// Consul adds up to wait/16 of jitter to blocking queries.
+	wait := time.Duration(s.Wait)
+	s.client = &http.Client{Timeout: wait + wait/16 + 30*time.Second}
+	s.refresher.fetch = s.fetch
+	s.refresher.next = kvNext
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// kvNext watches again right after a change.
+func kvNext() time.Duration {
+	return 0
+}
+
+// fetch returns the list once it differs from the one last read, or when
+// the blocking query times out.
+func (s *consulSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	query := url.Values{"raw": {""}}
+	if s.index > 0 {
+		query.Set("index", strconv.FormatUint(s.index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(time.Duration(s.Wait).Seconds())))
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(s.Address, "/")+"/v1/kv/"+strings.TrimPrefix(s.Key, "/")+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if s.Token != "" {
+		req.Header.Set("X-Consul-Token", s.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.index = 0
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The index must be reset if it goes backwards, e.g. after a restore.
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < s.index {
+		index = 0
+	}
+	previous := s.index
+	s.index = index
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("key %s not found", s.Key)
+	default:
+		s.index = 0
+		return nil, fmt.Errorf("reading %s: unexpected status %s", s.Key, resp.Status)
+	}
+	if index != 0 && index == previous {
+		return s.refresher.current(), nil
+	}
+	ranges, err := parseRangeList(io.LimitReader(resp.Body, maxRangeListBytes))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", s.Key, err)
+	}
+	return ranges, nil
+}
+
+func (s *consulSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *consulSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	consul <key> {
+//	    address <url>
+//	    token <token>
+//	    wait <duration>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *consulSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&s.Key) || d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "address":
+			err = parseStringArg(d, &s.Address)
+		case "token":
+			err = parseStringArg(d, &s.Token)
+		case "wait":
+			err = parseDurationArg(d, &s.Wait)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown consul source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+// etcdSource reads a list of ranges, one per line, from a key in etcd and
+// watches it for changes through the v3 JSON gateway. The previous list is
+// kept if the key is deleted, becomes invalid or etcd is unreachable.
+type etcdSource struct {
+	// Key is the key holding the list.
+	Key string
+
+	// Endpoint is the URL of an etcd member. The default is
+	// http://127.0.0.1:2379.
+	Endpoint string
+
+	// Username and Password authenticate to etcd, if required.
+	Username string
+	Password string
+
+	// Wait is the maximum duration of a watch. When it ends without a
+	// change, the list is still current, which keeps it from going stale.
+	// The default is 5m.
+	Wait caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *http.Client
+	revision  int64
+}
+
+func (etcdSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.etcd",
+		New: func() caddy.Module {
+			return new(etcdSource)
+		},
+	}
+}
+
+func (s *etcdSource) Provision(ctx caddy.Context) error {
+	if s.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "http://127.0.0.1:2379"
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	if s.Wait == 0 {
+		s.Wait = caddy.Duration(5 * time.Minute)
+	}
+	s.client = &http.Client{Timeout: time.Duration(s.Wait) + 30*time.Second}
+	s.refresher.fetch = s.fetch
+	s.refresher.next = kvNext
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch reads the key. After the first read, it waits for the key to
+// change before reading it again, and returns the current list if it
+// doesn't change within Wait.
+func (s *etcdSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	token, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.revision > 0 {
+		changed, err := s.watch(ctx, token)
+		if err != nil {
+			s.revision = 0
+			return nil, err
+		}
+		if !changed {
+			return s.refresher.current(), nil
+		}
+	}
+
+	var resp struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	readCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := s.post(readCtx, "/v3/kv/range", token, map[string]interface{}{"key": []byte(s.Key)}, &resp); err != nil {
+		return nil, err
+	}
+	s.revision, _ = strconv.ParseInt(resp.Header.Revision, 10, 64)
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("key %s not found", s.Key)
+	}
+	ranges, err := parseRangeList(bytes.NewReader(resp.Kvs[0].Value))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", s.Key, err)
+	}
+	return ranges, nil
+}
+
+// watch blocks until the key changes after the last revision read, or
+// until Wait has passed, in which case it reports no change.
+func (s *etcdSource) watch(ctx context.Context, token string) (bool, error) {
+	watchCtx, cancel := context.WithTimeout(ctx, time.Duration(s.Wait))
+	defer cancel()
+	expired := func() bool {
+		return watchCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	}
+	body, err := s.request(watchCtx, "/v3/watch", token, map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(s.Key),
+			"start_revision": strconv.FormatInt(s.revision+1, 10),
+		},
+	})
+	if err != nil {
+		if expired() {
+			return false, nil
+		}
+		return false, err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Result struct {
+				Events       []json.RawMessage `json:"events"`
+				Canceled     bool              `json:"canceled"`
+				CancelReason string            `json:"cancel_reason"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if expired() {
+				return false, nil
+			}
+			return false, fmt.Errorf("watching %s: %v", s.Key, err)
+		}
+		if msg.Error != nil {
+			return false, fmt.Errorf("watching %s: %s", s.Key, msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return false, fmt.Errorf("watching %s: canceled: %s", s.Key, msg.Result.CancelReason)
+		}
+		if len(msg.Result.Events) > 0 {
+			return true, nil
+		}
+	}
+}
+
+// authenticate returns a token for Username, or an empty string if no
+// authentication is configured.
+func (s *etcdSource) authenticate(ctx context.Context) (string, error) {
+	if s.Username == "" {
+		return "", nil
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	err := s.post(ctx, "/v3/auth/authenticate", "", map[string]string{"name": s.Username, "password": s.Password}, &resp)
+	return resp.Token, err
+}
+
+// post sends req to path and decodes the response into resp.
+func (s *etcdSource) post(ctx context.Context, path, token string, req, resp interface{}) error {
+	body, err := s.request(ctx, path, token, req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(io.LimitReader(body, maxRangeListBytes)).Decode(resp)
+}
+
+// request sends req to path and returns the response body.
+func (s *etcdSource) request(ctx context.Context, path, token string, req interface{}) (io.ReadCloser, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", s.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set("Authorization", token)
+	}
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected status %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *etcdSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *etcdSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	etcd <key> {
+//	    endpoint <url>
+//	    username <name>
+//	    password <password>
+//	    wait <duration>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *etcdSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&s.Key) || d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "endpoint":
+			err = parseStringArg(d, &s.Endpoint)
+		case "username":
+			err = parseStringArg(d, &s.Username)
+		case "password":
+			err = parseStringArg(d, &s.Password)
+		case "wait":
+			err = parseDurationArg(d, &s.Wait)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown etcd source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*consulSource)(nil)
+	_ IPSource              = (*etcdSource)(nil)
+	_ caddy.Provisioner     = (*consulSource)(nil)
+	_ caddy.Provisioner     = (*etcdSource)(nil)
+	_ caddy.CleanerUpper    = (*consulSource)(nil)
+	_ caddy.CleanerUpper    = (*etcdSource)(nil)
+	_ caddyfile.Unmarshaler = (*consulSource)(nil)
+	_ caddyfile.Unmarshaler = (*etcdSource)(nil)
+)
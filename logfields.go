@@ -0,0 +1,40 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// logFields logs how the client address of req was derived at Info level:
+// the address of the connection as original_remote_addr, the header the
+// address was taken from and its raw value, if any, and the resulting
+// client_ip. Caddy v2.0.0 doesn't let handlers add fields to the access
+// log entry of a request, so this is a separate entry, which carries the
+// method, host and uri of the request to match it to that entry. It must
+// be called before the headers are stripped or rewritten.
+func (m *module) logFields(req *http.Request, peer string, res *resolution) {
+	if !m.LogFields || m.logger == nil {
+		return
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	fields := []zap.Field{
+		zap.String("original_remote_addr", peer),
+		zap.String("client_ip", client),
+		zap.String("method", req.Method),
+		zap.String("host", req.Host),
+		zap.String("uri", req.RequestURI),
+	}
+	if res != nil && res.Header != "" {
+		fields = append(fields,
+			zap.String("header", res.Header),
+			zap.String("header_value", strings.Join(req.Header.Values(res.Header), ", ")),
+		)
+	}
+	m.logger.Info("resolved client address", fields...)
+}
@@ -0,0 +1,78 @@
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// matchFrom matches requests whose client address, as resolved by the
+// realip handler, is in one of Ranges. Unlike Caddy's remote_ip matcher,
+// it accepts presets such as "cloudflare".
+type matchFrom struct {
+	// Ranges are CIDR ranges, single addresses or presets.
+	Ranges []string
+
+	ranges []*net.IPNet
+}
+
+func init() {
+	caddy.RegisterModule(matchFrom{})
+}
+
+func (matchFrom) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.matchers.realip_from",
+		New: func() caddy.Module {
+			return new(matchFrom)
+		},
+	}
+}
+
+func (m *matchFrom) Provision(ctx caddy.Context) error {
+	ranges, err := parseRanges(m.Ranges)
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return fmt.Errorf("no ranges")
+	}
+	m.ranges = ranges
+	return nil
+}
+
+// Match reports whether the client address of req is in the ranges.
+func (m matchFrom) Match(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return validSource(m.ranges, host)
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens:
+//
+//	realip_from <ranges...>
+func (m *matchFrom) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		if _, err := parseRanges(args); err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+		m.Ranges = append(m.Ranges, args...)
+	}
+	return nil
+}
+
+var (
+	_ caddy.Provisioner        = (*matchFrom)(nil)
+	_ caddyhttp.RequestMatcher = (*matchFrom)(nil)
+	_ caddyfile.Unmarshaler    = (*matchFrom)(nil)
+)
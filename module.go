@@ -1,30 +1,466 @@
 package realip
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
-	"strings"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 type module struct {
 	From   []*net.IPNet
 	Header string
 
+	// FromPlaceholders are ranges or presets given as global placeholders,
+	// such as {env.TRUSTED_PROXIES}. They are expanded when the handler is
+	// provisioned, split on whitespace and commas, and added to From.
+	FromPlaceholders []string
+
+	// FromHosts are host names whose addresses are added to From when the
+	// handler is provisioned, e.g. the service name of a proxy in Docker
+	// Compose.
+	FromHosts []string
+
+	// Headers is an ordered list of headers to try after Header. The first
+	// header that yields a usable address wins.
+	Headers []string
+
+	// Bindings ties headers to their own trusted ranges. A bound header is
+	// only honored when the peer and every proxy in its chain are in the
+	// binding's From, independent of the module-wide From. Bindings are
+	// tried before Header and Headers.
+	Bindings []headerBinding
+
 	// MaxHops configures the maxiumum number of hops or IPs to be found in a forward header.
 	// It's purpose is to prevent abuse and/or DOS attacks from long forward-chains, since each one
 	// must be parsed and checked against a list of subnets.
-	// The default is 5, -1 to disable. If set to 0, any request with a forward header will be rejected
+	// The hop count is checked before the header is parsed, so oversized chains are cheap to reject.
+	// The default is 5 in the Caddyfile, -1 to disable. If set to 0, any request with a forward header will be rejected
 	MaxHops int
 	Strict  bool
+
+	// RequireTrustedChain rejects requests with a 403 status unless every
+	// hop between the selected client and the peer is in From. This is
+	// stricter than Strict, which only applies to the default strategy's
+	// walk, and is meant for zero-trust internal deployments.
+	RequireTrustedChain bool
+
+	// Fallback decides what happens when forward headers are present but
+	// none yields a usable address, e.g. because every entry is malformed
+	// or was filtered out: "keep" leaves the connection's address in place,
+	// "reject" responds with FallbackStatus (default 403), and "sentinel"
+	// substitutes FallbackAddress. By default, Strict rejects with a 403
+	// and the connection's address is kept otherwise.
+	Fallback        string
+	FallbackStatus  int
+	FallbackAddress string
+
+	// Strategy selects how the client address is picked from the chain:
+	//
+	//   - "default" (or empty): walk from the right while hops are trusted;
+	//     an untrusted hop ends the walk as an error, which Strict turns
+	//     into a 403
+	//   - "first": the leftmost address, which is spoofable
+	//   - "last": the rightmost address, as seen by the nearest proxy
+	//   - "rightmost_untrusted": the first untrusted address from the
+	//     right, as with nginx's real_ip_recursive
+	//   - "trusted_hops": the TrustedHops-th address from the right
+	//   - "leftmost_public": the first public address from the left, which
+	//     is spoofable and only meant for legacy setups
+	Strategy string
+
+	// TrustedHops is the number of proxy tiers for the "trusted_hops"
+	// strategy, like Envoy's xff_num_trusted_hops. The trusted ranges are
+	// not consulted for the chain, but the peer must still be in From.
+	// Setting it without a strategy implies "trusted_hops".
+	TrustedHops int
+
+	// MaxHeaderBytes caps the combined size of all lines of a forward header.
+	// Larger headers are not parsed at all and are treated as unusable.
+	// Zero means no limit beyond the server's own header limits.
+	MaxHeaderBytes int
+
+	// Port is the policy for the port of the rewritten address: "keep"
+	// (the default) reuses the port of the connection, "forwarded" uses the
+	// port carried by the selected entry of the forward header if there is
+	// one, and "zero" does the same but uses port 0 if the client port is
+	// unknown. ForwardedPort is the same as "forwarded".
+	Port          string
+	ForwardedPort bool
+
+	// SkipObfuscated drops "unknown" and obfuscated ("_hidden") node
+	// identifiers, as allowed by RFC 7239, from the chain and keeps walking.
+	// By default such an identifier is an untrusted boundary: the proxy that
+	// reported it is used as the client address.
+	SkipObfuscated bool
+
+	// SkipPrivate drops private, loopback, link-local and reserved addresses
+	// from the chain, so that addresses inserted by internal proxies are
+	// never chosen as the client and the walk continues past them.
+	SkipPrivate bool
+
+	// DedupeChain collapses consecutive duplicate addresses in the chain,
+	// as added by some CDN and load balancer combinations, before hops are
+	// counted and the client is selected. The cheap hop count check before
+	// parsing is skipped in that case; MaxHeaderBytes still applies.
+	DedupeChain bool
+
+	// Via cross-checks the number of proxies declared in the Via header
+	// against the length of the forward chain. It is "log" to only log
+	// requests where both differ by more than ViaTolerance, or "reject" to
+	// also refuse them. The check is disabled by default.
+	Via          string
+	ViaTolerance int
+
+	// StripHeaders removes forward headers from the request once it has
+	// been resolved, so that handlers further down can't be confused by the
+	// raw, partially untrusted values. This covers the configured headers
+	// and well-known ones like X-Forwarded-For, Forwarded and X-Real-IP,
+	// except for those listed in KeepHeaders.
+	StripHeaders bool
+	KeepHeaders  []string
+
+	// RewriteXFF replaces X-Forwarded-For once the request has been
+	// resolved, so that backends reading it directly see a spoof-free
+	// value. It is "client" for just the client address, or "chain" for
+	// the client address followed by the trusted proxies it came through.
+	RewriteXFF string
+
+	// SetHeader sets a header to the client address once the request has
+	// been resolved, for backends that read the client from a header of
+	// their own, such as X-Client-IP. The port is only included if
+	// SetHeaderPort is set.
+	SetHeader     string
+	SetHeaderPort bool
+
+	// OriginalHeader sets a header to the address of the connection the
+	// request was received on, with its port, so that tiers further down
+	// can tell which proxy connected after RemoteAddr was rewritten.
+	OriginalHeader string
+
+	// LogFields logs the address of the connection, the raw forward header
+	// and the resolved client address of every request the handler sees,
+	// along with the fields that match the entry to the access log.
+	LogFields bool
+
+	// AppendXFF and AppendForwarded add the address of the immediate peer
+	// to X-Forwarded-For and Forwarded respectively, the way a reverse
+	// proxy would, so that proxy tiers further down see the full chain.
+	AppendXFF       bool
+	AppendForwarded bool
+
+	// TrustProto, TrustHost and TrustPort apply X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-Port when they are sent by a trusted
+	// peer, so that redirects and absolute URLs are correct behind a TLS
+	// terminating proxy. The request host and the scheme, host and port
+	// placeholders are updated accordingly.
+	TrustProto bool
+	TrustHost  bool
+	TrustPort  bool
+
+	// SingleValue lists headers, such as X-Real-IP, that carry exactly one
+	// address and never a chain. Only the peer is checked against From, and
+	// a value containing more than one entry is treated as unusable instead
+	// of being walked.
+	SingleValue []string
+
+	// Extract configures regular expressions that extract the addresses from
+	// headers with a structured value. They replace the usual parsing of
+	// those headers.
+	Extract []headerExtract
+
+	// PseudoIPv4 handles Cloudflare's Pseudo IPv4 feature: a client address
+	// from the reserved 240.0.0.0/4 range is replaced by the real IPv6
+	// address from CF-Connecting-IPv6, or the header is treated as unusable
+	// if there is none. The pseudo address is kept in the
+	// {http.realip.pseudo_ipv4} placeholder.
+	PseudoIPv4 bool
+
+	// Parsers are guest modules extracting a forward chain from headers the
+	// handler doesn't support natively. They are tried in order after the
+	// configured headers, and their chains are validated against From.
+	Parsers []json.RawMessage `caddy:"namespace=http.handlers.realip.parsers inline_key=parser"`
+
+	parsers []Parser
+
+	// Sources are guest modules providing trusted ranges in addition to
+	// From, such as lists that are fetched and refreshed at runtime. Their
+	// ranges are used wherever From is.
+	Sources []json.RawMessage `caddy:"namespace=realip.ip_sources inline_key=source"`
+
+	sources     []IPSource
+	sourceNames []string
+	trust       *trustCache
+
+	// crawlers are the crawler sources among sources, and allCrawlers
+	// those of the bindings as well.
+	crawlers    []*crawlerSource
+	allCrawlers []*crawlerSource
+
+	// Except are ranges that are never trusted, even if they are part of
+	// From, a binding, a preset or a source.
+	Except []*net.IPNet
+
+	logger *zap.Logger
+}
+
+// headerSize returns the combined length of all lines of a header.
+func headerSize(values []string) int {
+	size := 0
+	for _, value := range values {
+		size += len(value)
+	}
+	return size
+}
+
+// isObfuscated reports whether host is one of the node identifiers RFC 7239
+// allows in place of an address: "unknown" or an obfuscated "_" token.
+func isObfuscated(host string) bool {
+	return strings.EqualFold(host, "unknown") || strings.HasPrefix(host, "_")
+}
+
+// isPort reports whether port is a valid numeric port.
+func isPort(port string) bool {
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n > 0
+}
+
+// hop is a single entry of a forward header.
+type hop struct {
+	Host string
+	Port string
+
+	// Forwarded holds the element the entry was taken from, if the header
+	// is Forwarded.
+	Forwarded *forwardedElement
+
+	// index is the position of the entry in the header as received,
+	// before any entries were skipped.
+	index int
+}
+
+// Port policies
+const (
+	portKeep      = "keep"
+	portForwarded = "forwarded"
+	portZero      = "zero"
+)
+
+// clientPort returns the port of the rewritten address given the port of
+// the connection and the port carried by the forward header, if any.
+func (m *module) clientPort(connPort, fwdPort string) string {
+	policy := m.Port
+	if policy == "" && m.ForwardedPort {
+		policy = portForwarded
+	}
+	switch {
+	case (policy == portForwarded || policy == portZero) && isPort(fwdPort):
+		return fwdPort
+	case policy == portZero:
+		return "0"
+	}
+	return connPort
+}
+
+// Fallback modes
+const (
+	fallbackKeep     = "keep"
+	fallbackReject   = "reject"
+	fallbackSentinel = "sentinel"
+)
+
+// defaultMaxHops is the MaxHops used by the Caddyfile unless configured.
+const defaultMaxHops = 5
+
+type headerBinding struct {
+	Header string
+	From   []*net.IPNet
+
+	// Sources are guest modules providing ranges trusted to send Header in
+	// addition to From, e.g. a CDN's live list of addresses.
+	Sources []json.RawMessage `json:",omitempty" caddy:"namespace=realip.ip_sources inline_key=source"`
+
+	sources  []IPSource
+	crawlers []*crawlerSource
+
+	// MaxHops overrides the module's MaxHops for Header, e.g. 1 for a CDN
+	// header that only ever carries the client. Zero means the module's.
+	MaxHops int `json:",omitempty"`
+
+	// parser, if set, extracts the chain instead of Header.
+	parser Parser
+
+	// SecretHeader and Secret, if set, require the request to carry
+	// SecretHeader with the value Secret before Header is trusted. This is
+	// how CDNs such as Akamai or Cloudflare Enterprise authenticate
+	// True-Client-IP to an origin that is reachable from anywhere.
+	SecretHeader string
+	Secret       string
+}
+
+// trusted returns From along with the current ranges of the binding's
+// sources.
+func (b headerBinding) trusted() []*net.IPNet {
+	if len(b.sources) == 0 {
+		return b.From
+	}
+	from := append([]*net.IPNet{}, b.From...)
+	for _, source := range b.sources {
+		from = append(from, source.IPRanges()...)
+	}
+	return from
+}
+
+// maxHops returns the maximum number of hops in the chain of b.
+func (m *module) maxHops(b headerBinding) int {
+	if b.MaxHops != 0 {
+		return b.MaxHops
+	}
+	return m.MaxHops
 }
 
+// authenticated reports whether req carries the secret of the binding, if
+// one is configured.
+func (b headerBinding) authenticated(req *http.Request) bool {
+	if b.SecretHeader == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(b.SecretHeader)), []byte(b.Secret)) == 1
+}
+
+//go:generate go run presetsgen.go
+
+// presets are named lists of ranges accepted wherever ranges are. Some are
+// generated from lists published by the providers, see presetsgen.go.
 var presets = map[string][]string{
+	// RFC 1918 private networks and RFC 4193 unique local IPv6 addresses,
+	// for proxies on the same network
+	"private": {
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	},
+	// loopback addresses, for proxies on the same host such as a local
+	// nginx, Varnish or cloudflared
+	"loopback": {
+		"127.0.0.0/8",
+		"::1/128",
+	},
+	// where the ngrok agent forwards tunneled requests from when it runs on
+	// the same host; ngrok's edge reaches the agent over its own outbound
+	// connection, so it has no address ranges of its own
+	"ngrok": {
+		"127.0.0.0/8",
+		"::1/128",
+	},
+	// RFC 6598 shared address space, used by carrier-grade NAT and overlay
+	// networks such as Tailscale
+	"cgnat": {
+		"100.64.0.0/10",
+	},
+	// link-local addresses, which metadata proxies and some cloud-internal
+	// forwarders connect from
+	"link_local": {
+		"169.254.0.0/16",
+		"fe80::/10",
+	},
+	// the Cloudflare China Network, which JD Cloud operates and which is
+	// not part of the cloudflare preset
+	"cloudflare_china": cloudflareChinaPreset,
+	// AWS CloudFront's edge locations and regional edge caches
+	"cloudfront": cloudfrontPreset,
+	// the CIDRs Akamai publishes for origin IP access control lists, from
+	// https://techdocs.akamai.com/origin-ip-acl/docs/update-your-origin-server
+	// SiteShield maps are narrower and specific to a property.
+	"akamai": {
+		"2.16.0.0/13",
+		"23.0.0.0/12",
+		"23.32.0.0/11",
+		"23.64.0.0/14",
+		"23.72.0.0/13",
+		"23.192.0.0/11",
+		"69.192.0.0/16",
+		"72.246.0.0/15",
+		"88.221.0.0/16",
+		"92.122.0.0/15",
+		"95.100.0.0/15",
+		"96.6.0.0/15",
+		"96.16.0.0/15",
+		"104.64.0.0/10",
+		"118.214.0.0/16",
+		"173.222.0.0/15",
+		"184.24.0.0/13",
+		"184.50.0.0/15",
+		"184.84.0.0/14",
+		"2405:9600::/32",
+		"2600:1400::/24",
+		"2a02:26f0::/29",
+	},
+	// the Sucuri firewall's egress ranges, from
+	// https://docs.sucuri.net/website-firewall/troubleshooting/same-ip-for-all-users/
+	"sucuri": {
+		"66.248.200.0/22",
+		"185.93.228.0/22",
+		"192.88.134.0/23",
+		"208.109.0.0/22",
+		"2a02:fe80::/29",
+	},
+	// CacheFly's edge prefixes
+	"cachefly": cacheflyPreset,
+	// Gcore's CDN nodes
+	"gcore": gcorePreset,
+	// QUIC.cloud's nodes, for LiteSpeed sites
+	"quic_cloud": quicCloudPreset,
+	// ArvanCloud's CDN
+	"arvancloud": arvancloudPreset,
+	// Tencent EdgeOne's back-to-origin ranges
+	"tencent_edgeone": tencentEdgeonePreset,
+	// the address space Scaleway's load balancers connect to public
+	// backends from, shared with other Scaleway instances, see
+	// https://www.scaleway.com/en/docs/network/load-balancer/reference-content/configuring-backends/
+	"scaleway": {
+		"51.15.0.0/16",
+		"51.158.0.0/15",
+		"62.210.0.0/16",
+		"163.172.0.0/16",
+		"195.154.0.0/16",
+		"212.47.224.0/19",
+		"212.83.128.0/19",
+		"2001:bc8::/32",
+	},
+	// Fly.io's private 6PN network, which fly-proxy reaches apps through,
+	// and its Anycast edge, see https://fly.io/docs/networking/
+	"fly": {
+		"66.241.124.0/22",
+		"2a09:8280::/32",
+		"fdaa::/16",
+	},
+	// uptime monitors' probes
+	"uptimerobot": uptimerobotPreset,
+	"pingdom":     pingdomPreset,
+	"statuscake":  statuscakePreset,
+	// Fastly's edge and shield POPs
+	"fastly": fastlyPreset,
+	// the egress ranges of Zscaler Internet Access on the zscaler.net cloud
+	"zscaler": zscalerPreset,
+	// the AzureFrontDoor.Backend service tag, from which Azure Front Door
+	// connects to origins
+	"azure_frontdoor": azureFrontdoorPreset,
 	// from https://www.cloudflare.com/ips/
 	"cloudflare": {
 		"173.245.48.0/20",
@@ -49,6 +485,96 @@ var presets = map[string][]string{
 		"2a06:98c0::/29",
 		"2c0f:f248::/32",
 	},
+	// Google Cloud load balancer and health check proxies, from
+	// https://cloud.google.com/load-balancing/docs/health-check-concepts
+	"gcp": {
+		"130.211.0.0/22",
+		"35.191.0.0/16",
+	},
+	// the gcp ranges plus those Google's global external Application Load
+	// Balancer and Cloud CDN connect to origins outside Google Cloud from,
+	// and the IPv6 ranges of its proxies and health checks, see
+	// https://cloud.google.com/load-balancing/docs/negs/internet-neg-concepts
+	"gcp_lb": {
+		"130.211.0.0/22",
+		"35.191.0.0/16",
+		"34.96.0.0/20",
+		"34.127.192.0/18",
+		"2600:2d00:1:1::/64",
+		"2600:2d00:1:b029::/64",
+	},
+	// Azure's platform address, from which Application Gateway's and Load
+	// Balancer's health probes come, see
+	// https://learn.microsoft.com/azure/virtual-network/what-is-ip-address-168-63-129-16
+	// Application Gateway proxies requests from addresses in its own
+	// subnet, which is configured alongside the preset. The GatewayManager
+	// ranges only reach the gateway itself and are not included.
+	"azure_appgw": {
+		azureHealthProbe,
+	},
+}
+
+// Headers providers without a source of their own set to the address of
+// the client.
+const (
+	// trueClientIP is set by Akamai, and by Cloudflare Enterprise, to the
+	// address of the client that connected to the edge.
+	trueClientIP = "True-Client-IP"
+
+	// sucuriClientIP is set by the Sucuri firewall to the address of the
+	// client that connected to it.
+	sucuriClientIP = "X-Sucuri-ClientIP"
+
+	// flyClientIP is set by Fly.io's proxy to the address of the client
+	// that connected to the edge.
+	flyClientIP = "Fly-Client-IP"
+
+	// netlifyClientIP is set by Netlify's proxy to the address of the
+	// client that connected to it.
+	netlifyClientIP = "X-Nf-Client-Connection-Ip"
+
+	// edgeOneClientIP is set by Tencent EdgeOne to the address of the
+	// client that connected to the edge.
+	edgeOneClientIP = "EO-Client-IP"
+
+	// azureClientIP is set by Azure Front Door to the address of the
+	// client that connected to it. Front Door overwrites any value sent
+	// by the client, so it always holds a single address. Front Door's
+	// backend ranges are shared by all of its customers; X-Azure-FDID
+	// identifies the Front Door instance a request came through.
+	azureClientIP = "X-Azure-ClientIP"
+)
+
+// presetHeaders are the headers the providers of some presets always set
+// to the client's address. The Caddyfile defaults header to them when such
+// a preset is given to from. CloudFront and Akamai only send theirs when
+// configured to, so their presets don't imply one.
+var presetHeaders = map[string]string{
+	"cloudflare":       cfConnectingIP,
+	"cloudflare_china": cfConnectingIP,
+	"fastly":           fastlyClientIP,
+	"azure_frontdoor":  azureClientIP,
+	"sucuri":           sucuriClientIP,
+	"tencent_edgeone":  edgeOneClientIP,
+	"fly":              flyClientIP,
+}
+
+// impliedHeader returns the header the given presets imply, or an empty
+// string if none does. Presets implying different headers are an error,
+// since each header must only be trusted from its own provider.
+func impliedHeader(names []string) (string, error) {
+	header, from := "", ""
+	for _, name := range names {
+		h, ok := presetHeaders[name]
+		if !ok {
+			continue
+		}
+		if header != "" && header != h {
+			return "", fmt.Errorf("presets %s and %s imply different headers; configure header or bind each one", from, name)
+		}
+		header, from = h, name
+	}
+	return header, nil
 }
 
 func init() {
@@ -65,6 +591,121 @@ func (module) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+func (m *module) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+
+	for i := range m.Extract {
+		re, err := compileExtract(m.Extract[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("extract %s: %v", m.Extract[i].Header, err)
+		}
+		m.Extract[i].re = re
+	}
+
+	if m.Sources != nil {
+		vals, err := ctx.LoadModule(m, "Sources")
+		if err != nil {
+			return fmt.Errorf("loading IP source modules: %v", err)
+		}
+		for _, val := range vals.([]interface{}) {
+			m.sources = append(m.sources, val.(IPSource))
+			if c, ok := val.(*crawlerSource); ok {
+				m.crawlers = append(m.crawlers, c)
+				m.allCrawlers = append(m.allCrawlers, c)
+			}
+			m.sourceNames = append(m.sourceNames, strings.TrimPrefix(string(val.(caddy.Module).CaddyModule().ID), "realip.ip_sources."))
+		}
+	}
+
+	for i := range m.Bindings {
+		if m.Bindings[i].Sources == nil {
+			continue
+		}
+		vals, err := ctx.LoadModule(&m.Bindings[i], "Sources")
+		if err != nil {
+			return fmt.Errorf("loading IP source modules of %s binding: %v", m.Bindings[i].Header, err)
+		}
+		for _, val := range vals.([]interface{}) {
+			m.Bindings[i].sources = append(m.Bindings[i].sources, val.(IPSource))
+			if c, ok := val.(*crawlerSource); ok {
+				m.Bindings[i].crawlers = append(m.Bindings[i].crawlers, c)
+				m.allCrawlers = append(m.allCrawlers, c)
+			}
+		}
+	}
+
+	if err := m.expandFrom(); err != nil {
+		return err
+	}
+	m.applyExcept()
+	m.logOverlaps()
+	m.From = mergeRanges(m.From)
+	m.trust = new(trustCache)
+
+	if m.Parsers != nil {
+		vals, err := ctx.LoadModule(m, "Parsers")
+		if err != nil {
+			return fmt.Errorf("loading parser modules: %v", err)
+		}
+		for _, val := range vals.([]interface{}) {
+			m.parsers = append(m.parsers, val.(Parser))
+		}
+	}
+	registerHandler(m)
+	return nil
+}
+
+func (m *module) Cleanup() error {
+	unregisterHandler(m)
+	return nil
+}
+
+func (m *module) Validate() error {
+	switch m.Via {
+	case "", viaLog, viaReject:
+	default:
+		return fmt.Errorf("unknown Via mode %q", m.Via)
+	}
+	switch m.Strategy {
+	case "", strategyDefault, strategyFirst, strategyLast, strategyRightmostUntrusted, strategyLeftmostPublic:
+		if m.TrustedHops > 0 && m.Strategy != "" {
+			return fmt.Errorf("trusted hops can't be combined with strategy %q", m.Strategy)
+		}
+	case strategyTrustedHops:
+		if m.TrustedHops < 1 {
+			return fmt.Errorf("strategy %q requires trusted hops of at least 1", m.Strategy)
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q", m.Strategy)
+	}
+	if m.TrustedHops < 0 {
+		return fmt.Errorf("trusted hops must not be negative")
+	}
+	switch m.Port {
+	case "", portKeep, portForwarded, portZero:
+	default:
+		return fmt.Errorf("unknown port policy %q", m.Port)
+	}
+	switch m.Fallback {
+	case "", fallbackKeep, fallbackReject:
+	case fallbackSentinel:
+		if net.ParseIP(m.FallbackAddress) == nil {
+			return fmt.Errorf("sentinel fallback requires a valid address, got %q", m.FallbackAddress)
+		}
+	default:
+		return fmt.Errorf("unknown fallback %q", m.Fallback)
+	}
+	if m.FallbackStatus != 0 && (m.FallbackStatus < 400 || m.FallbackStatus > 599) {
+		return fmt.Errorf("fallback status %d is not an error status", m.FallbackStatus)
+	}
+	switch m.RewriteXFF {
+	case "", rewriteClient, rewriteChain:
+	default:
+		return fmt.Errorf("unknown X-Forwarded-For rewrite mode %q", m.RewriteXFF)
+	}
+	return nil
+}
+
 func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m module
 	err := m.UnmarshalCaddyfile(h.Dispenser)
@@ -74,21 +715,123 @@ func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler,
 	return m, err
 }
 
-func addIpRanges(m *module, d *caddyfile.Dispenser, ranges []string) error {
+func addIpRanges(out *[]*net.IPNet, d *caddyfile.Dispenser, ranges []string) error {
+	nets, err := parseRanges(ranges)
+	if err != nil {
+		return d.Err(err.Error())
+	}
+	*out = append(*out, nets...)
+	return nil
+}
+
+// expandFrom adds the ranges FromPlaceholders expand to, and the addresses
+// of FromHosts, to From.
+func (m *module) expandFrom() error {
+	repl := caddy.NewReplacer()
+	hosts := append([]string{}, m.FromHosts...)
+	for _, value := range m.FromPlaceholders {
+		expanded := repl.ReplaceAll(value, "")
+		fields, names := splitHosts(strings.FieldsFunc(expanded, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}))
+		ranges, err := parseRanges(fields)
+		if err != nil {
+			return fmt.Errorf("from %s: %v", value, err)
+		}
+		if len(ranges) == 0 && len(names) == 0 && m.logger != nil {
+			m.logger.Warn("trusted ranges placeholder is empty", zap.String("from", value))
+		}
+		m.From = append(m.From, ranges...)
+		hosts = append(hosts, names...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, host := range hosts {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("from %s: %v", host, err)
+		}
+		for _, addr := range addrs {
+			m.From = append(m.From, hostRange(addr.IP))
+		}
+	}
+	return nil
+}
+
+// splitHosts separates host names from ranges, addresses and presets.
+func splitHosts(args []string) (ranges, hosts []string) {
+	for _, arg := range args {
+		if _, ok := presets[arg]; ok || strings.Contains(arg, "/") || net.ParseIP(arg) != nil {
+			ranges = append(ranges, arg)
+		} else {
+			hosts = append(hosts, arg)
+		}
+	}
+	return ranges, hosts
+}
+
+// parseRanges parses CIDR ranges, single addresses and presets. It is
+// meant for the configuration; use parseCIDRs for lists fetched at runtime.
+func parseRanges(ranges []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
 	for _, v := range ranges {
 		if preset, ok := presets[v]; ok {
-			if err := addIpRanges(m, d, preset); err != nil {
-				return err
+			nets, err := parseRanges(preset)
+			if err != nil {
+				return nil, err
 			}
+			out = append(out, nets...)
+			continue
+		}
+		nets, err := parseCIDRs([]string{v})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, nets...)
+	}
+	return out, nil
+}
+
+// parseCIDRs parses CIDR ranges and single addresses, but not presets, so
+// that a list fetched from elsewhere can't make a preset's ranges trusted
+// by naming it.
+func parseCIDRs(ranges []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, v := range ranges {
+		if ip := net.ParseIP(v); ip != nil {
+			out = append(out, hostRange(ip))
 			continue
 		}
 		_, cidr, err := net.ParseCIDR(v)
 		if err != nil {
-			return d.Err(err.Error())
+			return nil, err
 		}
-		m.From = append(m.From, cidr)
+		out = append(out, cidr)
 	}
-	return nil
+	return out, nil
+}
+
+// parseGuestModule parses a module of the given namespace whose name is the
+// next argument, passing it the tokens starting at its name.
+func parseGuestModule(d *caddyfile.Dispenser, namespace string) (caddy.Module, string, error) {
+	if !d.NextArg() {
+		return nil, "", d.ArgErr()
+	}
+	name := d.Val()
+	info, err := caddy.GetModule(namespace + "." + name)
+	if err != nil {
+		return nil, "", d.Errf("getting module '%s': %v", name, err)
+	}
+	mod := info.New()
+	unm, ok := mod.(caddyfile.Unmarshaler)
+	if !ok {
+		return nil, "", d.Errf("module '%s' is not a Caddyfile unmarshaler", name)
+	}
+	if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+		return nil, "", err
+	}
+	return mod, name, nil
 }
 
 func parseStringArg(d *caddyfile.Dispenser, out *string) error {
@@ -116,90 +859,775 @@ func parseBoolArg(d *caddyfile.Dispenser, out *bool) error {
 	return err
 }
 
-func (m *module) validSource(addr string) bool {
+func parseDurationArg(d *caddyfile.Dispenser, out *caddy.Duration) error {
+	var strVal string
+	err := parseStringArg(d, &strVal)
+	if err == nil {
+		var dur time.Duration
+		dur, err = time.ParseDuration(strVal)
+		*out = caddy.Duration(dur)
+	}
+	return err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, from := range nets {
+		if from.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func validSource(from []*net.IPNet, addr string) bool {
 	ip := net.ParseIP(addr)
 	if ip == nil {
 		return false
 	}
-	for _, from := range m.From {
-		if from.Contains(ip) {
+	return containsIP(from, ip)
+}
+
+var (
+	errNoAddress      = errors.New("no usable address in forward header")
+	errTooManyHops    = errors.New("too many hops in forward header")
+	errUntrustedHop   = errors.New("untrusted proxy in forward header")
+	errUntrustedChain = errors.New("forward chain is not trusted up to the client")
+	errBadSecret      = errors.New("missing or wrong secret for forward header")
+	errViaMismatch    = errors.New("forward header does not match Via header")
+	errHeaderTooLarge = errors.New("forward header too large")
+)
+
+// singleValueHeaders are set by CDNs to the client's address alone, so
+// they are always treated as single value headers.
+var singleValueHeaders = []string{
+	cloudFrontViewerAddress,
+	azureClientIP,
+	fastlyClientIP,
+	trueClientIP,
+	sucuriClientIP,
+	edgeOneClientIP,
+	flyClientIP,
+	netlifyClientIP,
+}
+
+// singleValue reports whether header is configured as a single value header
+// or is one of singleValueHeaders.
+func (m *module) singleValue(header string) bool {
+	for _, name := range singleValueHeaders {
+		if strings.EqualFold(name, header) {
+			return true
+		}
+	}
+	for _, name := range m.SingleValue {
+		if header != "" && strings.EqualFold(name, header) {
 			return true
 		}
 	}
 	return false
 }
 
-func (m module) ServeHTTP(w http.ResponseWriter, req *http.Request, handler caddyhttp.Handler) error {
-	host, port, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil || !m.validSource(host) {
-		if m.Strict {
-			return caddyhttp.Error(http.StatusForbidden, err)
+// headerBindings returns the configured headers in order of priority,
+// along with the ranges trusted to send each of them.
+func (m *module) headerBindings() []headerBinding {
+	from := m.trusted()
+	bindings := append([]headerBinding{}, m.Bindings...)
+	state := overrides.load()
+	for i := range bindings {
+		bindings[i].From = state.apply(bindings[i].trusted())
+	}
+	if m.Header != "" {
+		bindings = append(bindings, headerBinding{Header: m.Header, From: from, crawlers: m.crawlers})
+	}
+	for _, header := range m.Headers {
+		bindings = append(bindings, headerBinding{Header: header, From: from, crawlers: m.crawlers})
+	}
+	for _, parser := range m.parsers {
+		bindings = append(bindings, headerBinding{From: from, parser: parser, crawlers: m.crawlers})
+	}
+	return bindings
+}
+
+// trusted returns From along with the current ranges of all sources and
+// the overrides made through the admin API, merged. The result is cached
+// until one of them changes.
+func (m *module) trusted() []*net.IPNet {
+	state := overrides.load()
+	if len(m.sources) == 0 && len(state.added) == 0 && len(state.revoked) == 0 {
+		return m.From
+	}
+	inputs := make([][]*net.IPNet, 0, len(m.sources)+3)
+	inputs = append(inputs, m.From, state.added, state.revoked)
+	for _, source := range m.sources {
+		inputs = append(inputs, source.IPRanges())
+	}
+	compile := func() []*net.IPNet {
+		from := append([]*net.IPNet{}, m.From...)
+		for _, ranges := range inputs[3:] {
+			from = append(from, ranges...)
+		}
+		if len(state.added) > 0 {
+			from = append(from, excludeRanges(state.added, m.Except)...)
+		}
+		return mergeRanges(state.apply(from))
+	}
+	if m.trust == nil {
+		return compile()
+	}
+	return m.trust.get(inputs, compile)
+}
+
+// trustedPeer reports whether host may send any of the configured headers.
+func (m *module) trustedPeer(host string) bool {
+	if validSource(m.trusted(), host) || m.trustsCrawler(m.crawlers, host) {
+		return true
+	}
+	state := overrides.load()
+	for _, binding := range m.Bindings {
+		if validSource(state.apply(binding.trusted()), host) || m.trustsCrawler(binding.crawlers, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerParts splits the value of a header into the addresses it carries,
+// ordered from the client to the nearest proxy. The RFC 7239 Forwarded
+// header is parsed and its "for" parameters are used; any other header is
+// treated as a comma-separated list like X-Forwarded-For.
+func (m *module) headerParts(header, hVal string) ([]hop, error) {
+	if strings.EqualFold(header, forwardedHeader) {
+		elements, err := parseForwarded(hVal)
+		if err != nil {
+			return nil, err
+		}
+		parts := make([]hop, len(elements))
+		for i := range elements {
+			parts[i].Host, parts[i].Port = splitNode(elements[i].For)
+			parts[i].Forwarded = &elements[i]
+		}
+		return parts, nil
+	}
+	nodes := strings.Split(hVal, ",")
+	parts := make([]hop, len(nodes))
+	for i, node := range nodes {
+		parts[i].Host, parts[i].Port = splitNode(strings.TrimSpace(node))
+	}
+	return parts, nil
+}
+
+// resolution describes how the client address of a request was derived
+// from a forward header.
+type resolution struct {
+	// Header is the name of the header that was used.
+	Header string
+	// Chain is the list of addresses carried by the header, ordered from
+	// the client to the nearest proxy.
+	Chain []hop
+	// Client is the index of the client address in Chain. Every entry
+	// after it is a trusted proxy.
+	Client int
+	// Entries is the number of entries the header carried, before any
+	// were skipped or deduplicated, and Position is the index of the
+	// client address among them.
+	Entries, Position int
+	// PseudoIPv4 is the Cloudflare pseudo IPv4 address of the client, if
+	// PseudoIPv4 is enabled and one was sent.
+	PseudoIPv4 string
+	// From are the ranges trusted to send Header.
+	From []*net.IPNet
+}
+
+// chainFor returns the forward chain carried by req for binding, ordered
+// from the client to the nearest proxy, or nil if req doesn't carry one.
+func (m *module) chainFor(req *http.Request, binding headerBinding) ([]hop, error) {
+	if binding.parser != nil {
+		nodes, err := binding.parser.Parse(req)
+		if err != nil || len(nodes) == 0 {
+			return nil, err
+		}
+		parts := make([]hop, len(nodes))
+		for i, node := range nodes {
+			parts[i].Host, parts[i].Port = splitNode(strings.TrimSpace(node))
+		}
+		return parts, nil
+	}
+
+	// proxies may append a new header line instead of extending the
+	// existing one, so all lines are merged in order
+	values := req.Header.Values(binding.Header)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if m.MaxHeaderBytes > 0 && headerSize(values) > m.MaxHeaderBytes {
+		return nil, errHeaderTooLarge
+	}
+	hVal := strings.Join(values, ",")
+	if hVal == "" {
+		return nil, nil
+	}
+	if !binding.authenticated(req) {
+		return nil, errBadSecret
+	}
+	if re := m.extract(binding.Header); re != nil {
+		return extractParts(re, hVal)
+	}
+	if m.singleValue(binding.Header) {
+		if len(values) > 1 || strings.Contains(hVal, ",") {
+			return nil, errNoAddress
+		}
+		host, port := splitNode(strings.TrimSpace(hVal))
+		if strings.EqualFold(binding.Header, cloudFrontViewerAddress) {
+			host, port = splitViewerAddress(strings.TrimSpace(hVal))
+		}
+		if net.ParseIP(host) == nil {
+			return nil, errNoAddress
 		}
-		return handler.ServeHTTP(w, req) 
+		return []hop{{Host: host, Port: port}}, nil
+	}
+	// every entry but the last is followed by a comma, so this bounds the
+	// length of the chain without splitting it; quoted commas in the
+	// Forwarded header would overcount, so it's checked after parsing
+	if maxHops := m.maxHops(binding); maxHops != -1 && !m.DedupeChain && !strings.EqualFold(binding.Header, forwardedHeader) && strings.Count(hVal, ",") >= maxHops {
+		return nil, errTooManyHops
+	}
+	return m.headerParts(binding.Header, hVal)
+}
+
+// dedupe removes entries from parts whose host equals that of the entry
+// before them.
+func dedupe(parts []hop) []hop {
+	out := parts[:1]
+	for _, part := range parts[1:] {
+		if !strings.EqualFold(part.Host, out[len(out)-1].Host) {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// walkChain walks a forward chain from the nearest proxy towards the
+// client. It returns the chain along with the index of the client address
+// if every proxy in between is in the binding's From, or the index of the
+// first untrusted hop along with errUntrustedHop otherwise.
+func (m *module) walkChain(req *http.Request, parts []hop, binding headerBinding) ([]hop, int, error) {
+	from := binding.From
+	if len(parts) == 0 {
+		return nil, 0, errNoAddress
+	}
+	if m.DedupeChain {
+		parts = dedupe(parts)
+	}
+	if maxHops := m.maxHops(binding); maxHops != -1 && len(parts) > maxHops {
+		return nil, 0, errTooManyHops
+	}
+	if err := m.checkVia(req, len(parts)); err != nil {
+		return nil, 0, err
+	}
+	if m.SkipObfuscated {
+		known := parts[:0]
+		for _, part := range parts {
+			if !isObfuscated(part.Host) {
+				known = append(known, part)
+			}
+		}
+		if parts = known; len(parts) == 0 {
+			return nil, 0, errNoAddress
+		}
+	}
+	if m.SkipPrivate {
+		routable := parts[:0]
+		for _, part := range parts {
+			if net.ParseIP(part.Host) == nil || isPublic(part.Host) {
+				routable = append(routable, part)
+			}
+		}
+		if parts = routable; len(parts) == 0 {
+			return nil, 0, errNoAddress
+		}
+	}
+	client, err := m.selectClient(parts, from)
+	if err != nil && err != errUntrustedHop {
+		return nil, 0, err
+	}
+	if m.RequireTrustedChain {
+		if err == errUntrustedHop {
+			return nil, 0, errUntrustedChain
+		}
+		for _, part := range parts[client+1:] {
+			if !validSource(from, part.Host) {
+				return nil, 0, errUntrustedChain
+			}
+		}
+	}
+	return parts, client, err
+}
+
+// peerCtxKey is the context key for the address the request was received
+// from, as recorded by the first instance of the handler.
+type peerCtxKey struct{}
+
+// ServeHTTP resolves the client address of req. When several instances of
+// the handler run for the same request, e.g. one for the whole site and one
+// for a route, each resolves from the address the request was received
+// from rather than from the result of the previous one, and the last
+// instance that resolves an address wins. An instance that doesn't resolve
+// one leaves the previous result in place.
+func (m module) ServeHTTP(w http.ResponseWriter, req *http.Request, handler caddyhttp.Handler) error {
+	prior := req.RemoteAddr
+	peer, ok := req.Context().Value(peerCtxKey{}).(string)
+	if ok {
+		req.RemoteAddr = peer
+	} else {
+		peer = req.RemoteAddr
+		req = req.WithContext(context.WithValue(req.Context(), peerCtxKey{}, peer))
 	}
-	if !m.validSource(host) {
+	m.verifyCrawler(req, peer)
+	res, err := m.resolve(req)
+	if err != nil {
+		return err
+	}
+	if res == nil && req.RemoteAddr == peer {
+		req.RemoteAddr = prior
+	}
+	setAddressPlaceholders(req, peer)
+	setOriginalVars(req, peer, res)
+	setChain(req, peer, res)
+	m.logFields(req, peer, res)
+	setForwardedPlaceholders(req, res)
+	setPseudoPlaceholder(req, res)
+	m.applyForwardedInfo(req, peer, res)
+	m.stripHeaders(req)
+	m.rewriteXFF(req, res)
+	m.setClientHeader(req)
+	m.setOriginalHeader(req, peer)
+	m.appendHop(req, peer)
+	return handler.ServeHTTP(w, req)
+}
+
+// resolve rewrites req.RemoteAddr to the client address carried by the
+// configured headers, if the peer is trusted to send them, and describes
+// how it was found. It returns a nil resolution if the address was left
+// alone, and a handler error if the request must be rejected.
+func (m *module) resolve(req *http.Request) (*resolution, error) {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !m.trustedPeer(host) {
 		if m.Strict {
-			return caddyhttp.Error(http.StatusForbidden, err)
+			return nil, caddyhttp.Error(http.StatusForbidden, err)
 		}
-		return handler.ServeHTTP(w, req)
+		return nil, nil
 	}
 
-	if hVal := req.Header.Get(m.Header); hVal != "" {
-		parts := strings.Split(hVal, ",")
-		for i, part := range parts {
-			parts[i] = strings.TrimSpace(part)
+	var lastErr error
+	for _, binding := range m.headerBindings() {
+		if !validSource(binding.From, host) && !m.trustsCrawler(binding.crawlers, host) {
+			continue
+		}
+		chain, err := m.chainFor(req, binding)
+		if chain == nil && err == nil {
+			continue
+		}
+		for i := range chain {
+			chain[i].index = i
 		}
-		if m.MaxHops != -1 && len(parts) > m.MaxHops {
-			return caddyhttp.Error(http.StatusForbidden, err)
+		entries := len(chain)
+		var client int
+		if err == nil && !m.singleValue(binding.Header) {
+			chain, client, err = m.walkChain(req, chain, binding)
 		}
-		ip := net.ParseIP(parts[len(parts)-1])
-		if ip == nil {
+		switch err {
+		case nil:
+		case errTooManyHops, errViaMismatch, errUntrustedChain:
+			return nil, caddyhttp.Error(http.StatusForbidden, err)
+		case errUntrustedHop:
 			if m.Strict {
-				return caddyhttp.Error(http.StatusForbidden, err)
+				return nil, caddyhttp.Error(http.StatusForbidden, err)
 			}
-			return handler.ServeHTTP(w, req)
+		default:
+			// try the next header, if any
+			lastErr = err
+			continue
 		}
-		req.RemoteAddr = net.JoinHostPort(parts[len(parts)-1], port)
-		for i := len(parts) - 1; i >= 0; i-- {
-			req.RemoteAddr = net.JoinHostPort(parts[i], port)
-			if i > 0 && !m.validSource(parts[i]) {
-				if m.Strict {
-					return caddyhttp.Error(http.StatusForbidden, err)
-				}
-				return handler.ServeHTTP(w, req)
+		var pseudo string
+		if m.PseudoIPv4 {
+			if pseudo, err = unpseudo(req, &chain[client]); err != nil {
+				lastErr = err
+				continue
 			}
 		}
+		port = m.clientPort(port, chain[client].Port)
+		req.RemoteAddr = net.JoinHostPort(chain[client].Host, port)
+		return &resolution{Header: binding.Header, Chain: chain, Client: client, Entries: entries, Position: chain[client].index, PseudoIPv4: pseudo, From: binding.From}, nil
 	}
-	return handler.ServeHTTP(w, req)
+	if lastErr == nil {
+		return nil, nil
+	}
+	switch m.Fallback {
+	case fallbackKeep:
+		return nil, nil
+	case fallbackReject:
+		status := m.FallbackStatus
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		return nil, caddyhttp.Error(status, lastErr)
+	case fallbackSentinel:
+		req.RemoteAddr = net.JoinHostPort(m.FallbackAddress, port)
+		return nil, nil
+	}
+	if m.Strict {
+		return nil, caddyhttp.Error(http.StatusForbidden, lastErr)
+	}
+	return nil, nil
+}
+
+// parseBinding parses a header binding of the form
+//
+//	bind <header> [<ranges...>] {
+//	    secret <header> <value>
+//	    max_hops <n>
+//	    source <name> [<args...>]
+//	}
+//
+// At least one range or source is required.
+func parseBinding(d *caddyfile.Dispenser) (headerBinding, error) {
+	var binding headerBinding
+	args := d.RemainingArgs()
+	if len(args) < 1 {
+		return binding, d.ArgErr()
+	}
+	binding.Header = args[0]
+	if err := addIpRanges(&binding.From, d, args[1:]); err != nil {
+		return binding, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "secret":
+			if !d.Args(&binding.SecretHeader, &binding.Secret) {
+				return binding, d.ArgErr()
+			}
+		case "max_hops":
+			if err := parseIntArg(d, &binding.MaxHops); err != nil {
+				return binding, d.Errf("Error parsing %s: %s", d.Val(), err)
+			}
+		case "source":
+			raw, err := parseSource(d)
+			if err != nil {
+				return binding, err
+			}
+			binding.Sources = append(binding.Sources, raw)
+		default:
+			return binding, d.Errf("Unknown bind arg %s", d.Val())
+		}
+	}
+	if len(binding.From) == 0 && len(binding.Sources) == 0 {
+		return binding, d.Err("bind requires ranges or a source")
+	}
+	return binding, nil
 }
 
 func (m *module) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.NextArg()
-	
-	for d.NextBlock(0) {	
+
+	if m.MaxHops == 0 {
+		m.MaxHops = defaultMaxHops
+	}
+
+	// the presets given to from, kept current with live_presets
+	var fromPresets []string
+	// the entries of From the presets in fromPresets expanded to
+	var presetNets []*net.IPNet
+	// the presets given to from that may imply the header
+	var implied []string
+	var live *presetSource
+
+	for d.NextBlock(0) {
 		var err error
-		
+
 		switch d.Val() {
-			case "header":
-				err = parseStringArg(d, &m.Header)
-			case "from":
-				err = addIpRanges(m, d, d.RemainingArgs())
-			case "strict":
-				err = parseBoolArg(d, &m.Strict)
-			case "maxhops":
-				err = parseIntArg(d, &m.MaxHops)
+		case "header":
+			err = parseStringArg(d, &m.Header)
+		case "single_value":
+			m.SingleValue = append(m.SingleValue, d.RemainingArgs()...)
+			if len(m.SingleValue) == 0 {
+				err = d.ArgErr()
+			}
+		case "headers":
+			m.Headers = append(m.Headers, d.RemainingArgs()...)
+			if len(m.Headers) == 0 {
+				err = d.ArgErr()
+			}
+		case "from":
+			var args []string
+			for _, arg := range d.RemainingArgs() {
+				if strings.Contains(arg, "{") {
+					m.FromPlaceholders = append(m.FromPlaceholders, arg)
+				} else {
+					args = append(args, arg)
+				}
+			}
+			ranges, hosts := splitHosts(args)
+			m.FromHosts = append(m.FromHosts, hosts...)
+			for _, r := range ranges {
+				var nets []*net.IPNet
+				if err = addIpRanges(&nets, d, []string{r}); err != nil {
+					break
+				}
+				if _, ok := presetFeeds[r]; ok {
+					fromPresets = append(fromPresets, r)
+					presetNets = append(presetNets, nets...)
+				}
+				if _, ok := presetHeaders[r]; ok {
+					implied = append(implied, r)
+				}
+				m.From = append(m.From, nets...)
+			}
+		case "live_presets":
+			// live_presets [<refresh>]
+			live = new(presetSource)
+			if d.NextArg() {
+				var dur time.Duration
+				if dur, err = time.ParseDuration(d.Val()); err == nil {
+					live.Refresh = caddy.Duration(dur)
+				}
+			}
+			if err == nil && d.NextArg() {
+				err = d.ArgErr()
+			}
+		case "platform":
+			var name string
+			if err = parseStringArg(d, &name); err == nil {
+				err = m.applyPlatform(name)
+			}
+		case "except":
+			err = addIpRanges(&m.Except, d, d.RemainingArgs())
+		case "bind":
+			var binding headerBinding
+			binding, err = parseBinding(d)
+			m.Bindings = append(m.Bindings, binding)
+		case "strict":
+			err = parseBoolArg(d, &m.Strict)
+		case "fallback":
+			// fallback keep | reject [<status>] | sentinel <address>
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				err = d.ArgErr()
+				break
+			}
+			m.Fallback = args[0]
+			switch {
+			case len(args) == 2 && m.Fallback == fallbackReject:
+				m.FallbackStatus, err = strconv.Atoi(args[1])
+			case len(args) == 2 && m.Fallback == fallbackSentinel:
+				m.FallbackAddress = args[1]
+			case len(args) == 2:
+				err = d.ArgErr()
+			}
+		case "require_trusted_chain":
+			err = parseBoolArg(d, &m.RequireTrustedChain)
+		case "strategy":
+			// strategy <name> [<trusted_hops>]
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				err = d.ArgErr()
+				break
+			}
+			m.Strategy = args[0]
+			if len(args) == 2 {
+				m.TrustedHops, err = strconv.Atoi(args[1])
+			}
+		case "trusted_hops":
+			err = parseIntArg(d, &m.TrustedHops)
+		case "maxhops":
+			err = parseIntArg(d, &m.MaxHops)
+		case "max_header_bytes":
+			err = parseIntArg(d, &m.MaxHeaderBytes)
+		case "forwarded_port":
+			err = parseBoolArg(d, &m.ForwardedPort)
+		case "port":
+			err = parseStringArg(d, &m.Port)
+		case "skip_obfuscated":
+			err = parseBoolArg(d, &m.SkipObfuscated)
+		case "skip_private":
+			err = parseBoolArg(d, &m.SkipPrivate)
+		case "dedupe":
+			err = parseBoolArg(d, &m.DedupeChain)
+		case "strip_headers":
+			m.StripHeaders = true
+			m.KeepHeaders = append(m.KeepHeaders, d.RemainingArgs()...)
+		case "append_hop":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				args = []string{"xff"}
+			}
+			for _, arg := range args {
+				switch arg {
+				case "xff":
+					m.AppendXFF = true
+				case "forwarded":
+					m.AppendForwarded = true
+				default:
+					err = d.Errf("unknown header %s", arg)
+				}
+			}
+		case "trust_forwarded":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				args = []string{"proto", "host", "port"}
+			}
+			for _, arg := range args {
+				switch arg {
+				case "proto":
+					m.TrustProto = true
+				case "host":
+					m.TrustHost = true
+				case "port":
+					m.TrustPort = true
+				default:
+					err = d.Errf("unknown header %s", arg)
+				}
+			}
+		case "from_url":
+			src := new(urlSource)
+			if err = src.UnmarshalCaddyfile(d.NewFromNextSegment()); err == nil {
+				m.Sources = append(m.Sources, caddyconfig.JSONModuleObject(src, "source", "url", nil))
+			}
+		case "from_file":
+			src := new(fileSource)
+			if err = src.UnmarshalCaddyfile(d.NewFromNextSegment()); err == nil {
+				m.Sources = append(m.Sources, caddyconfig.JSONModuleObject(src, "source", "file", nil))
+			}
+		case "from_dns":
+			src := new(dnsSource)
+			if err = src.UnmarshalCaddyfile(d.NewFromNextSegment()); err == nil {
+				m.Sources = append(m.Sources, caddyconfig.JSONModuleObject(src, "source", "dns", nil))
+			}
+		case "from_asn":
+			src := new(asnSource)
+			if err = src.UnmarshalCaddyfile(d.NewFromNextSegment()); err == nil {
+				m.Sources = append(m.Sources, caddyconfig.JSONModuleObject(src, "source", "asn", nil))
+			}
+		case "from_interface":
+			src := new(interfaceSource)
+			if err = src.UnmarshalCaddyfile(d.NewFromNextSegment()); err == nil {
+				m.Sources = append(m.Sources, caddyconfig.JSONModuleObject(src, "source", "interface", nil))
+			}
+		case "source":
+			var raw []byte
+			raw, err = parseSource(d)
+			m.Sources = append(m.Sources, raw)
+		case "parser":
+			var raw []byte
+			raw, err = parseParser(d)
+			m.Parsers = append(m.Parsers, raw)
+		case "rewrite_xff":
+			err = parseStringArg(d, &m.RewriteXFF)
+		case "log_fields":
+			m.LogFields = true
+		case "original_header":
+			// original_header [<name>]
+			m.OriginalHeader = defaultOriginalHeader
+			d.Args(&m.OriginalHeader)
+			if d.NextArg() {
+				err = d.ArgErr()
+			}
+		case "set_header":
+			// set_header <name> [with_port]
+			args := d.RemainingArgs()
+			switch {
+			case len(args) == 1:
+			case len(args) == 2 && args[1] == "with_port":
+				m.SetHeaderPort = true
 			default:
-				return d.Errf("Unknown realip arg")
+				err = d.ArgErr()
 			}
-			if err != nil {
-				return d.Errf("Error parsing %s: %s", d.Val(), err)
+			if err == nil {
+				m.SetHeader = args[0]
+			}
+		case "extract":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				err = d.ArgErr()
+				break
+			}
+			if _, err = compileExtract(args[1]); err == nil {
+				m.Extract = append(m.Extract, headerExtract{Header: args[0], Pattern: args[1]})
+			}
+		case "pseudo_ipv4":
+			err = parseBoolArg(d, &m.PseudoIPv4)
+		case "via":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				err = d.ArgErr()
+				break
+			}
+			m.Via = args[0]
+			if len(args) == 2 {
+				m.ViaTolerance, err = strconv.Atoi(args[1])
+			}
+		default:
+			return d.Errf("Unknown realip arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	if live != nil {
+		m.useLivePresets(fromPresets, presetNets, live.Refresh)
+	}
+	if m.Header == "" {
+		header, err := impliedHeader(implied)
+		if err != nil {
+			return d.Err(err.Error())
+		}
+		if !m.bound(header) {
+			m.Header = header
 		}
 	}
 	return nil
 }
 
+// bound reports whether header is one of the bound headers.
+func (m *module) bound(header string) bool {
+	for _, binding := range m.Bindings {
+		if binding.Header != "" && strings.EqualFold(binding.Header, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// useLivePresets replaces the snapshots of the given presets in From with
+// sources that keep them current. Only the entries in nets, which the
+// presets were expanded to, are removed from From, so that ranges listed
+// explicitly stay even if a preset contains them too.
+func (m *module) useLivePresets(names []string, nets []*net.IPNet, refresh caddy.Duration) {
+	expanded := make(map[*net.IPNet]bool, len(nets))
+	for _, n := range nets {
+		expanded[n] = true
+	}
+	var from []*net.IPNet
+	for _, n := range m.From {
+		if !expanded[n] {
+			from = append(from, n)
+		}
+	}
+	m.From = from
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		src := &presetSource{Name: name, Refresh: refresh}
+		m.Sources = append(m.Sources, caddyconfig.JSONModuleObject(src, "source", "preset", nil))
+	}
+}
+
 var (
+	_ caddy.Provisioner           = (*module)(nil)
+	_ caddy.Validator             = (*module)(nil)
+	_ caddy.CleanerUpper          = (*module)(nil)
 	_ caddyhttp.MiddlewareHandler = (*module)(nil)
 	_ caddyfile.Unmarshaler       = (*module)(nil)
 )
-
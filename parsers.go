@@ -0,0 +1,42 @@
+package realip
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Parser extracts a forward chain from a request, for header formats the
+// handler doesn't understand natively, such as base64 or JSON encoded
+// vendor headers. Parsers are modules in the http.handlers.realip.parsers
+// namespace; the handler tries them in order after its own headers, and
+// validates their chains against From like any other header.
+type Parser interface {
+	// Parse returns the addresses carried by req, ordered from the client
+	// to the nearest proxy. Entries may carry a port, as in X-Forwarded-For.
+	// It returns an empty chain if req doesn't carry a value for this
+	// parser, or an error if the value is malformed.
+	Parse(req *http.Request) ([]string, error)
+}
+
+// parsersNamespace is the module namespace of Parser modules.
+const parsersNamespace = "http.handlers.realip.parsers"
+
+// parseParser parses a parser module from the Caddyfile:
+//
+//	parser <name> [<args...>] [{
+//	    ...
+//	}]
+//
+// The module receives the tokens starting at its name.
+func parseParser(d *caddyfile.Dispenser) ([]byte, error) {
+	mod, name, err := parseGuestModule(d, parsersNamespace)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := mod.(Parser); !ok {
+		return nil, d.Errf("module '%s' is not a realip parser", name)
+	}
+	return caddyconfig.JSONModuleObject(mod, "parser", name, nil), nil
+}
@@ -0,0 +1,127 @@
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Keys of the request vars set by the handler, which handlers further down
+// can read as {http.vars.*} placeholders or with the vars matcher.
+const (
+	// varOriginalRemoteAddr is the address of the connection the request
+	// was received on, before RemoteAddr was rewritten.
+	varOriginalRemoteAddr = "realip.original_remote_addr"
+
+	// varHeader and varHeaderValue are the name and raw value of the
+	// header the client address was taken from.
+	varHeader      = "realip.header"
+	varHeaderValue = "realip.header_value"
+
+	// varChain is the chain the client address was derived from, as a
+	// []chainHop.
+	varChain = "realip.chain"
+)
+
+// setAddressPlaceholders exposes the client address the request ended up
+// with as {http.realip.client_ip}, and the address of the connection it
+// was received on as {http.realip.original_remote}, whether or not it was
+// resolved from a header.
+func setAddressPlaceholders(req *http.Request, peer string) {
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	repl.Set("http.realip.client_ip", client)
+	repl.Set("http.realip.original_remote", peer)
+}
+
+// setOriginalVars records the address of the connection, and the header
+// the client address was taken from as it was received, as request vars,
+// so that handlers further down can still see the actual peer after
+// RemoteAddr was rewritten and the header was stripped or rewritten.
+func setOriginalVars(req *http.Request, peer string, res *resolution) {
+	caddyhttp.SetVar(req.Context(), varOriginalRemoteAddr, peer)
+	if res == nil || res.Header == "" {
+		return
+	}
+	caddyhttp.SetVar(req.Context(), varHeader, res.Header)
+	caddyhttp.SetVar(req.Context(), varHeaderValue, strings.Join(req.Header.Values(res.Header), ", "))
+}
+
+// OriginalRemoteAddr returns the address of the connection req was
+// received on, before the handler rewrote RemoteAddr. It is RemoteAddr if
+// the handler didn't run for req.
+func OriginalRemoteAddr(req *http.Request) string {
+	if peer, ok := req.Context().Value(peerCtxKey{}).(string); ok {
+		return peer
+	}
+	return req.RemoteAddr
+}
+
+// chainHop is an entry of the chain a client address was derived from.
+type chainHop struct {
+	// Address is the address of the hop, without a port.
+	Address string `json:"address"`
+	// Trusted reports whether the address is in the ranges trusted to
+	// send the header.
+	Trusted bool `json:"trusted"`
+	// Client marks the hop that was selected as the client.
+	Client bool `json:"client,omitempty"`
+}
+
+// String formats the hop as its address followed by its status.
+func (h chainHop) String() string {
+	status := "untrusted"
+	if h.Trusted {
+		status = "trusted"
+	}
+	if h.Client {
+		status = "client, " + status
+	}
+	return fmt.Sprintf("%s (%s)", h.Address, status)
+}
+
+// resolvedChain returns the chain of res followed by the peer it was
+// received from, each annotated with whether it is trusted.
+func resolvedChain(peer string, res *resolution) []chainHop {
+	chain := make([]chainHop, 0, len(res.Chain)+1)
+	for i, part := range res.Chain {
+		chain = append(chain, chainHop{
+			Address: part.Host,
+			Trusted: validSource(res.From, part.Host),
+			Client:  i == res.Client,
+		})
+	}
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		chain = append(chain, chainHop{Address: host, Trusted: validSource(res.From, host)})
+	}
+	return chain
+}
+
+// setChain exposes the chain the client address was derived from, ordered
+// from the client to the peer, as the realip.chain var and as
+// {http.realip.chain}, e.g. "1.2.3.4 (client, untrusted), 10.0.0.1
+// (trusted)". Nothing is set if the address wasn't taken from a header.
+func setChain(req *http.Request, peer string, res *resolution) {
+	if res == nil {
+		return
+	}
+	chain := resolvedChain(peer, res)
+	caddyhttp.SetVar(req.Context(), varChain, chain)
+	if repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		hops := make([]string, len(chain))
+		for i, hop := range chain {
+			hops[i] = hop.String()
+		}
+		repl.Set("http.realip.chain", strings.Join(hops, ", "))
+	}
+}
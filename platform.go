@@ -0,0 +1,61 @@
+package realip
+
+import "fmt"
+
+// platform configures the module for a hosting platform whose proxies
+// don't have published addresses. Such platforms only route requests to
+// apps through their proxies, so any peer in from is trusted and the
+// client is taken from the entry the proxy appended.
+type platform struct {
+	header   string
+	from     []string
+	strategy string
+}
+
+// platforms are the hosting platforms supported by the platform option.
+var platforms = map[string]platform{
+	// Heroku's router appends the address it received the request from to
+	// X-Forwarded-For, see
+	// https://devcenter.heroku.com/articles/http-routing#heroku-headers
+	"heroku": {
+		header:   "X-Forwarded-For",
+		from:     []string{"0.0.0.0/0", "::/0"},
+		strategy: strategyLast,
+	},
+	// Render's proxies append the address they received the request from
+	// to X-Forwarded-For
+	"render": {
+		header:   "X-Forwarded-For",
+		from:     []string{"0.0.0.0/0", "::/0"},
+		strategy: strategyLast,
+	},
+	// ngrok's edge appends the address of the visitor to X-Forwarded-For
+	// and the agent passes it on from the host it runs on, see
+	// https://ngrok.com/docs/http/#upstream-headers
+	"ngrok": {
+		header:   "X-Forwarded-For",
+		from:     []string{"ngrok"},
+		strategy: strategyLast,
+	},
+}
+
+// applyPlatform configures m for the named platform. The header and the
+// strategy are only set if none is configured yet.
+func (m *module) applyPlatform(name string) error {
+	p, ok := platforms[name]
+	if !ok {
+		return fmt.Errorf("unknown platform %s", name)
+	}
+	ranges, err := parseRanges(p.from)
+	if err != nil {
+		return err
+	}
+	if m.Header == "" {
+		m.Header = p.header
+	}
+	m.From = append(m.From, ranges...)
+	if m.Strategy == "" {
+		m.Strategy = p.strategy
+	}
+	return nil
+}
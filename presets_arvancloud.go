@@ -0,0 +1,20 @@
+package realip
+
+// arvancloudPreset is a hand-written excerpt of ArvanCloud's CDN ranges,
+// after https://www.arvancloud.ir/en/ips.txt. It wasn't generated from that
+// list or checked against it, so it may miss peers, which then aren't
+// trusted, or hold wider ranges than the list. go generate replaces it with
+// the full list, and live_presets or a preset source trusts the current
+// one.
+var arvancloudPreset = []string{
+	"2.144.3.128/28",
+	"37.32.16.0/27",
+	"37.32.17.0/27",
+	"37.32.18.0/27",
+	"37.32.19.0/27",
+	"89.45.48.64/28",
+	"94.101.182.0/27",
+	"185.143.232.0/22",
+	"185.215.232.0/22",
+	"188.229.116.16/29",
+}
@@ -0,0 +1,16 @@
+package realip
+
+// cacheflyPreset is a hand-written excerpt of CacheFly's edge prefixes,
+// after https://cachefly.cachefly.net/ips/rproxy.txt. It wasn't generated
+// from that list or checked against it, so it may miss peers, which then
+// aren't trusted, or hold wider ranges than the list. go generate replaces
+// it with the full list, and live_presets or a preset source trusts the
+// current one.
+var cacheflyPreset = []string{
+	"66.225.197.0/24",
+	"66.225.223.0/24",
+	"204.93.150.0/24",
+	"204.93.177.0/24",
+	"204.93.240.0/24",
+	"205.234.175.0/24",
+}
@@ -0,0 +1,17 @@
+package realip
+
+// cloudflareChinaPreset is a hand-written excerpt of the ranges of the
+// Cloudflare China Network, operated by JD Cloud, after
+// https://api.cloudflare.com/client/v4/ips?networks=jdcloud. It wasn't
+// generated from that list or checked against it, so it may miss peers,
+// which then aren't trusted, or hold wider ranges than the list. go
+// generate replaces it with the full list, and live_presets or a preset
+// source trusts the current one.
+var cloudflareChinaPreset = []string{
+	"111.13.233.0/24",
+	"116.196.71.0/24",
+	"116.196.72.0/24",
+	"116.196.78.0/24",
+	"120.52.22.96/27",
+	"2402:db40:5100::/48",
+}
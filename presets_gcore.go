@@ -0,0 +1,15 @@
+package realip
+
+// gcorePreset is a hand-written excerpt of the addresses of Gcore's CDN
+// nodes, after https://api.gcore.com/cdn/public-ip-list. It wasn't
+// generated from that list or checked against it, so it may miss peers,
+// which then aren't trusted, or hold wider ranges than the list. go
+// generate replaces it with the full list, and live_presets or a preset
+// source trusts the current one.
+var gcorePreset = []string{
+	"5.188.126.0/24",
+	"92.223.84.0/24",
+	"92.223.88.0/24",
+	"93.123.11.0/24",
+	"2a03:90c0::/32",
+}
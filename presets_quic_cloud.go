@@ -0,0 +1,16 @@
+package realip
+
+// quicCloudPreset is a hand-written excerpt of the addresses of
+// QUIC.cloud's nodes, after https://quic.cloud/ips?ln. It wasn't generated
+// from that list or checked against it, so it may miss peers, which then
+// aren't trusted, or hold wider ranges than the list. go generate replaces
+// it with the full list, and live_presets or a preset source trusts the
+// current one.
+var quicCloudPreset = []string{
+	"102.221.36.98/32",
+	"103.106.229.82/32",
+	"104.244.77.37/32",
+	"109.248.43.195/32",
+	"136.243.106.228/32",
+	"146.88.239.197/32",
+}
@@ -0,0 +1,17 @@
+package realip
+
+// statuscakePreset is a hand-written excerpt of the addresses of
+// StatusCake's test locations, after
+// https://app.statuscake.com/Workfloor/Locations.php?format=txt. It wasn't
+// generated from that list or checked against it, so it may miss peers,
+// which then aren't trusted, or hold wider ranges than the list. go
+// generate replaces it with the full list, and live_presets or a preset
+// source trusts the current one.
+var statuscakePreset = []string{
+	"31.220.7.237/32",
+	"37.235.48.42/32",
+	"45.63.88.213/32",
+	"45.76.192.50/32",
+	"104.238.164.105/32",
+	"107.191.47.131/32",
+}
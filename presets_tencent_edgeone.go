@@ -0,0 +1,15 @@
+package realip
+
+// tencentEdgeonePreset is a hand-written excerpt of Tencent EdgeOne's
+// back-to-origin ranges, after https://api.edgeone.ai/ips. It wasn't
+// generated from that list or checked against it, so it may miss peers,
+// which then aren't trusted, or hold wider ranges than the list. go
+// generate replaces it with the full list, and live_presets or a preset
+// source trusts the current one.
+var tencentEdgeonePreset = []string{
+	"43.152.0.0/18",
+	"43.174.0.0/15",
+	"101.33.0.0/19",
+	"150.109.192.0/18",
+	"2402:4e00:1400::/40",
+}
@@ -0,0 +1,377 @@
+//go:build ignore
+// +build ignore
+
+// presetsgen updates the presets that are generated from lists published
+// by providers. Run it with go generate whenever they change; -dir reads
+// the lists from local copies, named after the presets, instead of
+// downloading them.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// preset is a preset generated from a published list.
+type preset struct {
+	name  string // the name of the preset and its file
+	url   string
+	doc   string
+	parse func(io.Reader) ([]string, error)
+
+	// link, if set, finds the URL of the list on the page at url, for
+	// lists whose URL changes with every update.
+	link *regexp.Regexp
+}
+
+var generated = []preset{
+	{
+		name:  "cloudfront",
+		url:   "https://ip-ranges.amazonaws.com/ip-ranges.json",
+		doc:   "the CLOUDFRONT service of",
+		parse: awsService("CLOUDFRONT"),
+	},
+	{
+		name:  "zscaler",
+		url:   "https://config.zscaler.com/api/zscaler.net/hubs/cidr/json/recommended",
+		doc:   "the recommended hub prefixes of the zscaler.net cloud, from",
+		parse: zscalerHubs,
+	},
+	{
+		name:  "fastly",
+		url:   "https://api.fastly.com/public-ip-list",
+		doc:   "Fastly's public address ranges, from",
+		parse: fastlyIPs,
+	},
+	{
+		name:  "cachefly",
+		url:   "https://cachefly.cachefly.net/ips/rproxy.txt",
+		doc:   "CacheFly's edge prefixes, from",
+		parse: lines,
+	},
+	{
+		name:  "gcore",
+		url:   "https://api.gcore.com/cdn/public-ip-list",
+		doc:   "the addresses of Gcore's CDN nodes, from",
+		parse: gcoreIPs,
+	},
+	{
+		name:  "quic_cloud",
+		url:   "https://quic.cloud/ips?ln",
+		doc:   "the addresses of QUIC.cloud's nodes, from",
+		parse: lines,
+	},
+	{
+		name:  "arvancloud",
+		url:   "https://www.arvancloud.ir/en/ips.txt",
+		doc:   "ArvanCloud's CDN ranges, from",
+		parse: lines,
+	},
+	{
+		name:  "tencent_edgeone",
+		url:   "https://api.edgeone.ai/ips",
+		doc:   "Tencent EdgeOne's back-to-origin ranges, from",
+		parse: lines,
+	},
+	{
+		name:  "cloudflare_china",
+		url:   "https://api.cloudflare.com/client/v4/ips?networks=jdcloud",
+		doc:   "the ranges of the Cloudflare China Network, operated by JD Cloud, from",
+		parse: cloudflareJDCloud,
+	},
+	{
+		name:  "uptimerobot",
+		url:   "https://uptimerobot.com/inc/files/ips/IPv4andIPv6.txt",
+		doc:   "the addresses of UptimeRobot's monitoring probes, from",
+		parse: lines,
+	},
+	{
+		name:  "pingdom",
+		url:   "https://my.pingdom.com/probes/ipv4",
+		doc:   "the addresses of Pingdom's probe servers, from",
+		parse: lines,
+	},
+	{
+		name:  "statuscake",
+		url:   "https://app.statuscake.com/Workfloor/Locations.php?format=txt",
+		doc:   "the addresses of StatusCake's test locations, from",
+		parse: lines,
+	},
+	{
+		name:  "azure_frontdoor",
+		url:   "https://www.microsoft.com/en-us/download/details.aspx?id=56519",
+		doc:   "the AzureFrontDoor.Backend service tag, from",
+		parse: azureServiceTag("AzureFrontDoor.Backend"),
+		link:  regexp.MustCompile(`https://download\.microsoft\.com/download/[^"]*/ServiceTags_Public_\d+\.json`),
+	},
+}
+
+func main() {
+	dir := flag.String("dir", "", "read the lists from `directory` instead of downloading them")
+	flag.Parse()
+	for _, p := range generated {
+		if err := generate(p, *dir); err != nil {
+			log.Fatalf("%s: %v", p.name, err)
+		}
+	}
+}
+
+func generate(p preset, dir string) error {
+	var r io.ReadCloser
+	if dir != "" {
+		f, err := os.Open(path.Join(dir, p.name))
+		if err != nil {
+			return err
+		}
+		r = f
+	} else {
+		url := p.url
+		if p.link != nil {
+			page, err := download(url)
+			if err != nil {
+				return err
+			}
+			buf, err := ioutil.ReadAll(page)
+			page.Close()
+			if err != nil {
+				return err
+			}
+			if url = p.link.FindString(string(buf)); url == "" {
+				return fmt.Errorf("no link to the list found on %s", p.url)
+			}
+		}
+		body, err := download(url)
+		if err != nil {
+			return err
+		}
+		r = body
+	}
+	defer r.Close()
+	ranges, err := p.parse(r)
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return fmt.Errorf("no ranges found")
+	}
+	ranges, err = sortRanges(ranges)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by presetsgen.go; DO NOT EDIT.\n\npackage realip\n\n")
+	name := varName(p.name)
+	fmt.Fprintf(&buf, "// %sPreset is %s\n// %s\nvar %sPreset = []string{\n", name, p.doc, p.url, name)
+	for _, r := range ranges {
+		fmt.Fprintf(&buf, "\t%q,\n", r)
+	}
+	fmt.Fprintf(&buf, "}\n")
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile("presets_"+p.name+".go", src, 0644)
+}
+
+// varName returns the Go name for a preset, e.g. azureFrontdoor for
+// azure_frontdoor.
+func varName(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.Title(parts[i])
+	}
+	return strings.Join(parts, "")
+}
+
+// download returns the body of the response to a GET request for url.
+func download(url string) (io.ReadCloser, error) {
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// sortRanges sorts and deduplicates ranges, IPv4 first, so that updates
+// produce small diffs. Single addresses become host ranges.
+func sortRanges(ranges []string) ([]string, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	seen := make(map[string]bool)
+	for _, r := range ranges {
+		if ip := net.ParseIP(r); ip != nil {
+			if ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := n.IP.To4(); ip4 != nil {
+			n.IP = ip4
+		}
+		if !seen[n.String()] {
+			seen[n.String()] = true
+			nets = append(nets, n)
+		}
+	}
+	sort.Slice(nets, func(i, j int) bool {
+		if len(nets[i].IP) != len(nets[j].IP) {
+			return len(nets[i].IP) < len(nets[j].IP)
+		}
+		if c := bytes.Compare(nets[i].IP, nets[j].IP); c != 0 {
+			return c < 0
+		}
+		a, _ := nets[i].Mask.Size()
+		b, _ := nets[j].Mask.Size()
+		return a < b
+	})
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out, nil
+}
+
+// awsService returns the prefixes of service in AWS's ip-ranges.json.
+func awsService(service string) func(io.Reader) ([]string, error) {
+	return func(r io.Reader) ([]string, error) {
+		var doc struct {
+			Prefixes []struct {
+				IPPrefix string `json:"ip_prefix"`
+				Service  string `json:"service"`
+			} `json:"prefixes"`
+			IPv6Prefixes []struct {
+				IPv6Prefix string `json:"ipv6_prefix"`
+				Service    string `json:"service"`
+			} `json:"ipv6_prefixes"`
+		}
+		if err := json.NewDecoder(r).Decode(&doc); err != nil {
+			return nil, err
+		}
+		var ranges []string
+		for _, p := range doc.Prefixes {
+			if p.Service == service {
+				ranges = append(ranges, p.IPPrefix)
+			}
+		}
+		for _, p := range doc.IPv6Prefixes {
+			if p.Service == service {
+				ranges = append(ranges, p.IPv6Prefix)
+			}
+		}
+		return ranges, nil
+	}
+}
+
+// zscalerHubs returns the prefixes of Zscaler's hub list.
+func zscalerHubs(r io.Reader) ([]string, error) {
+	var doc struct {
+		HubPrefixes []string `json:"hubPrefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.HubPrefixes, nil
+}
+
+// azureServiceTag returns the prefixes of a service tag in Azure's service
+// tags file.
+func azureServiceTag(name string) func(io.Reader) ([]string, error) {
+	return func(r io.Reader) ([]string, error) {
+		var doc struct {
+			Values []struct {
+				Name       string `json:"name"`
+				Properties struct {
+					AddressPrefixes []string `json:"addressPrefixes"`
+				} `json:"properties"`
+			} `json:"values"`
+		}
+		if err := json.NewDecoder(r).Decode(&doc); err != nil {
+			return nil, err
+		}
+		for _, v := range doc.Values {
+			if v.Name == name {
+				return v.Properties.AddressPrefixes, nil
+			}
+		}
+		return nil, fmt.Errorf("service tag %s not found", name)
+	}
+}
+
+// fastlyIPs parses Fastly's public IP list.
+func fastlyIPs(r io.Reader) ([]string, error) {
+	var doc struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return append(doc.Addresses, doc.IPv6Addresses...), nil
+}
+
+// gcoreIPs parses Gcore's public IP list.
+func gcoreIPs(r io.Reader) ([]string, error) {
+	var doc struct {
+		Addresses   []string `json:"addresses"`
+		AddressesV6 []string `json:"addresses_v6"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return append(doc.Addresses, doc.AddressesV6...), nil
+}
+
+// cloudflareJDCloud parses the JD Cloud ranges of Cloudflare's IP list.
+func cloudflareJDCloud(r io.Reader) ([]string, error) {
+	var doc struct {
+		Result struct {
+			JDCloudCIDRs []string `json:"jdcloud_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.Result.JDCloudCIDRs, nil
+}
+
+// lines parses a list of one range per line, ignoring blank lines and
+// comments.
+func lines(r io.Reader) ([]string, error) {
+	var ranges []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			ranges = append(ranges, line)
+		}
+	}
+	return ranges, scanner.Err()
+}
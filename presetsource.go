@@ -0,0 +1,245 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// presetFeed is the authoritative list a preset is a snapshot of.
+type presetFeed struct {
+	url   string
+	parse func(io.Reader) ([]*net.IPNet, error)
+}
+
+// presetFeeds are the presets that can be kept current from their
+// authoritative lists.
+var presetFeeds = map[string]presetFeed{
+	"cloudflare":       {cloudflareIPsURL, parseCloudflareIPs},
+	"cloudflare_china": {cloudflareChinaIPsURL, parseCloudflareChinaIPs},
+	"cloudfront":       {awsIPRangesURL, (&awsSource{Services: []string{"CLOUDFRONT"}}).parse},
+	"fastly":           {fastlyIPsURL, parseFastlyIPs},
+	"gcore":            {gcoreIPsURL, parseGcoreIPs},
+	"zscaler":          {"https://config.zscaler.com/api/zscaler.net/hubs/cidr/json/recommended", parseZscalerHubs},
+	"cachefly":         {"https://cachefly.cachefly.net/ips/rproxy.txt", parseRangeList},
+	"quic_cloud":       {"https://quic.cloud/ips?ln", parseRangeList},
+	"arvancloud":       {"https://www.arvancloud.ir/en/ips.txt", parseRangeList},
+	"tencent_edgeone":  {"https://api.edgeone.ai/ips", parseRangeList},
+	"uptimerobot":      {"https://uptimerobot.com/inc/files/ips/IPv4andIPv6.txt", parseRangeList},
+	"pingdom":          {"https://my.pingdom.com/probes/ipv4", parseRangeList},
+	"statuscake":       {"https://app.statuscake.com/Workfloor/Locations.php?format=txt", parseRangeList},
+}
+
+// parseZscalerHubs parses Zscaler's list of hub prefixes.
+func parseZscalerHubs(r io.Reader) ([]*net.IPNet, error) {
+	var doc struct {
+		HubPrefixes []string `json:"hubPrefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc.HubPrefixes) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+	return parseCIDRs(doc.HubPrefixes)
+}
+
+// Preset statuses
+const (
+	// presetSnapshot means the embedded snapshot is in use because the
+	// live list has not been fetched yet.
+	presetSnapshot = "snapshot"
+
+	// presetLive means the live list is in use.
+	presetLive = "live"
+)
+
+// presetStatus is the state of a live preset, as shown by the admin API.
+type presetStatus struct {
+	Name    string     `json:"name"`
+	URL     string     `json:"url"`
+	Status  string     `json:"status"`
+	Ranges  int        `json:"ranges"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// presetStatuses are the states of the live presets in use, by name.
+var presetStatuses struct {
+	sync.Mutex
+	m map[string]presetStatus
+}
+
+func setPresetStatus(status presetStatus) {
+	presetStatuses.Lock()
+	defer presetStatuses.Unlock()
+	if presetStatuses.m == nil {
+		presetStatuses.m = make(map[string]presetStatus)
+	}
+	presetStatuses.m[status.Name] = status
+}
+
+// initPresetStatus records status unless the preset is already known, as
+// it is when a config reload shares its refresher.
+func initPresetStatus(status presetStatus) {
+	presetStatuses.Lock()
+	_, ok := presetStatuses.m[status.Name]
+	presetStatuses.Unlock()
+	if !ok {
+		setPresetStatus(status)
+	}
+}
+
+// updatePresetStatus records the outcome of a fetch of the named preset.
+func updatePresetStatus(name string, ranges []*net.IPNet, err error) {
+	presetStatuses.Lock()
+	status := presetStatuses.m[name]
+	presetStatuses.Unlock()
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Status = presetLive
+		status.Ranges = len(ranges)
+		now := time.Now().UTC()
+		status.Updated = &now
+		status.Error = ""
+	}
+	setPresetStatus(status)
+}
+
+// livePresets returns the states of the live presets, sorted by name.
+func livePresets() []presetStatus {
+	presetStatuses.Lock()
+	defer presetStatuses.Unlock()
+	list := []presetStatus{}
+	for _, status := range presetStatuses.m {
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// presetSource keeps a preset current by fetching its authoritative list,
+// using the embedded snapshot until the first fetch succeeds.
+type presetSource struct {
+	// Name is the name of the preset, e.g. "cloudflare".
+	Name string
+
+	// Refresh is the interval between checks for updates. The default is
+	// 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	feed      presetFeed
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+func init() {
+	caddy.RegisterModule(presetSource{})
+}
+
+func (presetSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.preset",
+		New: func() caddy.Module {
+			return new(presetSource)
+		},
+	}
+}
+
+func (s *presetSource) Provision(ctx caddy.Context) error {
+	feed, ok := presetFeeds[s.Name]
+	if !ok {
+		return fmt.Errorf("preset %q has no live list", s.Name)
+	}
+	snapshot, err := parseRanges(presets[s.Name])
+	if err != nil {
+		return err
+	}
+	s.feed = feed
+	s.http = newHTTPFetcher(0)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	initPresetStatus(presetStatus{Name: s.Name, URL: feed.url, Status: presetSnapshot, Ranges: len(snapshot)})
+	s.refresher.startShared(ctx, s, snapshot)
+	return nil
+}
+
+func (s *presetSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	ranges, err := s.http.get(ctx, s.feed.url, s.feed.parse, s.refresher.current())
+	updatePresetStatus(s.Name, ranges, err)
+	return ranges, err
+}
+
+func (s *presetSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *presetSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	preset <name> [<refresh>] {
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *presetSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Name = d.Val()
+	if _, ok := presetFeeds[s.Name]; !ok {
+		return d.Errf("Preset %s has no live list", s.Name)
+	}
+	if d.NextArg() {
+		dur, err := time.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("Error parsing refresh: %s", err)
+		}
+		s.Refresh = caddy.Duration(dur)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown preset source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*presetSource)(nil)
+	_ caddy.Provisioner     = (*presetSource)(nil)
+	_ caddy.CleanerUpper    = (*presetSource)(nil)
+	_ caddyfile.Unmarshaler = (*presetSource)(nil)
+)
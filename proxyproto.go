@@ -0,0 +1,283 @@
+package realip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// proxyProtocol is a listener wrapper that recovers the client address from
+// a PROXY protocol (v1 or v2) preamble sent by a trusted load balancer.
+// It must be placed before the "tls" wrapper, since the preamble is sent
+// ahead of the TLS handshake.
+type proxyProtocol struct {
+	// From is the list of peers that are allowed to send a PROXY header.
+	// Headers from any other peer are not parsed.
+	From []*net.IPNet
+
+	// Timeout bounds how long to wait for the PROXY header once a
+	// connection has been accepted. The default is 5s.
+	Timeout caddy.Duration
+
+	// Strict closes connections from peers not in From, as well as
+	// connections from trusted peers that don't send a valid PROXY header.
+	// If not set, such connections keep their original address.
+	Strict bool
+}
+
+// proxyV2Signature is the fixed prefix of every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header,
+// including the trailing CRLF.
+const proxyV1MaxLen = 107
+
+func init() {
+	caddy.RegisterModule(proxyProtocol{})
+}
+
+func (proxyProtocol) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.listeners.realip_proxyproto",
+		New: func() caddy.Module {
+			return new(proxyProtocol)
+		},
+	}
+}
+
+func (pp *proxyProtocol) WrapListener(ln net.Listener) net.Listener {
+	timeout := time.Duration(pp.Timeout)
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &proxyListener{Listener: ln, pp: pp, timeout: timeout}
+}
+
+type proxyListener struct {
+	net.Listener
+	pp      *proxyProtocol
+	timeout time.Duration
+}
+
+func (ln *proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// the header is read lazily on first use of the connection, so a
+	// slow or silent peer can't block the accept loop
+	return &proxyConn{Conn: conn, ln: ln, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	ln     *proxyListener
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	peer, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIP(c.ln.pp.From, peer.IP) {
+		if c.ln.pp.Strict {
+			c.fail(fmt.Errorf("PROXY header not accepted from untrusted peer %s", c.Conn.RemoteAddr()))
+		}
+		return
+	}
+
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.ln.timeout)); err != nil {
+		c.fail(err)
+		return
+	}
+	remote, err := readProxyHeader(c.reader)
+	if dlErr := c.Conn.SetReadDeadline(time.Time{}); err == nil {
+		err = dlErr
+	}
+	if err != nil {
+		if c.ln.pp.Strict || !errors.Is(err, errNoProxyHeader) {
+			c.fail(err)
+		}
+		return
+	}
+	c.remote = remote
+}
+
+func (c *proxyConn) fail(err error) {
+	c.err = err
+	c.Conn.Close()
+}
+
+var errNoProxyHeader = errors.New("no PROXY header")
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from r and
+// returns the source address it carries. A nil address is returned for
+// headers that don't carry one (v1 UNKNOWN, v2 LOCAL or unsupported
+// families), in which case the connection's own address applies.
+// errNoProxyHeader is only returned if what was received can't be the
+// start of a header; a read error or timeout before that is returned as
+// is, so that a slow peer isn't mistaken for one that sent no header.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if ok, err := peekPrefix(r, proxyV2Signature); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		return readProxyV2(r)
+	}
+	if ok, err := peekPrefix(r, []byte("PROXY ")); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		return readProxyV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// peekPrefix reports whether r starts with prefix, without consuming it.
+// It fails if reading stops before the data either matches prefix or
+// differs from it.
+func peekPrefix(r *bufio.Reader, prefix []byte) (bool, error) {
+	start, err := r.Peek(len(prefix))
+	if !bytes.HasPrefix(prefix, start) {
+		return false, nil
+	}
+	if err == io.EOF && len(start) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err == nil, err
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || !v1Family(fields[1], fields[2]) {
+		return nil, fmt.Errorf("malformed PROXY v1 source address in %q", line)
+	}
+	if net.ParseIP(fields[3]) == nil || !v1Family(fields[1], fields[3]) {
+		return nil, fmt.Errorf("malformed PROXY v1 destination address in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// v1Family reports whether addr, a valid address, is written in the
+// family of the PROXY v1 protocol proto, TCP4 or TCP6.
+func v1Family(proto, addr string) bool {
+	return strings.Contains(addr, ":") == (proto == "TCP6")
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", header[12]&0x0f)
+	}
+
+	// only TCP is accepted, as the header describes this connection
+	if family, transport := header[13]>>4, header[13]&0x0f; family != 0x0 && transport != 0x1 {
+		return nil, fmt.Errorf("unsupported PROXY v2 transport %d", transport)
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("PROXY v2 IPv4 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("PROXY v2 IPv6 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+func (pp *proxyProtocol) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.NextArg()
+
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "from":
+			err = addIpRanges(&pp.From, d, d.RemainingArgs())
+		case "timeout":
+			err = parseDurationArg(d, &pp.Timeout)
+		case "strict":
+			err = parseBoolArg(d, &pp.Strict)
+		default:
+			return d.Errf("Unknown realip_proxyproto arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ caddy.ListenerWrapper = (*proxyProtocol)(nil)
+	_ caddyfile.Unmarshaler = (*proxyProtocol)(nil)
+)
@@ -0,0 +1,125 @@
+package realip
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addrs ...byte) string {
+		hdr := append([]byte{}, proxyV2Signature...)
+		hdr = append(hdr, 0x20|cmd, fam, 0, byte(len(addrs)))
+		return string(append(hdr, addrs...))
+	}
+	for i, test := range []struct {
+		input    string
+		expected string
+		rest     string
+		err      bool
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\nGET /", "1.2.3.4:1111", "GET /", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1111 443\r\nGET /", "[2001:db8::1]:1111", "GET /", false},
+		{"PROXY UNKNOWN\r\nGET /", "", "GET /", false},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\nGET /", "", "", true},
+		{"PROXY TCP4 2001:db8::1 5.6.7.8 1111 443\r\nGET /", "", "", true},
+		{"PROXY TCP6 1.2.3.4 2001:db8::2 1111 443\r\nGET /", "", "", true},
+		{"PROXY TCP4 1.2.3.4 2001:db8::2 1111 443\r\nGET /", "", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 120), "", "", true},
+		{"GET / HTTP/1.1\r\n", "", "GET / HTTP/1.1\r\n", true},
+		{v2(1, 0x11, 1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0x01, 0xbb) + "GET /", "1.2.3.4:1111", "GET /", false},
+		{v2(0, 0x00) + "GET /", "", "GET /", false},
+		{v2(1, 0x12, 1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0x01, 0xbb) + "GET /", "", "", true},
+		{v2(1, 0x21, append(make([]byte, 32), 0x04, 0x57, 0x01, 0xbb)...) + "GET /", "[::]:1111", "GET /", false},
+		{v2(1, 0x22, append(make([]byte, 32), 0x04, 0x57, 0x01, 0xbb)...) + "GET /", "", "", true},
+		{v2(1, 0x11, 1, 2, 3), "", "", true},
+	} {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Expected error %v, but got %v", i, test.err, err)
+			continue
+		}
+		actual := ""
+		if addr != nil {
+			actual = addr.String()
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		if rest, _ := ioutil.ReadAll(r); !test.err && string(rest) != test.rest {
+			t.Errorf("Test %d: Expected remaining '%s', but found '%s'", i, test.rest, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	for i, test := range []struct {
+		from     []*net.IPNet
+		strict   bool
+		send     string
+		hold     bool
+		expected string
+	}{
+		{[]*net.IPNet{loopback}, false, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\nhello", false, "1.2.3.4:1111 hello"},
+		{nil, false, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\nhello", false, "127.0.0.1 PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\nhello"},
+		{[]*net.IPNet{loopback}, false, "hello", false, "127.0.0.1 hello"},
+		{[]*net.IPNet{loopback}, false, "", true, "closed"},
+		{[]*net.IPNet{loopback}, false, "PROX", true, "closed"},
+		{[]*net.IPNet{loopback}, false, "PROX", false, "closed"},
+		{[]*net.IPNet{loopback}, true, "hello", false, "closed"},
+		{nil, true, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\nhello", false, "closed"},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pp := &proxyProtocol{From: test.from, Strict: test.strict, Timeout: caddy.Duration(50 * time.Millisecond)}
+		wrapped := pp.WrapListener(ln)
+
+		// a held connection stays open after send, so that reading the
+		// header can only end with the timeout
+		done, exited := make(chan struct{}), make(chan struct{})
+		go func(send string, hold bool) {
+			defer close(exited)
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte(send))
+			if hold {
+				<-done
+			}
+			conn.(*net.TCPConn).CloseWrite()
+			<-done
+		}(test.send, test.hold)
+
+		conn, err := wrapped.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(conn)
+		actual := "closed"
+		if err == nil {
+			actual = conn.RemoteAddr().String()
+			if host, _, _ := net.SplitHostPort(actual); host == "127.0.0.1" {
+				actual = host
+			}
+			actual += " " + string(body)
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		close(done)
+		<-exited
+		conn.Close()
+		ln.Close()
+	}
+}
@@ -1,17 +1,23 @@
 package realip
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 
 	"bytes"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestRealIP(t *testing.T) {
@@ -36,61 +42,1465 @@ func TestRealIP(t *testing.T) {
 		// since the chain is longer than the configured max (5)
 		{"4.5.2.3:123", "1.2.6.7,5.6.7.8,4.5.6.7,5.6.7.8,4.5.6.7,1.2.3.4", ""},
 	} {
-		remoteAddr := ""
-		_, ipnet, err := net.ParseCIDR("4.5.0.0/16") // "4.5.x.x"
+		he := newTestModule(t)
+		he.Header = "X-Real-IP"
+
+		remoteAddr := serveTest(t, i, he, test.actualIP, test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPForwarded(t *testing.T) {
+	for i, test := range []struct {
+		actualIP   string
+		headerVal  string
+		expectedIP string
+	}{
+		{"4.5.0.0:123", "for=1.2.3.4", "1.2.3.4:123"},
+		{"4.5.0.0:123", `for="1.2.3.4:5678";proto=https;by=4.5.0.0`, "1.2.3.4:123"},
+		{"4.5.0.0:123", `For="[2001:db8:cafe::17]:4711"`, "[2001:db8:cafe::17]:123"},
+		{"4.5.2.3:123", "for=1.2.6.7, for=5.6.7.8;proto=http, for=4.5.6.7", "5.6.7.8:123"},
+		{"4.5.2.3:123", "for=1.2.6.7, for=111.111.111.111", "111.111.111.111:123"},
+		{"4.5.2.3:123", "proto=https", "4.5.2.3:123"},
+		{"4.5.2.3:123", `for="1.2.3.4`, "4.5.2.3:123"},
+		{"1.2.3.4:123", "for=5.6.7.8", "1.2.3.4:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "Forwarded"
+
+		remoteAddr := serveTest(t, i, he, test.actualIP, test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPPorts(t *testing.T) {
+	for i, test := range []struct {
+		headerVal     string
+		forwardedPort bool
+		policy        string
+		expectedIP    string
+	}{
+		{"203.0.113.7:51123", false, "", "203.0.113.7:123"},
+		{"203.0.113.7:51123", true, "", "203.0.113.7:51123"},
+		{"[2001:db8::1]:443", false, "", "[2001:db8::1]:123"},
+		{"[2001:db8::1]:443", true, "", "[2001:db8::1]:443"},
+		{"[2001:db8::1]", true, "", "[2001:db8::1]:123"},
+		{"2001:db8::1", true, "", "[2001:db8::1]:123"},
+		{"1.2.3.4:1000, 4.5.6.7:2000", true, "", "1.2.3.4:1000"},
+		{"1.2.3.4:1000, 9.9.9.9:2000, 4.5.6.7:3000", true, "", "9.9.9.9:2000"},
+		{"1.2.3.4, garbage, 4.5.6.7", false, "", "4.5.0.1:123"},
+		{"203.0.113.7:51123", false, "keep", "203.0.113.7:123"},
+		{"203.0.113.7:51123", true, "keep", "203.0.113.7:123"},
+		{"203.0.113.7:51123", false, "forwarded", "203.0.113.7:51123"},
+		{"203.0.113.7", false, "forwarded", "203.0.113.7:123"},
+		{"203.0.113.7:51123", false, "zero", "203.0.113.7:51123"},
+		{"203.0.113.7", false, "zero", "203.0.113.7:0"},
+		{"[2001:db8::1]:0", false, "zero", "[2001:db8::1]:0"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.ForwardedPort = test.forwardedPort
+		he.Port = test.policy
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPObfuscated(t *testing.T) {
+	for i, test := range []struct {
+		headerVal  string
+		skip       bool
+		strict     bool
+		expectedIP string
+	}{
+		{"for=unknown, for=4.5.6.7", false, false, "4.5.6.7:123"},
+		{"for=unknown, for=4.5.6.7", false, true, ""},
+		{"for=unknown, for=4.5.6.7", true, false, "4.5.6.7:123"},
+		{`for=1.2.3.4, for="_hidden", for=4.5.6.7`, false, false, "4.5.6.7:123"},
+		{`for=1.2.3.4, for="_hidden", for=4.5.6.7`, true, false, "1.2.3.4:123"},
+		{`for=1.2.3.4, for="_hidden", for=4.5.6.7`, true, true, "1.2.3.4:123"},
+		{`for=1.2.3.4, for=UNKNOWN`, false, false, "4.5.0.1:123"},
+		{`for=1.2.3.4, for=UNKNOWN`, true, false, "1.2.3.4:123"},
+		{`for=unknown`, true, false, "4.5.0.1:123"},
+		{`for="1.2.3.4:_port"`, false, false, "1.2.3.4:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "Forwarded"
+		he.ForwardedPort = true
+		he.SkipObfuscated = test.skip
+		he.Strict = test.strict
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPSkipPrivate(t *testing.T) {
+	for i, test := range []struct {
+		headerVal  string
+		skip       bool
+		expectedIP string
+	}{
+		{"1.2.3.4, 10.0.0.1", false, "10.0.0.1:123"},
+		{"1.2.3.4, 10.0.0.1", true, "1.2.3.4:123"},
+		{"1.2.3.4, 192.168.0.1, 127.0.0.1, 4.5.0.2", true, "1.2.3.4:123"},
+		{"fe80::1, 2606:4700::1, fd00::1", true, "[2606:4700::1]:123"},
+		{"10.0.0.1, 172.16.0.1", true, "4.5.0.1:123"},
+		{"1.2.3.4, 192.0.2.1, 198.51.100.1, 203.0.113.1, 198.19.0.1", true, "1.2.3.4:123"},
+		{"2606:4700::1, 2001:db8::1", true, "[2606:4700::1]:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.SkipPrivate = test.skip
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPDedupe(t *testing.T) {
+	for i, test := range []struct {
+		headerVal  string
+		dedupe     bool
+		expectedIP string
+	}{
+		{"1.2.3.4, 4.5.0.2, 4.5.0.2, 4.5.0.2, 4.5.0.2, 4.5.0.2", false, ""},
+		{"1.2.3.4, 4.5.0.2, 4.5.0.2, 4.5.0.2, 4.5.0.2, 4.5.0.2", true, "1.2.3.4:123"},
+		{"1.2.3.4, 1.2.3.4, 5.6.7.8", true, "5.6.7.8:123"},
+		{"2001:DB8::1, 2001:db8::1", true, "[2001:DB8::1]:123"},
+		{"1.2.3.4, 4.5.0.2, 4.5.0.3, 4.5.0.2, 4.5.0.3, 4.5.0.2", true, ""},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.DedupeChain = test.dedupe
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPLimits(t *testing.T) {
+	for i, test := range []struct {
+		maxHops        int
+		maxHeaderBytes int
+		strict         bool
+		headerVal      string
+		expectedIP     string
+	}{
+		{5, 16, false, "1.2.3.4, 4.5.6.7", "1.2.3.4:123"},
+		{5, 15, false, "1.2.3.4, 4.5.6.7", "4.5.0.1:123"},
+		{5, 15, true, "1.2.3.4, 4.5.6.7", ""},
+		{2, 0, false, "1.2.3.4, 4.5.6.7", "1.2.3.4:123"},
+		{2, 0, false, "1.2.3.4, 4.5.6.7,", ""},
+		{-1, 0, false, strings.Repeat("4.5.6.7,", 5000) + "4.5.6.7", "4.5.6.7:123"},
+		{5, 0, false, strings.Repeat(",", 5000), ""},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.MaxHops = test.maxHops
+		he.MaxHeaderBytes = test.maxHeaderBytes
+		he.Strict = test.strict
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n header X-Forwarded-For\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxHops != defaultMaxHops {
+		t.Errorf("Expected default MaxHops of %d, but found %d", defaultMaxHops, m.MaxHops)
+	}
+}
+
+func TestRealIPHeaders(t *testing.T) {
+	for i, test := range []struct {
+		headers    http.Header
+		strict     bool
+		expectedIP string
+	}{
+		{http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}, "X-Forwarded-For": {"5.6.7.8"}}, false, "1.2.3.4:123"},
+		{http.Header{"X-Forwarded-For": {"5.6.7.8"}, "X-Real-Ip": {"9.9.9.9"}}, false, "5.6.7.8:123"},
+		{http.Header{"Cf-Connecting-Ip": {"NOTANIP"}, "X-Real-Ip": {"9.9.9.9"}}, false, "9.9.9.9:123"},
+		{http.Header{"Cf-Connecting-Ip": {"NOTANIP"}}, false, "4.5.0.1:123"},
+		{http.Header{"Cf-Connecting-Ip": {"NOTANIP"}}, true, ""},
+		{http.Header{"X-Forwarded-For": {"1.2.3.4, 111.111.111.111"}, "X-Real-Ip": {"9.9.9.9"}}, false, "111.111.111.111:123"},
+		{http.Header{}, true, "4.5.0.1:123"},
+
+		// repeated header lines are merged in order before walking the chain
+		{http.Header{"X-Forwarded-For": {"1.2.3.4", "4.5.6.7"}}, false, "1.2.3.4:123"},
+		{http.Header{"X-Forwarded-For": {"1.2.3.4, 5.6.7.8", "4.5.6.7"}}, false, "5.6.7.8:123"},
+		{http.Header{"X-Forwarded-For": {"1.2.3.4,4.5.0.1,4.5.0.2", "4.5.0.3,4.5.0.4,4.5.0.5"}}, false, ""},
+	} {
+		he := newTestModule(t)
+		he.Headers = []string{"CF-Connecting-IP", "X-Forwarded-For", "X-Real-IP"}
+		he.Strict = test.strict
+
+		remoteAddr := serveTestHeaders(t, i, he, "4.5.0.1:123", test.headers)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n headers CF-Connecting-IP X-Forwarded-For\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(m.Headers) != "[CF-Connecting-IP X-Forwarded-For]" {
+		t.Errorf("Expected headers to be parsed in order, but found %v", m.Headers)
+	}
+}
+
+func TestRealIPSingleValue(t *testing.T) {
+	for i, test := range []struct {
+		actualIP   string
+		headerVal  string
+		strict     bool
+		expectedIP string
+	}{
+		{"4.5.0.1:123", "1.2.3.4", false, "1.2.3.4:123"},
+		{"4.5.0.1:123", " 2001:db8::1 ", false, "[2001:db8::1]:123"},
+		{"4.5.0.1:123", "1.2.3.4, 4.5.0.2", false, "4.5.0.1:123"},
+		{"4.5.0.1:123", "1.2.3.4, 4.5.0.2", true, ""},
+		{"4.5.0.1:123", "1.2.3.4,5.6.7.8,4.5.0.2,4.5.0.3,4.5.0.4,4.5.0.5", false, "4.5.0.1:123"},
+		{"4.5.0.1:123", "NOTANIP", false, "4.5.0.1:123"},
+		{"8.8.8.8:123", "1.2.3.4", false, "8.8.8.8:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Real-IP"
+		he.SingleValue = []string{"x-real-ip"}
+		he.Strict = test.strict
+
+		remoteAddr := serveTest(t, i, he, test.actualIP, test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPKnownSingleValue(t *testing.T) {
+	for i, test := range []struct {
+		header     string
+		headerVal  string
+		expectedIP string
+	}{
+		{"X-Azure-ClientIP", "1.2.3.4", "1.2.3.4:123"},
+		{"X-Azure-ClientIP", "2001:db8::1", "[2001:db8::1]:123"},
+		{"X-Azure-ClientIP", "1.2.3.4, 4.5.0.2", "4.5.0.1:123"},
+		{"Fastly-Client-IP", "1.2.3.4", "1.2.3.4:123"},
+		{"fastly-client-ip", "1.2.3.4, 4.5.0.2", "4.5.0.1:123"},
+		{"True-Client-IP", "1.2.3.4, 4.5.0.2", "4.5.0.1:123"},
+		{"X-Sucuri-ClientIP", "2001:db8::1", "[2001:db8::1]:123"},
+		{"EO-Client-IP", "1.2.3.4, 4.5.0.2", "4.5.0.1:123"},
+		{"Fly-Client-IP", "1.2.3.4", "1.2.3.4:123"},
+		{"X-Nf-Client-Connection-Ip", "1.2.3.4, 4.5.0.2", "4.5.0.1:123"},
+		{"X-Forwarded-For", "1.2.3.4, 4.5.0.2", "1.2.3.4:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = test.header
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPExtract(t *testing.T) {
+	for i, test := range []struct {
+		headerVal  string
+		strict     bool
+		expectedIP string
+	}{
+		{`addr="1.2.3.4"; port=443`, false, "1.2.3.4:123"},
+		{`addr="[2001:db8::1]:8080"; port=443`, false, "[2001:db8::1]:123"},
+		{`addr="1.2.3.4", addr="4.5.0.2"`, false, "1.2.3.4:123"},
+		{`addr="1.2.3.4", addr="5.6.7.8"`, false, "5.6.7.8:123"},
+		{`port=443`, false, "4.5.0.1:123"},
+		{`port=443`, true, ""},
+		{`addr="NOTANIP"`, false, "4.5.0.1:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded"
+		re, err := compileExtract(`addr="([^"]+)"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		he.Extract = []headerExtract{{Header: "X-Forwarded", re: re}}
+		he.Strict = test.strict
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n extract X-Client client=(\\S+)\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Extract) != 1 || m.Extract[0].Header != "X-Client" || m.Extract[0].Pattern != `client=(\S+)` {
+		t.Errorf("Unexpected extractions: %v", m.Extract)
+	}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n extract X-Client client=\\S+\n}")); err == nil {
+		t.Errorf("Expected an error for a pattern without capture group")
+	}
+}
+
+func TestRealIPPseudoIPv4(t *testing.T) {
+	for i, test := range []struct {
+		headers        http.Header
+		expectedIP     string
+		expectedPseudo string
+	}{
+		{http.Header{"Cf-Connecting-Ip": {"240.16.0.1"}, "Cf-Connecting-Ipv6": {"2001:db8::1"}}, "[2001:db8::1]:123", "240.16.0.1"},
+		{http.Header{"Cf-Connecting-Ip": {"240.16.0.1"}}, "4.5.0.1:123", ""},
+		{http.Header{"Cf-Connecting-Ip": {"240.16.0.1"}, "Cf-Connecting-Ipv6": {"1.2.3.4"}}, "4.5.0.1:123", ""},
+		{http.Header{"Cf-Connecting-Ip": {"240.16.0.1"}, "X-Real-Ip": {"5.6.7.8"}}, "5.6.7.8:123", ""},
+		{http.Header{"Cf-Connecting-Ip": {"2001:db8::1"}, "Cf-Pseudo-Ipv4": {"240.16.0.1"}}, "[2001:db8::1]:123", "240.16.0.1"},
+		{http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}, "Cf-Pseudo-Ipv4": {"1.2.3.5"}}, "1.2.3.4:123", ""},
+	} {
+		he := newTestModule(t)
+		he.Headers = []string{"CF-Connecting-IP", "X-Real-IP"}
+		he.PseudoIPv4 = true
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "4.5.0.1:123"
+		req.Header = test.headers
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		var remoteAddr string
+		he.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			remoteAddr = r.RemoteAddr
+			return nil
+		}))
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+		if pseudo := repl.ReplaceAll("{http.realip.pseudo_ipv4}", ""); pseudo != test.expectedPseudo {
+			t.Errorf("Test %d: Expected pseudo IPv4 '%s', but found '%s'", i, test.expectedPseudo, pseudo)
+		}
+	}
+}
+
+func TestRealIPCloudFront(t *testing.T) {
+	for i, test := range []struct {
+		headerVal     string
+		forwardedPort bool
+		expectedIP    string
+	}{
+		{"1.2.3.4:46532", false, "1.2.3.4:123"},
+		{"1.2.3.4:46532", true, "1.2.3.4:46532"},
+		{"2001:db8:3333:4444:5555:6666:7777:8888:46532", true, "[2001:db8:3333:4444:5555:6666:7777:8888]:46532"},
+		{"2001:db8::1:46532", true, "[2001:db8::1]:46532"},
+		{"2001:db8::1:443", true, "[2001:db8::1]:443"},
+		{"[2001:db8::1]:46532", true, "[2001:db8::1]:46532"},
+		{"1.2.3.4", true, "1.2.3.4:123"},
+		{"1.2.3.4:1, 5.6.7.8:2", true, "4.5.0.1:123"},
+		{"NOTANIP:46532", true, "4.5.0.1:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "CloudFront-Viewer-Address"
+		he.ForwardedPort = test.forwardedPort
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPBindings(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	cloudflare, err := parseCidrs(0, presets["cloudflare"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		actualIP   string
+		headers    http.Header
+		expectedIP string
+	}{
+		{"173.245.48.1:123", http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}}, "1.2.3.4:123"},
+		{"10.1.2.3:123", http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}}, "10.1.2.3:123"},
+		{"10.1.2.3:123", http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}, "X-Forwarded-For": {"5.6.7.8"}}, "5.6.7.8:123"},
+		{"173.245.48.1:123", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "173.245.48.1:123"},
+		{"10.1.2.3:123", http.Header{"X-Forwarded-For": {"5.6.7.8, 173.245.48.1"}}, "173.245.48.1:123"},
+		{"4.5.0.1:123", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "4.5.0.1:123"},
+		{"4.5.0.1:123", http.Header{"X-Real-Ip": {"5.6.7.8"}}, "5.6.7.8:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Real-IP"
+		he.Bindings = []headerBinding{
+			{Header: "CF-Connecting-IP", From: cloudflare},
+			{Header: "X-Forwarded-For", From: []*net.IPNet{internal}},
+		}
+
+		remoteAddr := serveTestHeaders(t, i, he, test.actualIP, test.headers)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n bind CF-Connecting-IP cloudflare\n bind X-Forwarded-For 10.0.0.0/8\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Bindings) != 2 || len(m.Bindings[0].From) != len(cloudflare) || m.Bindings[1].From[0].String() != "10.0.0.0/8" {
+		t.Errorf("Unexpected bindings: %v", m.Bindings)
+	}
+}
+
+func TestRealIPBindingOverrides(t *testing.T) {
+	_, cdn, _ := net.ParseCIDR("173.245.48.0/20")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	for i, test := range []struct {
+		actualIP   string
+		headers    http.Header
+		expectedIP string
+	}{
+		{"173.245.48.1:123", http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}}, "1.2.3.4:123"},
+		{"173.245.48.1:123", http.Header{"Cf-Connecting-Ip": {"1.2.3.4, 5.6.7.8"}}, ""},
+		{"10.1.2.3:123", http.Header{"X-Forwarded-For": {"1.2.3.4, 10.2.0.1"}}, "1.2.3.4:123"},
+		{"10.1.2.3:123", http.Header{"X-Forwarded-For": {"1.2.3.4, 10.3.0.1, 10.2.0.1"}}, ""},
+		{"4.5.0.1:123", http.Header{"X-Real-Ip": {"1.2.3.4, 5.6.7.8, 9.10.11.12"}}, "9.10.11.12:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Real-IP"
+		he.Bindings = []headerBinding{
+			{Header: "CF-Connecting-IP", MaxHops: 1, sources: []IPSource{fixedSource{cdn}}},
+			{Header: "X-Forwarded-For", MaxHops: 2, From: []*net.IPNet{internal}},
+		}
+
+		remoteAddr := serveTestHeaders(t, i, he, test.actualIP, test.headers)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n bind CF-Connecting-IP {\n source cloudflare 6h\n max_hops 1\n }\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Bindings) != 1 || m.Bindings[0].MaxHops != 1 || len(m.Bindings[0].Sources) != 1 || string(m.Bindings[0].Sources[0]) != `{"Refresh":21600000000000,"URL":"","source":"cloudflare"}` {
+		t.Errorf("Unexpected bindings: %v", m.Bindings)
+	}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n bind CF-Connecting-IP\n}")); err == nil {
+		t.Errorf("Expected an error for a binding without ranges or sources")
+	}
+}
+
+func TestRealIPBindingSecret(t *testing.T) {
+	m := &module{MaxHops: 5}
+	err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n bind True-Client-IP 0.0.0.0/0 {\n secret X-True-Client-IP-Key s3cr3t\n }\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		headers    http.Header
+		strict     bool
+		expectedIP string
+	}{
+		{http.Header{"True-Client-Ip": {"1.2.3.4"}, "X-True-Client-Ip-Key": {"s3cr3t"}}, false, "1.2.3.4:123"},
+		{http.Header{"True-Client-Ip": {"1.2.3.4"}, "X-True-Client-Ip-Key": {"wrong"}}, false, "8.8.8.8:123"},
+		{http.Header{"True-Client-Ip": {"1.2.3.4"}}, false, "8.8.8.8:123"},
+		{http.Header{"True-Client-Ip": {"1.2.3.4"}}, true, ""},
+	} {
+		m.Strict = test.strict
+		remoteAddr := serveTestHeaders(t, i, m, "8.8.8.8:123", test.headers)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+// testParser reads a space-separated chain from the X-Test-Chain header.
+type testParser struct{}
+
+func (testParser) Parse(req *http.Request) ([]string, error) {
+	val := req.Header.Get("X-Test-Chain")
+	if val == "bad" {
+		return nil, errors.New("malformed chain")
+	}
+	return strings.Fields(val), nil
+}
+
+func TestRealIPParsers(t *testing.T) {
+	for i, test := range []struct {
+		headers    http.Header
+		strict     bool
+		expectedIP string
+	}{
+		{http.Header{"X-Test-Chain": {"1.2.3.4"}}, false, "1.2.3.4:123"},
+		{http.Header{"X-Test-Chain": {"1.2.3.4 4.5.0.2"}}, false, "1.2.3.4:123"},
+		{http.Header{"X-Test-Chain": {"1.2.3.4 5.6.7.8"}}, false, "5.6.7.8:123"},
+		{http.Header{"X-Test-Chain": {"1.2.3.4"}, "X-Real-Ip": {"9.9.9.9"}}, false, "9.9.9.9:123"},
+		{http.Header{"X-Test-Chain": {"bad"}}, false, "4.5.0.1:123"},
+		{http.Header{"X-Test-Chain": {"bad"}}, true, ""},
+		{http.Header{}, true, "4.5.0.1:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Real-IP"
+		he.Strict = test.strict
+		he.parsers = []Parser{testParser{}}
+
+		remoteAddr := serveTestHeaders(t, i, he, "4.5.0.1:123", test.headers)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPStrategy(t *testing.T) {
+	for i, test := range []struct {
+		strategy    string
+		trustedHops int
+		headerVal   string
+		strict      bool
+		expectedIP  string
+	}{
+		{"", 0, "1.2.3.4, 5.6.7.8", false, "5.6.7.8:123"},
+		{"", 0, "1.2.3.4, 5.6.7.8", true, ""},
+		{"rightmost_untrusted", 0, "1.2.3.4, 5.6.7.8", true, "5.6.7.8:123"},
+		{"rightmost_untrusted", 0, "1.2.3.4, 4.5.0.2", true, "1.2.3.4:123"},
+		{"rightmost_untrusted", 0, "4.5.0.3, 4.5.0.2", true, "4.5.0.3:123"},
+		{"rightmost_untrusted", 0, "NOTANIP, 5.6.7.8, 4.5.0.2", true, "5.6.7.8:123"},
+		{"rightmost_untrusted", 0, "1.2.3.4, NOTANIP, 4.5.0.2", false, "4.5.0.1:123"},
+		{"", 1, "1.2.3.4, 5.6.7.8", true, "5.6.7.8:123"},
+		{"", 2, "1.2.3.4, 5.6.7.8", true, "1.2.3.4:123"},
+		{"", 2, "1.2.3.4, 5.6.7.8, 9.9.9.9", true, "5.6.7.8:123"},
+		{"", 3, "1.2.3.4, 5.6.7.8", false, "4.5.0.1:123"},
+		{"", 2, "NOTANIP, 5.6.7.8", false, "4.5.0.1:123"},
+		{"leftmost_public", 0, "10.0.0.1, 1.2.3.4, 5.6.7.8", true, "1.2.3.4:123"},
+		{"leftmost_public", 0, "NOTANIP, 192.168.1.1, fd00::1, 2606:4700::1", true, "[2606:4700::1]:123"},
+		{"leftmost_public", 0, "127.0.0.1, 10.0.0.1", false, "4.5.0.1:123"},
+		{"default", 0, "1.2.3.4, 5.6.7.8", true, ""},
+		{"first", 0, "1.2.3.4, 5.6.7.8, 4.5.0.2", true, "1.2.3.4:123"},
+		{"first", 0, "NOTANIP, 5.6.7.8", false, "4.5.0.1:123"},
+		{"last", 0, "1.2.3.4, 5.6.7.8, 4.5.0.2", true, "4.5.0.2:123"},
+		{"trusted_hops", 2, "1.2.3.4, 5.6.7.8, 9.9.9.9", true, "5.6.7.8:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.Strategy = test.strategy
+		he.TrustedHops = test.trustedHops
+		he.Strict = test.strict
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	for i, test := range []struct {
+		input string
+		valid bool
+	}{
+		{"strategy rightmost_untrusted", true},
+		{"strategy trusted_hops 2", true},
+		{"strategy trusted_hops", false},
+		{"strategy last 2", false},
+		{"trusted_hops 2", true},
+		{"strategy middle", false},
+	} {
+		m := &module{}
+		err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n "+test.input+"\n}"))
+		if err == nil {
+			err = m.Validate()
+		}
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: Expected valid %v, but got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestRealIPRequireTrustedChain(t *testing.T) {
+	for i, test := range []struct {
+		strategy   string
+		headerVal  string
+		expectedIP string
+	}{
+		{"", "1.2.3.4, 4.5.0.2", "1.2.3.4:123"},
+		{"", "1.2.3.4, 5.6.7.8, 4.5.0.2", ""},
+		{"", "1.2.3.4", "1.2.3.4:123"},
+		{"first", "1.2.3.4, 5.6.7.8, 4.5.0.2", ""},
+		{"first", "1.2.3.4, 4.5.0.3, 4.5.0.2", "1.2.3.4:123"},
+		{"rightmost_untrusted", "1.2.3.4, 5.6.7.8, 4.5.0.2", "5.6.7.8:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.Strategy = test.strategy
+		he.RequireTrustedChain = true
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestRealIPExcept(t *testing.T) {
+	_, source, _ := net.ParseCIDR("10.0.0.0/8")
+	for i, test := range []struct {
+		actualIP   string
+		headerVal  string
+		expectedIP string
+	}{
+		{"4.5.0.1:123", "1.2.3.4", "1.2.3.4:123"},
+		{"4.5.9.1:123", "1.2.3.4", "4.5.9.1:123"},
+		{"4.5.0.1:123", "1.2.3.4, 4.5.9.1", "4.5.9.1:123"},
+		{"10.0.0.1:123", "1.2.3.4", "1.2.3.4:123"},
+		{"10.44.0.1:123", "1.2.3.4", "10.44.0.1:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.sources = []IPSource{fixedSource{source}}
+		for _, cidr := range []string{"4.5.9.0/24", "10.44.0.0/16"} {
+			_, except, _ := net.ParseCIDR(cidr)
+			he.Except = append(he.Except, except)
+		}
+		he.applyExcept()
+
+		remoteAddr := serveTest(t, i, he, test.actualIP, test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestAdminRanges(t *testing.T) {
+	defer overrides.state.Store(overrideState{})
+	he := newTestModule(t)
+	he.Header = "X-Forwarded-For"
+	_, source, _ := net.ParseCIDR("10.0.0.0/8")
+	he.sources = []IPSource{fixedSource{source}}
+	he.sourceNames = []string{"fixed"}
+	registerHandler(he)
+	defer unregisterHandler(he)
+
+	var api adminAPI
+	for i, test := range []struct {
+		method     string
+		target     string
+		body       string
+		actualIP   string
+		expectedIP string
+	}{
+		{"GET", "/realip/ranges", "", "192.0.2.1:123", "192.0.2.1:123"},
+		{"POST", "/realip/ranges", `{"range": "192.0.2.0/24"}`, "192.0.2.1:123", "1.2.3.4:123"},
+		{"DELETE", "/realip/ranges?range=10.1.0.0/16", "", "10.1.0.1:123", "10.1.0.1:123"},
+		{"GET", "/realip/ranges", "", "10.2.0.1:123", "1.2.3.4:123"},
+		{"DELETE", "/realip/ranges", `{"range": "192.0.2.0/24"}`, "192.0.2.1:123", "192.0.2.1:123"},
+		{"POST", "/realip/ranges?range=10.1.0.0/16", "", "10.1.0.1:123", "1.2.3.4:123"},
+		{"POST", "/realip/ranges", `{"range": "invalid"}`, "10.1.0.1:123", "1.2.3.4:123"},
+	} {
+		req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		err := api.handleRanges(httptest.NewRecorder(), req)
+		if (err != nil) != (test.body == `{"range": "invalid"}`) {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+		}
+		remoteAddr := serveTest(t, i, he, test.actualIP, "1.2.3.4")
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	overrides.revoke([]*net.IPNet{source})
+	rec := httptest.NewRecorder()
+	if err := api.handleRanges(rec, httptest.NewRequest("GET", "/realip/ranges", nil)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"handlers":[[{"range":"4.5.0.0/16","source":"from"}]],"added":["10.1.0.0/16"],"revoked":["192.0.2.0/24","10.0.0.0/8"]}`
+	if actual := strings.TrimSpace(rec.Body.String()); actual != expected {
+		t.Errorf("Expected '%s', but found '%s'", expected, actual)
+	}
+
+	overrides.add([]*net.IPNet{source, hostRange(net.ParseIP("10.9.9.9"))})
+	rec = httptest.NewRecorder()
+	if err := api.handleTrusted(rec, httptest.NewRequest("GET", "/realip/trusted", nil)); err != nil {
+		t.Fatal(err)
+	}
+	expected = `[{"ranges":[{"range":"4.5.0.0/16","source":"from"},{"range":"10.0.0.0/8","source":"fixed"}],"overlaps":[{"range":"10.0.0.0/8","source":"admin","covered_by":"10.0.0.0/8","covered_by_source":"fixed"},{"range":"10.1.0.0/16","source":"admin","covered_by":"10.0.0.0/8","covered_by_source":"fixed"},{"range":"10.9.9.9/32","source":"admin","covered_by":"10.0.0.0/8","covered_by_source":"fixed"}]}]`
+	if actual := strings.TrimSpace(rec.Body.String()); actual != expected {
+		t.Errorf("Expected '%s', but found '%s'", expected, actual)
+	}
+}
+
+func TestExpandFrom(t *testing.T) {
+	os.Setenv("REALIP_TEST_PROXIES", "10.0.0.0/8, 192.168.0.0/16\n172.16.0.0/12")
+	os.Setenv("REALIP_TEST_PRESET", "gcp")
+	os.Setenv("REALIP_TEST_INVALID", "10.0.0.0/33")
+	defer os.Unsetenv("REALIP_TEST_PROXIES")
+	defer os.Unsetenv("REALIP_TEST_PRESET")
+	defer os.Unsetenv("REALIP_TEST_INVALID")
+
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"from 4.5.0.0/16 {env.REALIP_TEST_PROXIES}", "[4.5.0.0/16 10.0.0.0/8 192.168.0.0/16 172.16.0.0/12]"},
+		{"from {env.REALIP_TEST_PRESET}", "[130.211.0.0/22 35.191.0.0/16]"},
+		{"from {env.REALIP_TEST_UNSET}", "[]"},
+		{"from {env.REALIP_TEST_INVALID}", "error"},
+	} {
+		m := &module{}
+		if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n "+test.input+"\n}")); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		actual := "error"
+		if err := m.expandFrom(); err == nil {
+			actual = fmt.Sprint(m.From)
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestFromHosts(t *testing.T) {
+	m := &module{}
+	if err := m.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n from 10.0.0.0/8 localhost 192.0.2.1\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if actual := fmt.Sprint(m.FromHosts); actual != "[localhost]" {
+		t.Errorf("Expected '[localhost]', but found '%s'", actual)
+	}
+	if err := m.expandFrom(); err != nil {
+		t.Fatal(err)
+	}
+	if !containsIP(m.From, net.ParseIP("127.0.0.1")) || !containsIP(m.From, net.ParseIP("192.0.2.1")) || containsIP(m.From, net.ParseIP("192.0.2.2")) {
+		t.Errorf("Unexpected ranges %s", m.From)
+	}
+
+	m = &module{FromHosts: []string{"proxy.invalid"}}
+	if err := m.expandFrom(); err == nil {
+		t.Errorf("Expected an error for a host name that doesn't resolve")
+	}
+}
+
+func TestExcludeRanges(t *testing.T) {
+	for i, test := range []struct {
+		ranges   []string
+		except   []string
+		expected string
+	}{
+		{[]string{"10.0.0.0/8"}, []string{"10.44.0.0/16"}, "[10.128.0.0/9 10.64.0.0/10 10.0.0.0/11 10.48.0.0/12 10.32.0.0/13 10.40.0.0/14 10.46.0.0/15 10.45.0.0/16]"},
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.0/9"}, "[10.128.0.0/9]"},
+		{[]string{"10.0.0.0/8", "192.168.0.0/16"}, []string{"10.0.0.0/8"}, "[192.168.0.0/16]"},
+		{[]string{"10.44.1.0/24"}, []string{"10.44.0.0/16"}, "[]"},
+		{[]string{"10.0.0.0/8"}, []string{"172.16.0.0/12", "2001:db8::/32"}, "[10.0.0.0/8]"},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8:8000::/33"}, "[2001:db8::/33]"},
+		{[]string{"192.0.2.0/30"}, []string{"192.0.2.1/32", "192.0.2.2/32"}, "[192.0.2.3/32 192.0.2.0/32]"},
+	} {
+		ranges, err := parseRanges(test.ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		except, err := parseRanges(test.except)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprint(excludeRanges(ranges, except)); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestCompileRanges(t *testing.T) {
+	for i, test := range []struct {
+		ranges   []string
+		sources  []string
+		expected string
+		overlaps string
+	}{
+		{[]string{"192.168.0.0/16", "10.0.0.0/8"}, []string{"from", "from"}, "[10.0.0.0/8 192.168.0.0/16]", "[]"},
+		{[]string{"10.1.0.0/16", "2001:db8::/32", "10.0.0.0/8"}, []string{"from", "from", "aws"}, "[10.0.0.0/8 2001:db8::/32]", "[{10.1.0.0/16 from 10.0.0.0/8 aws}]"},
+		{[]string{"10.0.0.0/8", "10.0.0.0/8", "10.2.3.4/32"}, []string{"from", "url", "admin"}, "[10.0.0.0/8]", "[{10.0.0.0/8 url 10.0.0.0/8 from} {10.2.3.4/32 admin 10.0.0.0/8 from}]"},
+		{[]string{"2001:db8::1/128", "192.0.2.1/32", "2001:db8::/64"}, []string{"dns", "dns", "from"}, "[192.0.2.1/32 2001:db8::/64]", "[{2001:db8::1/128 dns 2001:db8::/64 from}]"},
+	} {
+		var entries []trustEntry
+		for j, r := range test.ranges {
+			_, ipnet, err := net.ParseCIDR(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, trustEntry{ipnet: ipnet, source: test.sources[j]})
+		}
+		kept, overlaps := compileRanges(entries)
+		var ranges []*net.IPNet
+		for _, e := range kept {
+			ranges = append(ranges, e.ipnet)
+		}
+		if actual := fmt.Sprint(ranges); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		if actual := fmt.Sprint(overlaps); actual != test.overlaps && !(overlaps == nil && test.overlaps == "[]") {
+			t.Errorf("Test %d: Expected overlaps '%s', but found '%s'", i, test.overlaps, actual)
+		}
+	}
+}
+
+func TestRealIPFallback(t *testing.T) {
+	for i, test := range []struct {
+		input      string
+		headerVal  string
+		expectedIP string
+	}{
+		{"strict true", "NOTANIP", ""},
+		{"fallback keep\n strict true", "NOTANIP", "4.5.0.1:123"},
+		{"fallback reject", "NOTANIP", ""},
+		{"fallback reject 400", "1.2.3.4, NOTANIP", ""},
+		{"fallback sentinel 192.0.2.1", "NOTANIP", "192.0.2.1:123"},
+		{"fallback sentinel ::", "unknown", "[::]:123"},
+		{"fallback sentinel 192.0.2.1", "1.2.3.4", "1.2.3.4:123"},
+		{"fallback reject", "", "4.5.0.1:123"},
+	} {
+		he := newTestModule(t)
+		if err := he.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n header X-Forwarded-For\n "+test.input+"\n}")); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if err := he.Validate(); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+
+		remoteAddr := serveTest(t, i, he, "4.5.0.1:123", test.headerVal)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+
+	for i, input := range []string{"fallback sentinel", "fallback sentinel nowhere", "fallback reject 302", "fallback keep 1", "fallback maybe"} {
+		he := newTestModule(t)
+		err := he.UnmarshalCaddyfile(newTestDispenser(t, "realip {\n "+input+"\n}"))
+		if err == nil {
+			err = he.Validate()
+		}
+		if err == nil {
+			t.Errorf("Test %d: Expected an error for %q", i, input)
+		}
+	}
+}
+
+func TestRealIPInstances(t *testing.T) {
+	_, github, _ := net.ParseCIDR("140.82.112.0/20")
+	for i, test := range []struct {
+		actualIP   string
+		headers    http.Header
+		expectedIP string
+	}{
+		{"4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4:123"},
+		{"140.82.112.1:123", http.Header{"X-Hub-Client": {"5.6.7.8"}}, "5.6.7.8:123"},
+		{"4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Hub-Client": {"5.6.7.8"}}, "1.2.3.4:123"},
+		{"8.8.8.8:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "8.8.8.8:123"},
+	} {
+		site := newTestModule(t)
+		site.Header = "X-Forwarded-For"
+		route := &module{Header: "X-Hub-Client", MaxHops: 5, From: []*net.IPNet{github}}
+
+		var seen string
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			seen = r.RemoteAddr
+			return nil
+		})
+		req, err := http.NewRequest("GET", "/webhooks/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.actualIP
+		req.Header = test.headers
+
+		site.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return route.ServeHTTP(w, r, next)
+		}))
+		if seen != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, seen)
+		}
+	}
+}
+
+func TestRealIPVia(t *testing.T) {
+	for i, test := range []struct {
+		mode       string
+		tolerance  int
+		headers    http.Header
+		expectedIP string
+	}{
+		{"reject", 0, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7"}, "Via": {"1.1 a, 1.1 b"}}, "1.2.3.4:123"},
+		{"reject", 0, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7"}, "Via": {"1.1 a", "1.1 b (x, y)"}}, "1.2.3.4:123"},
+		{"reject", 0, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7"}, "Via": {"1.1 a"}}, ""},
+		{"reject", 1, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7"}, "Via": {"1.1 a"}}, "1.2.3.4:123"},
+		{"reject", 1, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7, 4.5.6.8"}, "Via": {"1.1 a"}}, ""},
+		{"log", 0, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7"}}, "1.2.3.4:123"},
+		{"", 0, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.6.7"}}, "1.2.3.4:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.Via = test.mode
+		he.ViaTolerance = test.tolerance
+
+		remoteAddr := serveTestHeaders(t, i, he, "4.5.0.1:123", test.headers)
+		if remoteAddr != test.expectedIP {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
+		}
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	for i, test := range []struct {
+		strip    bool
+		keep     []string
+		expected string
+	}{
+		{false, nil, "[Cf-Connecting-Ip Forwarded Secret Via X-Custom-Ip X-Forwarded-For X-Forwarded-Proto X-Real-Ip]"},
+		{true, nil, "[Via X-Forwarded-Proto]"},
+		{true, []string{"x-real-ip", "X-Custom-IP"}, "[Via X-Custom-Ip X-Forwarded-Proto X-Real-Ip]"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Custom-IP"
+		he.Bindings = []headerBinding{{Header: "X-Forwarded-For", From: he.From, SecretHeader: "Secret", Secret: "s3cr3t"}}
+		he.StripHeaders = test.strip
+		he.KeepHeaders = test.keep
+
+		req := serveTestRequest(t, i, he, "4.5.0.1:123", http.Header{
+			"X-Forwarded-For":   {"1.2.3.4"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Custom-Ip":       {"5.6.7.8"},
+			"X-Real-Ip":         {"5.6.7.8"},
+			"Cf-Connecting-Ip":  {"5.6.7.8"},
+			"Forwarded":         {"for=5.6.7.8"},
+			"Via":               {"1.1 proxy"},
+			"Secret":            {"s3cr3t"},
+		})
+		if req.RemoteAddr != "1.2.3.4:123" {
+			t.Errorf("Test %d: Expected '1.2.3.4:123', but found '%s'", i, req.RemoteAddr)
+		}
+		var names []string
+		for name := range req.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != test.expected {
+			t.Errorf("Test %d: Expected headers %s, but found %v", i, test.expected, names)
+		}
+	}
+}
+
+func TestRewriteXFF(t *testing.T) {
+	for i, test := range []struct {
+		mode      string
+		actualIP  string
+		headerVal string
+		expected  string
+	}{
+		{"", "4.5.0.1:123", "1.2.3.4, 4.5.6.7", ""},
+		{"client", "4.5.0.1:123", "1.2.3.4, 4.5.6.7", "1.2.3.4"},
+		{"chain", "4.5.0.1:123", "9.9.9.9, 1.2.3.4, 4.5.6.7", "1.2.3.4, 4.5.6.7"},
+		{"chain", "4.5.0.1:123", "[2001:db8::1]:443, 4.5.6.7:80", "2001:db8::1, 4.5.6.7"},
+		{"client", "8.8.8.8:123", "1.2.3.4", "8.8.8.8"},
+		{"chain", "8.8.8.8:123", "1.2.3.4", "8.8.8.8"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.RewriteXFF = test.mode
+		he.StripHeaders = true
+
+		req := serveTestRequest(t, i, he, test.actualIP, http.Header{"X-Forwarded-For": {test.headerVal}})
+		if xff := req.Header.Get("X-Forwarded-For"); xff != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, xff)
+		}
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	for i, test := range []struct {
+		matcher   string
+		actualIP  string
+		headerVal string
+		expected  string
+	}{
+		{"realip_from 1.2.3.0/24", "4.5.0.1:123", "1.2.3.4", "true"},
+		{"realip_from 1.2.3.0/24", "1.2.3.4:123", "", "true"},
+		{"realip_from 4.5.0.0/16", "4.5.0.1:123", "1.2.3.4", "false"},
+		{"realip_from 10.0.0.0/8 cloudflare", "4.5.0.1:123", "173.245.48.1", "true"},
+		{"realip_from 2001:db8::1", "4.5.0.1:123", "[2001:db8::1]:443", "true"},
+		{"realip_from", "", "", "error"},
+		{"realip_from 10.0.0.0/33", "", "", "error"},
+	} {
+		var m matchFrom
+		if err := m.UnmarshalCaddyfile(newTestDispenser(t, test.matcher)); err != nil {
+			if test.expected != "error" {
+				t.Errorf("Test %d: failed while parsing: '%s'; got '%v'", i, test.matcher, err)
+			}
+			continue
+		}
+		if err := m.Provision(caddy.Context{}); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		req := serveTestRequest(t, i, he, test.actualIP, http.Header{"X-Forwarded-For": {test.headerVal}})
+		if actual := fmt.Sprint(m.Match(req)); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	for i, test := range []struct {
+		rule     string
+		actualIP string
+		headers  http.Header
+		expected string
+	}{
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n set_header X-Client-IP\n}", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n set_header X-Client-IP with_port\n}", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"2001:db8::1"}}, "[2001:db8::1]:123"},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n set_header X-Client-IP\n}", "8.8.8.8:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Client-IP": {"1.2.3.4"}}, "8.8.8.8"},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n strip_headers\n set_header X-Client-IP\n}", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"realip {\n set_header X-Client-IP port\n}", "", nil, "error"},
+	} {
+		he := &module{}
+		if err := he.UnmarshalCaddyfile(newTestDispenser(t, test.rule)); err != nil {
+			if test.expected != "error" {
+				t.Errorf("Test %d: failed while parsing: '%s'; got '%v'", i, test.rule, err)
+			}
+			continue
+		}
+
+		req := serveTestRequest(t, i, he, test.actualIP, test.headers)
+		if actual := req.Header.Get("X-Client-IP"); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestOriginalHeader(t *testing.T) {
+	for i, test := range []struct {
+		rule     string
+		header   string
+		actualIP string
+		headers  http.Header
+		expected string
+	}{
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n original_header\n}", "X-Original-Remote-Addr", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "4.5.0.1:123"},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n original_header X-Edge-Addr\n}", "X-Edge-Addr", "[2001:db8::2]:443", http.Header{"X-Edge-Addr": {"1.2.3.4"}}, "[2001:db8::2]:443"},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n}", "X-Original-Remote-Addr", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, ""},
+		{"realip {\n original_header a b\n}", "", "", nil, "error"},
+	} {
+		he := &module{}
+		if err := he.UnmarshalCaddyfile(newTestDispenser(t, test.rule)); err != nil {
+			if test.expected != "error" {
+				t.Errorf("Test %d: failed while parsing: '%s'; got '%v'", i, test.rule, err)
+			}
+			continue
+		}
+
+		req := serveTestRequest(t, i, he, test.actualIP, test.headers)
+		if actual := req.Header.Get(test.header); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	for i, test := range []struct {
+		rule     string
+		actualIP string
+		headers  http.Header
+		expected string
+	}{
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n strip_headers\n log_fields\n}", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.0.2"}}, "4.5.0.1:123 1.2.3.4 GET foo.tld / X-Forwarded-For 1.2.3.4, 4.5.0.2"},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n log_fields\n}", "8.8.8.8:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "8.8.8.8:123 8.8.8.8 GET foo.tld /  "},
+		{"realip {\n from 4.5.0.0/16\n header X-Forwarded-For\n}", "4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, ""},
+	} {
+		he := &module{}
+		if err := he.UnmarshalCaddyfile(newTestDispenser(t, test.rule)); err != nil {
+			t.Fatalf("Test %d: failed while parsing: '%s'; got '%v'", i, test.rule, err)
+		}
+		core, logs := observer.New(zap.InfoLevel)
+		he.logger = zap.New(core)
+
+		serveTestRequest(t, i, he, test.actualIP, test.headers)
+		actual := ""
+		for _, entry := range logs.All() {
+			fields := entry.ContextMap()
+			actual = fmt.Sprintf("%v %v %v %v %v %v %v", fields["original_remote_addr"], fields["client_ip"], fields["method"], fields["host"], fields["uri"], fields["header"], fields["header_value"])
+			actual = strings.ReplaceAll(actual, "<nil>", "")
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestAppendHop(t *testing.T) {
+	for i, test := range []struct {
+		actualIP          string
+		headers           http.Header
+		expectedXFF       string
+		expectedForwarded string
+	}{
+		{"4.5.0.1:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4, 4.5.0.1", "for=4.5.0.1;proto=http"},
+		{"8.8.8.8:123", http.Header{"X-Forwarded-For": {"1.2.3.4"}, "Forwarded": {"for=1.2.3.4"}}, "1.2.3.4, 8.8.8.8", "for=1.2.3.4, for=8.8.8.8;proto=http"},
+		{"[2001:db8::1]:123", http.Header{}, "2001:db8::1", `for="[2001:db8::1]";proto=http`},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.AppendXFF = true
+		he.AppendForwarded = true
+
+		req := serveTestRequest(t, i, he, test.actualIP, test.headers)
+		if xff := req.Header.Get("X-Forwarded-For"); xff != test.expectedXFF {
+			t.Errorf("Test %d: Expected X-Forwarded-For '%s', but found '%s'", i, test.expectedXFF, xff)
+		}
+		if fwd := req.Header.Get("Forwarded"); fwd != test.expectedForwarded {
+			t.Errorf("Test %d: Expected Forwarded '%s', but found '%s'", i, test.expectedForwarded, fwd)
+		}
+	}
+}
+
+func TestForwardedInfo(t *testing.T) {
+	for i, test := range []struct {
+		actualIP       string
+		skipPrivate    bool
+		headers        http.Header
+		expectedScheme string
+		expectedHost   string
+	}{
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"example.com"}}, "https", "example.com"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-Proto": {"http, HTTPS"}, "X-Forwarded-Host": {"example.com:8443"}}, "https", "example.com:8443"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.0.2"}, "X-Forwarded-Proto": {"https, http"}, "X-Forwarded-Host": {"example.com, internal.lan"}}, "https", "example.com"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4"}, "X-Forwarded-Proto": {"http", "https"}, "X-Forwarded-Host": {"evil.com", "example.com"}}, "https", "example.com"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-For": {"1.2.3.4, 4.5.0.2"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"example.com"}}, "", "foo.tld"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"http, https"}, "X-Forwarded-Host": {"evil.com, example.com"}}, "", "foo.tld"},
+		{"4.5.0.1:123", true, http.Header{"X-Forwarded-For": {"1.2.3.4, 10.0.0.1, 4.5.0.2"}, "X-Forwarded-Proto": {"https, http, http"}, "X-Forwarded-Host": {"example.com, internal.lan, internal.lan"}}, "https", "example.com"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-Host": {"example.com"}, "X-Forwarded-Port": {"8443"}}, "", "example.com:8443"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-Port": {"8443"}}, "", "foo.tld:8443"},
+		{"4.5.0.1:123", false, http.Header{"X-Forwarded-Proto": {"gopher"}, "X-Forwarded-Host": {"evil.com/path"}}, "", "foo.tld"},
+		{"8.8.8.8:123", false, http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"example.com"}}, "", "foo.tld"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.TrustProto, he.TrustHost, he.TrustPort = true, true, true
+		he.SkipPrivate = test.skipPrivate
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "foo.tld"
+		req.RemoteAddr = test.actualIP
+		req.Header = test.headers
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		he.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			req = r
+			return nil
+		}))
+		if req.URL.Scheme != test.expectedScheme || req.Host != test.expectedHost {
+			t.Errorf("Test %d: Expected %s://%s, but found %s://%s", i, test.expectedScheme, test.expectedHost, req.URL.Scheme, req.Host)
+		}
+		if scheme := repl.ReplaceAll("{http.request.scheme}", ""); test.expectedScheme != "" && scheme != test.expectedScheme {
+			t.Errorf("Test %d: Expected scheme placeholder '%s', but found '%s'", i, test.expectedScheme, scheme)
+		}
+		if hostport := repl.ReplaceAll("{http.request.hostport}", ""); hostport != test.expectedHost {
+			t.Errorf("Test %d: Expected hostport placeholder '%s', but found '%s'", i, test.expectedHost, hostport)
+		}
+	}
+}
+
+func TestForwardedPlaceholders(t *testing.T) {
+	for i, test := range []struct {
+		forwarded string
+		expected  string
+	}{
+		{`for=1.2.3.4;by=4.5.0.1;proto=https;host=example.com`, "1.2.3.4 4.5.0.1 https example.com"},
+		{`for=1.2.3.4;proto=http, for=4.5.0.2;by="[2001:db8::1]";proto=https;host=example.com`, "1.2.3.4  http "},
+		{`for=1.2.3.4;proto=http, for=5.6.7.8;by=4.5.0.2;proto=https`, "5.6.7.8 4.5.0.2 https "},
+		{``, "   "},
+	} {
+		he := newTestModule(t)
+		he.Header = "Forwarded"
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "4.5.0.1:123"
+		if test.forwarded != "" {
+			req.Header.Set("Forwarded", test.forwarded)
+		}
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		he.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		actual := repl.ReplaceAll("{http.realip.forwarded.for} {http.realip.forwarded.by} {http.realip.forwarded.proto} {http.realip.forwarded.host}", "")
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestAddressPlaceholders(t *testing.T) {
+	for i, test := range []struct {
+		actualIP  string
+		headerVal string
+		expected  string
+	}{
+		{"4.5.0.1:123", "1.2.3.4", "1.2.3.4 4.5.0.1:123"},
+		{"4.5.0.1:123", "2001:db8::1", "2001:db8::1 4.5.0.1:123"},
+		{"4.5.0.1:123", "", "4.5.0.1 4.5.0.1:123"},
+		{"1.2.3.4:123", "5.6.7.8", "1.2.3.4 1.2.3.4:123"},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+
+		req, err := http.NewRequest("GET", "/", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.RemoteAddr = test.actualIP
+		if test.headerVal != "" {
+			req.Header.Set(he.Header, test.headerVal)
+		}
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
 
-		he := &module{
-			next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
-				remoteAddr = r.RemoteAddr
-				return 0, nil
-			}),
-			Header:  "X-Real-IP",
-			MaxHops: 5,
-			From:    []*net.IPNet{ipnet},
+		he.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		actual := repl.ReplaceAll("{http.realip.client_ip} {http.realip.original_remote}", "")
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
 		}
+	}
+}
+
+func TestOriginalVars(t *testing.T) {
+	for i, test := range []struct {
+		actualIP  string
+		headerVal string
+		expected  string
+	}{
+		{"4.5.0.1:123", "1.2.3.4, 4.5.0.2", "4.5.0.1:123 X-Forwarded-For 1.2.3.4, 4.5.0.2"},
+		{"4.5.0.1:123", "", "4.5.0.1:123  "},
+		{"1.2.3.4:123", "5.6.7.8", "1.2.3.4:123  "},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.StripHeaders = true
 
-		req, err := http.NewRequest("GET", "http://foo.tld/", nil)
+		req, err := http.NewRequest("GET", "/", nil)
 		if err != nil {
-			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+			t.Fatal(err)
 		}
 		req.RemoteAddr = test.actualIP
 		if test.headerVal != "" {
-			req.Header.Set("X-Real-IP", test.headerVal)
+			req.Header.Set(he.Header, test.headerVal)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{})))
+
+		var original string
+		he.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			original = OriginalRemoteAddr(r)
+			req = r
+			return nil
+		}))
+		actual := fmt.Sprintf("%v %v %v", caddyhttp.GetVar(req.Context(), varOriginalRemoteAddr), caddyhttp.GetVar(req.Context(), varHeader), caddyhttp.GetVar(req.Context(), varHeaderValue))
+		actual = strings.ReplaceAll(actual, "<nil>", "")
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+		if original != test.actualIP {
+			t.Errorf("Test %d: Expected original address '%s', but found '%s'", i, test.actualIP, original)
+		}
+	}
+}
+
+func TestChainPlaceholder(t *testing.T) {
+	for i, test := range []struct {
+		strategy  string
+		headerVal string
+		expected  string
+	}{
+		{"", "1.2.3.4, 4.5.0.2", "1.2.3.4 (client, untrusted), 4.5.0.2 (trusted), 4.5.0.1 (trusted)"},
+		{"", "4.5.0.3", "4.5.0.3 (client, trusted), 4.5.0.1 (trusted)"},
+		{"first", "1.2.3.4, 5.6.7.8, 4.5.0.2", "1.2.3.4 (client, untrusted), 5.6.7.8 (untrusted), 4.5.0.2 (trusted), 4.5.0.1 (trusted)"},
+		{"", "", ""},
+	} {
+		he := newTestModule(t)
+		he.Header = "X-Forwarded-For"
+		he.Strategy = test.strategy
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "4.5.0.1:123"
+		if test.headerVal != "" {
+			req.Header.Set(he.Header, test.headerVal)
+		}
+		repl := caddyhttp.NewTestReplacer(req)
+		ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+		req = req.WithContext(context.WithValue(ctx, caddyhttp.VarsCtxKey, make(map[string]interface{})))
+
+		he.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		if actual := repl.ReplaceAll("{http.realip.chain}", ""); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
 		}
+		chain, _ := caddyhttp.GetVar(req.Context(), varChain).([]chainHop)
+		if test.expected != "" && len(chain) != strings.Count(test.expected, "(") {
+			t.Errorf("Test %d: Expected %d hops in the chain var, but found %v", i, strings.Count(test.expected, "("), chain)
+		}
+	}
+}
 
-		rec := httptest.NewRecorder()
-		he.ServeHTTP(rec, req)
+func TestParseForwarded(t *testing.T) {
+	for i, test := range []struct {
+		value    string
+		expected []forwardedElement
+		err      bool
+	}{
+		{`for=192.0.2.43`, []forwardedElement{{For: "192.0.2.43"}}, false},
+		{`for="_gazonk"`, []forwardedElement{{For: "_gazonk"}}, false},
+		{`For="[2001:db8:cafe::17]:4711"`, []forwardedElement{{For: "[2001:db8:cafe::17]:4711"}}, false},
+		{`for=192.0.2.60;proto=http;by=203.0.113.43`, []forwardedElement{{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"}}, false},
+		{`for=192.0.2.43, for=198.51.100.17`, []forwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17"}}, false},
+		{`for="a,b;c";host="ex\"ample"`, []forwardedElement{{For: "a,b;c", Host: `ex"ample`}}, false},
+		{`,for=192.0.2.43,,`, []forwardedElement{{For: "192.0.2.43"}}, false},
+		{`for="192.0.2.43`, nil, true},
+		{`192.0.2.43`, nil, true},
+	} {
+		result, err := parseForwarded(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Expected error %v, but got %v", i, test.err, err)
+			continue
+		}
+		if fmt.Sprint(result) != fmt.Sprint(test.expected) {
+			t.Errorf("Test %d: Expected %v, but found %v", i, test.expected, result)
+		}
+	}
+}
 
+func TestPlatform(t *testing.T) {
+	for i, test := range []struct {
+		rule       string
+		actualIP   string
+		headerVal  string
+		expectedIP string
+	}{
+		{"realip {\n platform render\n}", "10.214.3.5:123", "1.2.3.4, 5.6.7.8", "5.6.7.8:123"},
+		{"realip {\n platform render\n}", "10.214.3.5:123", "2001:db8::1", "[2001:db8::1]:123"},
+		{"realip {\n platform render\n}", "10.214.3.5:123", "", "10.214.3.5:123"},
+		{"realip {\n platform heroku\n header X-Real-IP\n}", "10.1.2.3:123", "1.2.3.4", "1.2.3.4:123"},
+		{"realip {\n header X-Client-Chain\n platform heroku\n}", "10.1.2.3:123", "1.2.3.4, 5.6.7.8", "5.6.7.8:123"},
+		{"realip {\n strategy first\n platform render\n}", "10.214.3.5:123", "1.2.3.4, 5.6.7.8", "1.2.3.4:123"},
+		{"realip {\n platform render\n strategy first\n}", "10.214.3.5:123", "1.2.3.4, 5.6.7.8", "1.2.3.4:123"},
+		{"realip {\n platform ngrok\n}", "127.0.0.1:123", "1.2.3.4, 5.6.7.8", "5.6.7.8:123"},
+		{"realip {\n platform ngrok\n}", "10.0.0.5:123", "1.2.3.4", "10.0.0.5:123"},
+		{"realip {\n platform ngrok\n from 10.0.0.5\n}", "10.0.0.5:123", "1.2.3.4", "1.2.3.4:123"},
+		{"realip {\n platform fly\n}", "", "", "error"},
+	} {
+		m := &module{}
+		if err := m.UnmarshalCaddyfile(newTestDispenser(t, test.rule)); err != nil {
+			if test.expectedIP != "error" {
+				t.Errorf("Test %d: failed while parsing: '%s'; got '%v'", i, test.rule, err)
+			}
+			continue
+		}
+		remoteAddr := serveTest(t, i, m, test.actualIP, test.headerVal)
 		if remoteAddr != test.expectedIP {
 			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expectedIP, remoteAddr)
 		}
 	}
 }
 
+func TestPresetHeader(t *testing.T) {
+	for i, test := range []struct {
+		rule     string
+		expected string
+	}{
+		{"realip {\n from cloudflare\n}", "CF-Connecting-IP"},
+		{"realip {\n from private fastly\n}", "Fastly-Client-IP"},
+		{"realip {\n from cloudflare cloudflare_china\n}", "CF-Connecting-IP"},
+		{"realip {\n from cloudflare\n header X-Forwarded-For\n}", "X-Forwarded-For"},
+		{"realip {\n header X-Real-IP\n from fly\n}", "X-Real-IP"},
+		{"realip {\n from cloudfront gcp\n}", ""},
+		{"realip {\n from private\n bind CF-Connecting-IP cloudflare\n}", ""},
+		{"realip {\n from cloudflare fastly\n}", "error"},
+		{"realip {\n from cloudflare fastly\n header X-Forwarded-For\n}", "X-Forwarded-For"},
+	} {
+		m := &module{}
+		err := m.UnmarshalCaddyfile(newTestDispenser(t, test.rule))
+		actual := m.Header
+		if err != nil {
+			actual = "error"
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', but found '%s'", i, test.expected, actual)
+		}
+	}
+}
+
 func TestCidrAndPresets(t *testing.T) {
 	tests := []struct {
 		rule     string
 		presets  []string
 		expected []string
 	}{
-		{"cloudflare", []string{"cloudflare"}, nil},
-		{"gcp", []string{"gcp"}, nil},
-		{"rackspace", []string{"rackspace"}, nil},
-		{"cloudflare rackspace gcp", []string{"cloudflare", "gcp", "rackspace"}, nil},
-		{"cloudflare { from 1.2.3.4/32\n}", []string{"cloudflare"}, []string{"1.2.3.4/32"}},
-		{"{ from gcp 1.2.3.4/32\n}", []string{"gcp"}, []string{"1.2.3.4/32"}},
-		{"{ from gcp rackspace\n}", []string{"gcp", "rackspace"}, nil},
-		{"{ from gcp\n from rackspace\n}", []string{"gcp", "rackspace"}, nil},
-		{"{ from rackspace\n from 1.2.3.4/32\n}", []string{"rackspace"}, []string{"1.2.3.4/32"}},
-		{"{ from 1.2.3.4/32 5.6.7.8/32\n}", nil, []string{"1.2.3.4/32", "5.6.7.8/32"}},
+		{"realip {\n from cloudflare\n}", []string{"cloudflare"}, nil},
+		{"realip {\n from cloudflare 1.2.3.4/32\n}", []string{"cloudflare"}, []string{"1.2.3.4/32"}},
+		{"realip {\n from cloudflare\n from 1.2.3.4/32\n}", []string{"cloudflare"}, []string{"1.2.3.4/32"}},
+		{"realip {\n from gcp\n}", []string{"gcp"}, nil},
+		{"realip {\n from cloudflare gcp\n}", []string{"cloudflare", "gcp"}, nil},
+		{"realip {\n from gcp 1.2.3.4/32\n}", []string{"gcp"}, []string{"1.2.3.4/32"}},
+		{"realip {\n from gcp\n from cloudflare\n}", []string{"gcp", "cloudflare"}, nil},
+		{"realip {\n from 1.2.3.4/32 5.6.7.8/32\n}", nil, []string{"1.2.3.4/32", "5.6.7.8/32"}},
+		{"realip {\n from 1.2.3.4 2001:db8::1\n}", nil, []string{"1.2.3.4/32", "2001:db8::1/128"}},
+		{"realip {\n from cloudfront\n}", []string{"cloudfront"}, nil},
+		{"realip {\n from cloudflare cloudflare_china\n}", []string{"cloudflare", "cloudflare_china"}, nil},
+		{"realip {\n from ngrok\n}", []string{"ngrok"}, nil},
+		{"realip {\n from gcp_lb\n}", []string{"gcp_lb"}, nil},
+		{"realip {\n from zscaler 10.0.0.0/8\n}", []string{"zscaler"}, []string{"10.0.0.0/8"}},
+		{"realip {\n from azure_frontdoor\n}", []string{"azure_frontdoor"}, nil},
+		{"realip {\n from akamai\n}", []string{"akamai"}, nil},
+		{"realip {\n from sucuri\n}", []string{"sucuri"}, nil},
+		{"realip {\n from cachefly\n}", []string{"cachefly"}, nil},
+		{"realip {\n from gcore\n}", []string{"gcore"}, nil},
+		{"realip {\n from quic_cloud\n}", []string{"quic_cloud"}, nil},
+		{"realip {\n from arvancloud\n}", []string{"arvancloud"}, nil},
+		{"realip {\n from tencent_edgeone\n}", []string{"tencent_edgeone"}, nil},
+		{"realip {\n from scaleway\n}", []string{"scaleway"}, nil},
+		{"realip {\n from fly\n}", []string{"fly"}, nil},
+		{"realip {\n from private\n}", []string{"private"}, nil},
+		{"realip {\n from loopback private\n}", []string{"loopback", "private"}, nil},
+		{"realip {\n from cgnat\n}", []string{"cgnat"}, nil},
+		{"realip {\n from link_local\n}", []string{"link_local"}, nil},
+		{"realip {\n from uptimerobot pingdom statuscake\n}", []string{"uptimerobot", "pingdom", "statuscake"}, nil},
+		{"realip {\n from azure_appgw 10.225.0.0/24\n}", []string{"azure_appgw"}, []string{"10.225.0.0/24"}},
 	}
 	for i, test := range tests {
-		c := caddy.NewTestController("http", test.rule)
 		m := &module{}
-		err := parse(m, c)
+		err := m.UnmarshalCaddyfile(newTestDispenser(t, test.rule))
 		if err != nil {
 			t.Fatalf("Test %d: failed while parsing: '%s'; got '%v'", i, test.rule, err)
 		}
@@ -126,6 +1536,69 @@ func TestCidrAndPresets(t *testing.T) {
 	}
 }
 
+// newTestModule returns a module trusting 4.5.0.0/16 with a MaxHops of 5.
+func newTestModule(t *testing.T) *module {
+	_, ipnet, err := net.ParseCIDR("4.5.0.0/16") // "4.5.x.x"
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &module{
+		MaxHops: 5,
+		From:    []*net.IPNet{ipnet},
+	}
+}
+
+// serveTest runs a request from actualIP through he, setting the
+// configured header to headerVal if it is not empty, and returns the
+// RemoteAddr seen by the next handler. It returns an empty string if the
+// next handler was not called.
+func serveTest(t *testing.T, i int, he *module, actualIP, headerVal string) string {
+	headers := http.Header{}
+	if headerVal != "" {
+		headers.Set(he.Header, headerVal)
+	}
+	return serveTestHeaders(t, i, he, actualIP, headers)
+}
+
+// serveTestHeaders is like serveTest, but sends the given request headers.
+func serveTestHeaders(t *testing.T, i int, he *module, actualIP string, headers http.Header) string {
+	if req := serveTestRequest(t, i, he, actualIP, headers); req != nil {
+		return req.RemoteAddr
+	}
+	return ""
+}
+
+// serveTestRequest is like serveTestHeaders, but returns the request seen
+// by the next handler, or nil if it was not called.
+func serveTestRequest(t *testing.T, i int, he *module, actualIP string, headers http.Header) *http.Request {
+	var seen *http.Request
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		seen = r
+		return nil
+	})
+
+	req, err := http.NewRequest("GET", "http://foo.tld/", nil)
+	if err != nil {
+		t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+	}
+	req.RequestURI = "/"
+	req.RemoteAddr = actualIP
+	req.Header = headers
+
+	rec := httptest.NewRecorder()
+	he.ServeHTTP(rec, req, next)
+	return seen
+}
+
+// newTestDispenser returns a dispenser for the first directive in input.
+func newTestDispenser(t *testing.T, input string) *caddyfile.Dispenser {
+	blocks, err := caddyfile.Parse("Testfile", []byte(":80 {\n"+input+"\n}"))
+	if err != nil {
+		t.Fatalf("Could not parse %q: %v", input, err)
+	}
+	return caddyfile.NewDispenser(blocks[0].Segments[0])
+}
+
 func parseCidrs(i int, values []string) ([]*net.IPNet, error) {
 	var cidrs []*net.IPNet
 	for _, value := range values {
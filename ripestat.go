@@ -0,0 +1,176 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// ripestatURL is RIPEstat's announced prefixes API.
+const ripestatURL = "https://stat.ripe.net/data/announced-prefixes/data.json"
+
+// ripestatSource trusts the prefixes that autonomous systems announce in
+// BGP, as seen by RIPEstat, for ASN-scoped trust without an ASN database.
+// RIPEstat reports the prefixes announced during the last two weeks.
+type ripestatSource struct {
+	// ASNs are the numbers of the trusted autonomous systems.
+	ASNs []uint
+
+	// URL overrides the location of the API.
+	URL string
+
+	// Refresh is the interval between fetches. The default is 24h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	fetchers  map[uint]*httpFetcher
+	ranges    map[uint][]*net.IPNet
+}
+
+// ripestatPrefixes is the format of the announced prefixes API.
+type ripestatPrefixes struct {
+	Status string `json:"status"`
+	Data   struct {
+		Prefixes []struct {
+			Prefix string `json:"prefix"`
+		} `json:"prefixes"`
+	} `json:"data"`
+}
+
+func init() {
+	caddy.RegisterModule(ripestatSource{})
+}
+
+func (ripestatSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.ripestat",
+		New: func() caddy.Module {
+			return new(ripestatSource)
+		},
+	}
+}
+
+func (s *ripestatSource) Provision(ctx caddy.Context) error {
+	if len(s.ASNs) == 0 {
+		return fmt.Errorf("missing AS numbers")
+	}
+	if s.URL == "" {
+		s.URL = ripestatURL
+	}
+	s.fetchers = make(map[uint]*httpFetcher)
+	s.ranges = make(map[uint][]*net.IPNet)
+	for _, asn := range s.ASNs {
+		fetcher := newHTTPFetcher(0)
+		s.fetchers[asn] = &fetcher
+	}
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = 24 * time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch fetches the prefixes of all autonomous systems. It fails if any of
+// them fails, so that a partial list doesn't replace a complete one.
+func (s *ripestatSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	var all []*net.IPNet
+	for _, asn := range s.ASNs {
+		query := url.Values{"resource": {fmt.Sprintf("AS%d", asn)}}
+		ranges, err := s.fetchers[asn].get(ctx, s.URL+"?"+query.Encode(), parseRIPEstat, s.ranges[asn])
+		if err != nil {
+			return nil, err
+		}
+		s.ranges[asn] = ranges
+		all = append(all, ranges...)
+	}
+	return all, nil
+}
+
+// parseRIPEstat returns the prefixes of an announced prefixes response.
+func parseRIPEstat(r io.Reader) ([]*net.IPNet, error) {
+	var doc ripestatPrefixes
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Status != "ok" {
+		return nil, fmt.Errorf("status %q", doc.Status)
+	}
+	if len(doc.Data.Prefixes) == 0 {
+		return nil, fmt.Errorf("no announced prefixes")
+	}
+	prefixes := make([]string, len(doc.Data.Prefixes))
+	for i, p := range doc.Data.Prefixes {
+		prefixes[i] = p.Prefix
+	}
+	return parseCIDRs(prefixes)
+}
+
+func (s *ripestatSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *ripestatSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	ripestat <numbers...> {
+//	    url <url>
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *ripestatSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	for d.NextArg() {
+		n, err := parseASN(d.Val())
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+		s.ASNs = append(s.ASNs, n)
+	}
+	if len(s.ASNs) == 0 {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown ripestat source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*ripestatSource)(nil)
+	_ caddy.Provisioner     = (*ripestatSource)(nil)
+	_ caddy.CleanerUpper    = (*ripestatSource)(nil)
+	_ caddyfile.Unmarshaler = (*ripestatSource)(nil)
+)
@@ -0,0 +1,141 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// X-Forwarded-For rewrite modes
+const (
+	rewriteClient = "client"
+	rewriteChain  = "chain"
+)
+
+// defaultOriginalHeader is the header original_header sets by default.
+const defaultOriginalHeader = "X-Original-Remote-Addr"
+
+// forwardHeaders are well-known headers carrying client or proxy addresses.
+var forwardHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded",
+	"Forwarded-For",
+	"X-Real-IP",
+	"X-Client-IP",
+	"Client-IP",
+	"X-Cluster-Client-IP",
+	"True-Client-IP",
+	"CF-Connecting-IP",
+	"CF-Connecting-IPv6",
+	"Cf-Pseudo-IPv4",
+	"Fastly-Client-IP",
+	"CloudFront-Viewer-Address",
+	"X-Azure-ClientIP",
+	"X-Azure-SocketIP",
+	"X-Sucuri-ClientIP",
+	"EO-Client-IP",
+	"Fly-Client-IP",
+	"X-Nf-Client-Connection-Ip",
+}
+
+// stripHeaders removes the configured and well-known forward headers from
+// req, except for those in KeepHeaders.
+func (m *module) stripHeaders(req *http.Request) {
+	if !m.StripHeaders {
+		return
+	}
+	keep := make(map[string]bool, len(m.KeepHeaders))
+	for _, header := range m.KeepHeaders {
+		keep[http.CanonicalHeaderKey(header)] = true
+	}
+	strip := func(header string) {
+		if header != "" && !keep[http.CanonicalHeaderKey(header)] {
+			req.Header.Del(header)
+		}
+	}
+	for _, header := range forwardHeaders {
+		strip(header)
+	}
+	for _, binding := range m.headerBindings() {
+		strip(binding.Header)
+		strip(binding.SecretHeader)
+	}
+}
+
+// rewriteXFF replaces X-Forwarded-For with the client address, followed by
+// the trusted proxies from res in "chain" mode. If the request was not
+// resolved, the peer itself is the client.
+func (m *module) rewriteXFF(req *http.Request, res *resolution) {
+	if m.RewriteXFF == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	xff := []string{host}
+	if res != nil && m.RewriteXFF == rewriteChain {
+		for _, proxy := range res.Chain[res.Client+1:] {
+			xff = append(xff, proxy.Host)
+		}
+	}
+	req.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+}
+
+// setClientHeader sets SetHeader to the client address, with its port if
+// SetHeaderPort is set.
+func (m *module) setClientHeader(req *http.Request) {
+	if m.SetHeader == "" {
+		return
+	}
+	value := req.RemoteAddr
+	if !m.SetHeaderPort {
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			value = host
+		}
+	}
+	req.Header.Set(m.SetHeader, value)
+}
+
+// setOriginalHeader sets OriginalHeader to peer, the address the request
+// was received from.
+func (m *module) setOriginalHeader(req *http.Request, peer string) {
+	if m.OriginalHeader != "" {
+		req.Header.Set(m.OriginalHeader, peer)
+	}
+}
+
+// appendHop adds peer, the address the request was received from, to
+// X-Forwarded-For and Forwarded as configured.
+func (m *module) appendHop(req *http.Request, peer string) {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	if m.AppendXFF {
+		appendHeader(req.Header, "X-Forwarded-For", host)
+	}
+	if m.AppendForwarded {
+		node := host
+		if strings.Contains(host, ":") {
+			node = `"[` + host + `]"`
+		}
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		appendHeader(req.Header, forwardedHeader, "for="+node+";proto="+proto)
+	}
+}
+
+// appendHeader adds value to the last line of a comma-separated header, or
+// sets the header if it isn't present.
+func appendHeader(h http.Header, name, value string) {
+	values := h.Values(name)
+	if len(values) == 0 {
+		h.Set(name, value)
+		return
+	}
+	values[len(values)-1] += ", " + value
+}
@@ -0,0 +1,235 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// defaultSPFDepth limits include chains like the SPF lookup limit does.
+const defaultSPFDepth = 10
+
+// spfSource trusts the ranges published in SPF-style TXT records, such as
+// _spf.google.com, following include: and redirect= chains. Only the ip4:
+// and ip6: mechanisms that pass are used; a, mx and the like are ignored.
+type spfSource struct {
+	// Domains are the names whose records are expanded.
+	Domains []string
+
+	// Resolvers are the DNS servers to query, as host:port. The default is
+	// the servers in /etc/resolv.conf.
+	Resolvers []string
+
+	// MaxDepth limits how deep include chains are followed. The default
+	// is 10.
+	MaxDepth int
+
+	// Refresh is the interval between expansions. The default is 1h.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *dns.Client
+}
+
+func init() {
+	caddy.RegisterModule(spfSource{})
+}
+
+func (spfSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.spf",
+		New: func() caddy.Module {
+			return new(spfSource)
+		},
+	}
+}
+
+func (s *spfSource) Provision(ctx caddy.Context) error {
+	if len(s.Domains) == 0 {
+		return fmt.Errorf("missing domains")
+	}
+	if len(s.Resolvers) == 0 {
+		resolvers, err := systemResolvers()
+		if err != nil {
+			return err
+		}
+		s.Resolvers = resolvers
+	}
+	if s.MaxDepth == 0 {
+		s.MaxDepth = defaultSPFDepth
+	}
+	s.client = new(dns.Client)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch expands all domains. It fails if any of them can't be expanded
+// completely, so that a partial list doesn't replace a complete one.
+func (s *spfSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	seen := make(map[string]bool)
+	for _, domain := range s.Domains {
+		expanded, err := s.expand(ctx, domain, 0, seen)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, expanded...)
+	}
+	return ranges, nil
+}
+
+// expand returns the ranges of the SPF record of domain and of the records
+// it includes. Domains already in seen are skipped, which breaks loops.
+func (s *spfSource) expand(ctx context.Context, domain string, depth int, seen map[string]bool) ([]*net.IPNet, error) {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	if seen[domain] {
+		return nil, nil
+	}
+	if depth > s.MaxDepth {
+		return nil, fmt.Errorf("%s: includes nested deeper than %d", domain, s.MaxDepth)
+	}
+	seen[domain] = true
+
+	record, err := s.lookup(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []*net.IPNet
+	for _, term := range strings.Fields(record)[1:] {
+		lower := strings.ToLower(term)
+		if strings.HasPrefix(lower, "redirect=") {
+			expanded, err := s.expand(ctx, term[len("redirect="):], depth+1, seen)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, expanded...)
+			continue
+		}
+		switch lower[0] {
+		case '-', '~', '?':
+			continue
+		case '+':
+			term, lower = term[1:], lower[1:]
+		}
+		i := strings.IndexByte(lower, ':')
+		if i < 0 {
+			continue
+		}
+		switch lower[:i] {
+		case "ip4", "ip6":
+			value := term[i+1:]
+			if !strings.Contains(value, "/") {
+				ip := net.ParseIP(value)
+				if ip == nil {
+					return nil, fmt.Errorf("%s: invalid address %s", domain, value)
+				}
+				ranges = append(ranges, hostRange(ip))
+				continue
+			}
+			_, cidr, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", domain, err)
+			}
+			ranges = append(ranges, cidr)
+		case "include":
+			expanded, err := s.expand(ctx, term[i+1:], depth+1, seen)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, expanded...)
+		}
+	}
+	return ranges, nil
+}
+
+// lookup returns the SPF record of domain. The strings of a TXT record are
+// joined without spaces.
+func (s *spfSource) lookup(ctx context.Context, domain string) (string, error) {
+	answer, err := exchange(ctx, s.client, s.Resolvers, domain, dns.TypeTXT)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		record := strings.Join(txt.Txt, "")
+		if fields := strings.Fields(record); len(fields) > 0 && strings.EqualFold(fields[0], "v=spf1") {
+			return record, nil
+		}
+	}
+	return "", fmt.Errorf("no SPF record found for %s", domain)
+}
+
+func (s *spfSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *spfSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	spf <domains...> {
+//	    resolvers <addresses...>
+//	    max_depth <n>
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *spfSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	s.Domains = append(s.Domains, d.RemainingArgs()...)
+	if len(s.Domains) == 0 {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "resolvers":
+			s.Resolvers = append(s.Resolvers, d.RemainingArgs()...)
+			if len(s.Resolvers) == 0 {
+				err = d.ArgErr()
+			}
+		case "max_depth":
+			err = parseIntArg(d, &s.MaxDepth)
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown spf source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*spfSource)(nil)
+	_ caddy.Provisioner     = (*spfSource)(nil)
+	_ caddy.CleanerUpper    = (*spfSource)(nil)
+	_ caddyfile.Unmarshaler = (*spfSource)(nil)
+)
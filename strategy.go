@@ -0,0 +1,155 @@
+package realip
+
+import "net"
+
+// Client selection strategies
+const (
+	// strategyDefault walks the chain from the right as long as the hops
+	// are trusted, and reports an untrusted hop as errUntrustedHop.
+	strategyDefault = "default"
+
+	// strategyFirst picks the leftmost address. It is controlled by the
+	// client and therefore spoofable.
+	strategyFirst = "first"
+
+	// strategyLast picks the rightmost address, the one the nearest proxy
+	// received the request from.
+	strategyLast = "last"
+
+	// strategyRightmostUntrusted walks the chain from the right, skipping
+	// trusted proxies, and picks the first untrusted address, like nginx
+	// with real_ip_recursive on.
+	strategyRightmostUntrusted = "rightmost_untrusted"
+
+	// strategyTrustedHops picks the address a fixed number of hops from the
+	// right, regardless of the trusted ranges.
+	strategyTrustedHops = "trusted_hops"
+
+	// strategyLeftmostPublic picks the first public address from the left.
+	// It trusts whatever the client put into the header and is therefore
+	// trivially spoofable; it only exists so that migrations from stacks
+	// with client-first semantics behave identically.
+	strategyLeftmostPublic = "leftmost_public"
+)
+
+// selectClient returns the index of the client address in parts according
+// to the configured strategy. The default strategy returns errUntrustedHop
+// along with the index of the first untrusted hop if the chain is not
+// trusted up to the client.
+func (m *module) selectClient(parts []hop, from []*net.IPNet) (int, error) {
+	switch m.Strategy {
+	case strategyFirst:
+		return nthFromRight(parts, len(parts))
+	case strategyLast:
+		return nthFromRight(parts, 1)
+	case strategyRightmostUntrusted:
+		return rightmostUntrusted(parts, from)
+	case strategyTrustedHops:
+		return nthFromRight(parts, m.TrustedHops)
+	case strategyLeftmostPublic:
+		return leftmostPublic(parts)
+	}
+	if m.TrustedHops > 0 {
+		return nthFromRight(parts, m.TrustedHops)
+	}
+	return trustedWalk(parts, from)
+}
+
+// trustedWalk walks parts from the right as long as the hops are in from.
+// It returns the index of the leftmost address if the whole chain is
+// trusted, or the index of the first untrusted hop with errUntrustedHop. An
+// obfuscated identifier ends the walk at the proxy that reported it.
+func trustedWalk(parts []hop, from []*net.IPNet) (int, error) {
+	for i := len(parts) - 1; i >= 0; i-- {
+		if isObfuscated(parts[i].Host) && i < len(parts)-1 {
+			return i + 1, errUntrustedHop
+		}
+		if net.ParseIP(parts[i].Host) == nil {
+			return 0, errNoAddress
+		}
+		if i > 0 && !validSource(from, parts[i].Host) {
+			return i, errUntrustedHop
+		}
+	}
+	return 0, nil
+}
+
+// nonPublicRanges are private, shared, loopback, link-local, documentation,
+// benchmarking and reserved address ranges, which never identify a client
+// on the internet.
+var nonPublicRanges = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipnet
+	}
+	return nets
+}
+
+// isPublic reports whether host is a valid, publicly routable address.
+func isPublic(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsMulticast() && !containsIP(nonPublicRanges, ip)
+}
+
+// rightmostUntrusted returns the index of the rightmost address in parts
+// that is not in from, or of the leftmost address if all of them are.
+// Unlike the default walk, an untrusted hop is the expected outcome rather
+// than an error, and entries left of the client are never inspected.
+func rightmostUntrusted(parts []hop, from []*net.IPNet) (int, error) {
+	for i := len(parts) - 1; i >= 0; i-- {
+		if net.ParseIP(parts[i].Host) == nil {
+			return 0, errNoAddress
+		}
+		if !validSource(from, parts[i].Host) {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+// nthFromRight returns the index of the nth address from the right of
+// parts, ignoring the trusted ranges. It returns errNoAddress if the chain
+// is shorter or the address is not valid.
+func nthFromRight(parts []hop, n int) (int, error) {
+	i := len(parts) - n
+	if i < 0 || net.ParseIP(parts[i].Host) == nil {
+		return 0, errNoAddress
+	}
+	return i, nil
+}
+
+// leftmostPublic returns the index of the leftmost public address in parts,
+// without regard to the trusted ranges. Anyone can prepend addresses to a
+// forward header, so the result is controlled by the client.
+func leftmostPublic(parts []hop) (int, error) {
+	for i, part := range parts {
+		if isPublic(part.Host) {
+			return i, nil
+		}
+	}
+	return 0, errNoAddress
+}
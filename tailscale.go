@@ -0,0 +1,310 @@
+package realip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+const (
+	// tailscaleSocket is where tailscaled serves its local API on Linux.
+	tailscaleSocket = "/var/run/tailscale/tailscaled.sock"
+
+	// tailscaleAPI is the base URL of Tailscale's public API.
+	tailscaleAPI = "https://api.tailscale.com"
+)
+
+// tailscaleSource trusts the Tailscale addresses of the tailnet nodes that
+// proxy to Caddy, selected by ACL tag or host name, instead of the whole
+// 100.64.0.0/10 range every node shares. The nodes are listed through the
+// local tailscaled's API or, with an API key, through Tailscale's API.
+type tailscaleSource struct {
+	// Tags selects the nodes with one of these ACL tags, e.g. "tag:proxy".
+	Tags []string
+
+	// Hosts selects the nodes with one of these host names or MagicDNS
+	// names.
+	Hosts []string
+
+	// Socket is the path of tailscaled's socket. The default is
+	// /var/run/tailscale/tailscaled.sock.
+	Socket string
+
+	// APIKey uses Tailscale's API instead of the local one, e.g. when
+	// Caddy doesn't run on a tailnet node.
+	APIKey string
+
+	// Tailnet is the tailnet to list with APIKey. The default is the
+	// tailnet of the key.
+	Tailnet string
+
+	// URL overrides the location of the API.
+	URL string
+
+	// Refresh is the interval between polls. The default is 1m.
+	Refresh caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	client    *http.Client
+}
+
+// tailscaleNode is a node of the tailnet, as listed by either API.
+type tailscaleNode struct {
+	HostName string
+	DNSName  string
+	Tags     []string
+	IPs      []string
+}
+
+func init() {
+	caddy.RegisterModule(tailscaleSource{})
+}
+
+func (tailscaleSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.tailscale",
+		New: func() caddy.Module {
+			return new(tailscaleSource)
+		},
+	}
+}
+
+func (s *tailscaleSource) Provision(ctx caddy.Context) error {
+	if len(s.Tags) == 0 && len(s.Hosts) == 0 {
+		return fmt.Errorf("either tags or hosts are required")
+	}
+	if s.Tailnet == "" {
+		s.Tailnet = "-"
+	}
+	s.client = &http.Client{Timeout: 30 * time.Second}
+	if s.APIKey == "" {
+		if s.Socket == "" {
+			s.Socket = tailscaleSocket
+		}
+		if s.URL == "" {
+			// the host name is ignored; tailscaled only checks it
+			s.URL = "http://local-tailscaled.sock"
+		}
+		socket := s.Socket
+		s.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	} else if s.URL == "" {
+		s.URL = tailscaleAPI
+	}
+
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Minute
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+// fetch returns the addresses of the selected nodes.
+func (s *tailscaleSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	var nodes []tailscaleNode
+	var err error
+	if s.APIKey == "" {
+		nodes, err = s.localNodes(ctx)
+	} else {
+		nodes, err = s.apiNodes(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ranges []*net.IPNet
+	for _, node := range nodes {
+		if !s.selects(node) {
+			continue
+		}
+		for _, ip := range node.IPs {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				ranges = append(ranges, hostRange(parsed))
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// selects reports whether node has one of the tags or host names.
+func (s *tailscaleSource) selects(node tailscaleNode) bool {
+	for _, tag := range node.Tags {
+		if containsFold(s.Tags, tag) {
+			return true
+		}
+	}
+	dnsName := strings.TrimSuffix(node.DNSName, ".")
+	for _, host := range s.Hosts {
+		host = strings.TrimSuffix(host, ".")
+		if strings.EqualFold(host, node.HostName) || strings.EqualFold(host, dnsName) {
+			return true
+		}
+		// a short name matches the first label of the MagicDNS name
+		if i := strings.IndexByte(dnsName, '.'); i > 0 && strings.EqualFold(host, dnsName[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// localNodes lists the peers known to the local tailscaled.
+func (s *tailscaleSource) localNodes(ctx context.Context) ([]tailscaleNode, error) {
+	var status struct {
+		Peer map[string]struct {
+			HostName     string
+			DNSName      string
+			Tags         []string
+			TailscaleIPs []string
+		}
+	}
+	if err := s.get(ctx, "/localapi/v0/status", &status); err != nil {
+		return nil, err
+	}
+	// sort the peers so that the ranges only change when the peers do
+	keys := make([]string, 0, len(status.Peer))
+	for key := range status.Peer {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodes := make([]tailscaleNode, 0, len(keys))
+	for _, key := range keys {
+		peer := status.Peer[key]
+		nodes = append(nodes, tailscaleNode{peer.HostName, peer.DNSName, peer.Tags, peer.TailscaleIPs})
+	}
+	return nodes, nil
+}
+
+// apiNodes lists the devices of the tailnet through Tailscale's API.
+func (s *tailscaleSource) apiNodes(ctx context.Context) ([]tailscaleNode, error) {
+	var list struct {
+		Devices []struct {
+			Addresses []string `json:"addresses"`
+			Hostname  string   `json:"hostname"`
+			Name      string   `json:"name"`
+			Tags      []string `json:"tags"`
+		} `json:"devices"`
+	}
+	if err := s.get(ctx, "/api/v2/tailnet/"+url.PathEscape(s.Tailnet)+"/devices", &list); err != nil {
+		return nil, err
+	}
+	nodes := make([]tailscaleNode, 0, len(list.Devices))
+	for _, device := range list.Devices {
+		nodes = append(nodes, tailscaleNode{device.Hostname, device.Name, device.Tags, device.Addresses})
+	}
+	return nodes, nil
+}
+
+// get requests path from the API and decodes the response into v.
+func (s *tailscaleSource) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", s.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: unexpected status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *tailscaleSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *tailscaleSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Arguments
+// starting with "tag:" are tags, the others host names:
+//
+//	tailscale [<tags|hosts...>] {
+//	    tags <tags...>
+//	    hosts <names...>
+//	    socket <path>
+//	    api_key <key>
+//	    tailnet <name>
+//	    url <url>
+//	    refresh <interval>
+//	    max_stale <duration>
+//	    on_stale open|closed
+//	}
+func (s *tailscaleSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	for d.NextArg() {
+		if strings.HasPrefix(d.Val(), "tag:") {
+			s.Tags = append(s.Tags, d.Val())
+		} else {
+			s.Hosts = append(s.Hosts, d.Val())
+		}
+	}
+	for d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "tags":
+			s.Tags = append(s.Tags, d.RemainingArgs()...)
+			if len(s.Tags) == 0 {
+				err = d.ArgErr()
+			}
+		case "hosts":
+			s.Hosts = append(s.Hosts, d.RemainingArgs()...)
+			if len(s.Hosts) == 0 {
+				err = d.ArgErr()
+			}
+		case "socket":
+			err = parseStringArg(d, &s.Socket)
+		case "api_key":
+			err = parseStringArg(d, &s.APIKey)
+		case "tailnet":
+			err = parseStringArg(d, &s.Tailnet)
+		case "url":
+			err = parseStringArg(d, &s.URL)
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown tailscale source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*tailscaleSource)(nil)
+	_ caddy.Provisioner     = (*tailscaleSource)(nil)
+	_ caddy.CleanerUpper    = (*tailscaleSource)(nil)
+	_ caddyfile.Unmarshaler = (*tailscaleSource)(nil)
+)
@@ -0,0 +1,169 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// urlSource fetches a list of ranges, one per line, from a URL and
+// refreshes it periodically. ETag and Last-Modified are honored, so an
+// unchanged list is not downloaded again, and the previous list is kept
+// when a fetch fails.
+type urlSource struct {
+	// URL is the location of the list.
+	URL string
+
+	// Refresh is the interval between fetches. The default is 1h.
+	Refresh caddy.Duration
+
+	// Timeout bounds each fetch. The default is 30s.
+	Timeout caddy.Duration
+
+	stalePolicy
+
+	refresher rangeRefresher
+	http      httpFetcher
+}
+
+// maxRangeListBytes caps the size of a fetched list of ranges.
+const maxRangeListBytes = 4 << 20
+
+func init() {
+	caddy.RegisterModule(urlSource{})
+}
+
+func (urlSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "realip.ip_sources.url",
+		New: func() caddy.Module {
+			return new(urlSource)
+		},
+	}
+}
+
+func (s *urlSource) Provision(ctx caddy.Context) error {
+	if s.URL == "" {
+		return fmt.Errorf("missing URL")
+	}
+	s.http = newHTTPFetcher(s.Timeout)
+	s.refresher.fetch = s.fetch
+	s.refresher.interval = time.Duration(s.Refresh)
+	if s.refresher.interval == 0 {
+		s.refresher.interval = time.Hour
+	}
+	if err := s.stalePolicy.configure(&s.refresher); err != nil {
+		return err
+	}
+	s.refresher.logger = ctx.Logger(s)
+	s.refresher.startShared(ctx, s, nil)
+	return nil
+}
+
+func (s *urlSource) fetch(ctx context.Context) ([]*net.IPNet, error) {
+	return s.http.get(ctx, s.URL, parseRangeList, s.refresher.current())
+}
+
+// httpFetcher fetches lists of ranges over HTTP with conditional requests,
+// so that an unchanged list is not downloaded and parsed again.
+type httpFetcher struct {
+	client       *http.Client
+	etag         string
+	lastModified string
+}
+
+// newHTTPFetcher returns an httpFetcher whose requests time out after
+// timeout, or 30s if it is zero.
+func newHTTPFetcher(timeout caddy.Duration) httpFetcher {
+	if timeout == 0 {
+		timeout = caddy.Duration(30 * time.Second)
+	}
+	return httpFetcher{client: &http.Client{Timeout: time.Duration(timeout)}}
+}
+
+// get fetches url and parses the body with parse. It returns current if
+// the list has not been modified since the last successful fetch.
+func (f *httpFetcher) get(ctx context.Context, url string, parse func(io.Reader) ([]*net.IPNet, error), current []*net.IPNet) ([]*net.IPNet, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return current, nil
+	default:
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", url, resp.Status)
+	}
+	ranges, err := parse(io.LimitReader(resp.Body, maxRangeListBytes))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", url, err)
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return ranges, nil
+}
+
+func (s *urlSource) IPRanges() []*net.IPNet {
+	return s.refresher.IPRanges()
+}
+
+func (s *urlSource) Cleanup() error {
+	return s.refresher.stop()
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens:
+//
+//	url <url> [refresh <interval>] [timeout <duration>] [max_stale <duration>] [on_stale open|closed]
+//
+// The options may also be given in a block.
+func (s *urlSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&s.URL) {
+		return d.ArgErr()
+	}
+	for d.NextArg() || d.NextBlock(0) {
+		var err error
+
+		switch d.Val() {
+		case "refresh":
+			err = parseDurationArg(d, &s.Refresh)
+		case "timeout":
+			err = parseDurationArg(d, &s.Timeout)
+		case "max_stale", "on_stale":
+			err = s.stalePolicy.parseCaddyfile(d)
+		default:
+			return d.Errf("Unknown url source arg")
+		}
+		if err != nil {
+			return d.Errf("Error parsing %s: %s", d.Val(), err)
+		}
+	}
+	return nil
+}
+
+var (
+	_ IPSource              = (*urlSource)(nil)
+	_ caddy.Provisioner     = (*urlSource)(nil)
+	_ caddy.CleanerUpper    = (*urlSource)(nil)
+	_ caddyfile.Unmarshaler = (*urlSource)(nil)
+)
@@ -0,0 +1,73 @@
+package realip
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Via modes
+const (
+	viaLog    = "log"
+	viaReject = "reject"
+)
+
+// viaHops returns the number of proxies declared by the Via header lines.
+// Commas inside comments, which are enclosed in parentheses, don't
+// separate entries.
+func viaHops(values []string) int {
+	hops := 0
+	for _, value := range values {
+		depth, empty := 0, true
+		for _, c := range value {
+			switch {
+			case c == '(':
+				depth++
+			case c == ')' && depth > 0:
+				depth--
+			case c == ',' && depth == 0:
+				if !empty {
+					hops++
+				}
+				empty = true
+				continue
+			}
+			if c != ' ' && c != '\t' {
+				empty = false
+			}
+		}
+		if !empty {
+			hops++
+		}
+	}
+	return hops
+}
+
+// checkVia compares the number of proxies declared in the Via header with
+// the length of a forward chain. Every proxy adds one Via entry and one
+// chain entry, so a divergence beyond ViaTolerance points to a malformed or
+// injected chain. It returns errViaMismatch if such requests are rejected.
+func (m *module) checkVia(req *http.Request, chainLen int) error {
+	if m.Via == "" {
+		return nil
+	}
+	via := viaHops(req.Header.Values("Via"))
+	diff := via - chainLen
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff <= m.ViaTolerance {
+		return nil
+	}
+	if m.logger != nil {
+		m.logger.Warn("forward chain length does not match Via header",
+			zap.String("remote_addr", req.RemoteAddr),
+			zap.Int("chain_hops", chainLen),
+			zap.Int("via_hops", via),
+		)
+	}
+	if m.Via == viaReject {
+		return errViaMismatch
+	}
+	return nil
+}